@@ -2,6 +2,9 @@ module backend
 
 go 1.19
 
-require github.com/gyozatech/temaki v0.1.0
+require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/gyozatech/temaki v0.1.0
+)
 
 require github.com/gyozatech/noodlog v0.0.0-20211006161024-c2cd168c8400 // indirect
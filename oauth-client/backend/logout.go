@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// the Oauth2 provider: its keys sign the id_tokens and the logout tokens
+	providerIssuer  = "http://localhost:8080"
+	providerJWKSURI = providerIssuer + "/.well-known/jwks.json"
+	clientID        = "12345"
+
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+)
+
+// AppSession is the login of a user to TheCommunity, identified by the app-token given to the frontend
+type AppSession struct {
+	UserID   string // the sub claim of the id_token
+	SID      string // the sid claim of the id_token: the WalrusMail session the user has logged in with
+	UserInfo UserInfo
+}
+
+var appSessions = struct {
+	sync.Mutex
+	byToken map[string]AppSession
+	// the jti of the logout tokens already received, until they expire: a logout token can't be replayed
+	usedLogoutTokens map[string]time.Time
+}{
+	byToken:          map[string]AppSession{},
+	usedLogoutTokens: map[string]time.Time{},
+}
+
+// startAppSession returns the app-token of the new session
+func startAppSession(session AppSession) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	appToken := hex.EncodeToString(tokenBytes)
+	appSessions.Lock()
+	defer appSessions.Unlock()
+	appSessions.byToken[appToken] = session
+	return appToken, nil
+}
+
+func findAppSession(appToken string) (AppSession, bool) {
+	appSessions.Lock()
+	defer appSessions.Unlock()
+	session, found := appSessions.byToken[appToken]
+	return session, found
+}
+
+// endAppSessions ends the sessions started from the WalrusMail session sid or, without sid, all the sessions of the user
+func endAppSessions(userID, sid string) int {
+	appSessions.Lock()
+	defer appSessions.Unlock()
+	ended := 0
+	for appToken, session := range appSessions.byToken {
+		if (sid != "" && session.SID == sid) || (sid == "" && session.UserID == userID) {
+			delete(appSessions.byToken, appToken)
+			ended++
+		}
+	}
+	return ended
+}
+
+// useLogoutToken records the jti of the logout token: false if it had already been used
+func useLogoutToken(jti string, expiresAt time.Time) bool {
+	appSessions.Lock()
+	defer appSessions.Unlock()
+	now := time.Now()
+	for usedJTI, usedExpiresAt := range appSessions.usedLogoutTokens {
+		if now.After(usedExpiresAt) {
+			delete(appSessions.usedLogoutTokens, usedJTI)
+		}
+	}
+	if _, used := appSessions.usedLogoutTokens[jti]; used {
+		return false
+	}
+	appSessions.usedLogoutTokens[jti] = expiresAt
+	return true
+}
+
+// HANDLERS ********
+
+// sessionHandler returns the user of the app-token, or 401 if the session has ended
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, found := findAppSession(r.Header.Get("app-token"))
+	if !found {
+		http.Error(w, "Session ended", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session.UserInfo)
+}
+
+// backchannelLogoutHandler receives the logout token posted by WalrusMail when the user logs out there
+// (OpenID Connect Back-Channel Logout): the app sessions started from the ended WalrusMail session end too
+func backchannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	claims, err := verifyLogoutToken(r.FormValue("logout_token"))
+	if err != nil {
+		log.Println("Invalid logout token:", err)
+		http.Error(w, "Invalid logout token", http.StatusBadRequest)
+		return
+	}
+	userID, _ := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	log.Printf("Back-channel logout of %s: %d app sessions ended\n", userID, endAppSessions(userID, sid))
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyLogoutToken validates the logout token as required by OpenID Connect Back-Channel Logout section 2.6
+func verifyLogoutToken(logoutToken string) (jwt.MapClaims, error) {
+	claims, err := verifyProviderJWT(logoutToken)
+	if err != nil {
+		return nil, err
+	}
+	events, _ := claims["events"].(map[string]interface{})
+	if _, found := events[backchannelLogoutEvent]; !found {
+		return nil, fmt.Errorf("missing the back-channel logout event")
+	}
+	if _, found := claims["nonce"]; found {
+		return nil, fmt.Errorf("a logout token must not have a nonce")
+	}
+	if claims["sub"] == nil && claims["sid"] == nil {
+		return nil, fmt.Errorf("missing both sub and sid")
+	}
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if jti == "" || !useLogoutToken(jti, time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("missing or already used jti")
+	}
+	return claims, nil
+}
+
+// verifyProviderJWT verifies the signature, the expiry, the issuer and the audience of a jwt issued by WalrusMail to the app
+func verifyProviderJWT(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, providerKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if !claims.VerifyIssuer(providerIssuer, true) || !claims.VerifyAudience(clientID, true) {
+		return nil, fmt.Errorf("the token has not been issued by %s to %s", providerIssuer, clientID)
+	}
+	return claims, nil
+}
+
+// JWK is a public key of the JSON Web Key Set of the provider
+type JWK struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// providerKey returns the public key of the provider matching the kid of the token: the keys are fetched every time,
+// since they may have been rotated and the tokens to verify are few
+func providerKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	resp, err := http.Get(providerJWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	jwks := struct {
+		Keys []JWK `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid == kid {
+			if jwk.Alg != token.Method.Alg() {
+				return nil, fmt.Errorf("the key %s is not for %s", kid, token.Method.Alg())
+			}
+			return jwk.publicKey()
+		}
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+func (jwk JWK) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
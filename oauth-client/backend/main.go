@@ -23,6 +23,10 @@ func main() {
 	router.UseMiddleware(middlewares.RecoverPanicMiddleware)
 
 	router.POST("/exchange-token", exchangeTokenHandler)
+	// tells the frontend if the session of the app-token is still alive
+	router.GET("/session", sessionHandler)
+	// WalrusMail posts here the logout token when the user logs out there
+	router.POST("/backchannel-logout", backchannelLogoutHandler)
 
 	log.Fatal(router.Start(8082))
 
@@ -38,9 +42,11 @@ type ExchangeTokenRequest struct {
 
 // AccessTokenResponse is the response provided in the second step of the Oauth2 protocol
 type AccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
 }
 
 // UserInfo contains the info about the user and is the response provided in the second step of the Oauth2 protocol
@@ -120,8 +126,24 @@ func exchangeTokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(userInfo)
 
-	appToken := generateAppTokenFromUserInfo(userInfo)
-	log.Println("app-token header: " + appToken)
+	// the id_token tells which WalrusMail session the user has logged in with: the app session ends with it
+	session := AppSession{UserInfo: userInfo}
+	if accessTokenResp.IDToken != "" {
+		idTokenClaims, err := verifyProviderJWT(accessTokenResp.IDToken)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Invalid id_token got from the Oauth2 provider", http.StatusInternalServerError)
+			return
+		}
+		session.UserID, _ = idTokenClaims["sub"].(string)
+		session.SID, _ = idTokenClaims["sid"].(string)
+	}
+	appToken, err := startAppSession(session)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while starting the app session", http.StatusInternalServerError)
+		return
+	}
 
 	// returning the app token in the headers
 	w.Header().Set("app-token", appToken)
@@ -134,8 +156,3 @@ func exchangeTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// json.NewEncoder(w).Encode(userInfo)
 
 }
-
-func generateAppTokenFromUserInfo(userInfo UserInfo) string {
-	// This simulates the generation of the app token, extraneous to the access_token got from the Oauth2 provider
-	return "my-app-token-from-user-info"
-}
@@ -27,6 +27,8 @@ func main() {
 	router.GET("/login", loginHandler)
 	// is a page that performs an Ajax request to the Backend to exchange the code with the access token
 	router.GET("/redirect", redirectHandler)
+	// loaded by WalrusMail in an iframe when the user logs out there: it removes the app-token from the browser
+	router.GET("/frontchannel-logout", frontchannelLogoutHandler)
 
 	log.Fatal(router.Start(8081))
 
@@ -63,6 +65,18 @@ func redirectHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, redirectPage)
 }
 
+func frontchannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	frontchannelLogoutPage, err := generatePage("frontchannel_logout")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while fetching front-channel logout page", http.StatusInternalServerError)
+		return
+	}
+	// the page must not be cached: it has to run at every logout
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	fmt.Fprint(w, frontchannelLogoutPage)
+}
+
 func generateIndexPage() (htmlPage string, err error) {
 	return generatePage("welcome")
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"provider/database"
+	"provider/mailer"
+)
+
+const (
+	defaultDatabaseDriver = "memory"
+	defaultSQLitePath     = "oauth-server.db"
+	defaultMailer         = "log"
+	defaultMailFrom       = "no-reply@walrusmail.local"
+	defaultMailerFile     = "emails.txt"
+	defaultSMTPPort       = 587
+)
+
+// newStore creates the store selected by DATABASE_DRIVER: the in-memory tables (default) or an SQLite database at SQLITE_PATH
+func newStore() (database.Store, error) {
+	driver := os.Getenv("DATABASE_DRIVER")
+	if driver == "" {
+		driver = defaultDatabaseDriver
+	}
+	switch driver {
+	case "memory":
+		return database.NewMemoryStore(), nil
+	case "sqlite":
+		return database.NewSQLiteStore(sqlitePath())
+	default:
+		return nil, fmt.Errorf("Unsupported DATABASE_DRIVER %q: use memory or sqlite", driver)
+	}
+}
+
+func sqlitePath() string {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return path
+	}
+	return defaultSQLitePath
+}
+
+// newMailer creates the mailer selected by MAILER: log (default) prints the emails, file appends them to MAILER_FILE
+// and smtp sends them through SMTP_HOST:SMTP_PORT, authenticating with SMTP_USERNAME and SMTP_PASSWORD if set.
+// The sender is MAIL_FROM
+func newMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+	kind := os.Getenv("MAILER")
+	if kind == "" {
+		kind = defaultMailer
+	}
+	switch kind {
+	case "log":
+		return &mailer.LogMailer{From: from}, nil
+	case "file":
+		path := os.Getenv("MAILER_FILE")
+		if path == "" {
+			path = defaultMailerFile
+		}
+		return &mailer.FileMailer{Path: path, From: from}, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required by the smtp mailer")
+		}
+		port, err := positiveIntFromEnv("SMTP_PORT", defaultSMTPPort)
+		if err != nil {
+			return nil, err
+		}
+		return &mailer.SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported MAILER %q: use log, file or smtp", kind)
+	}
+}
+
+// positiveIntFromEnv reads a positive number from the environment variable, defaultValue if it is not set
+func positiveIntFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return number, nil
+}
+
+// runCommand runs the maintenance command given on the command line instead of starting the server:
+//
+//	seed                  applies the migrations and inserts the demo users and apps into the SQLite database
+//	migrate-down VERSION  rolls back the SQLite migrations after VERSION (0 drops all the tables)
+func runCommand(args []string) {
+	switch args[0] {
+	case "seed":
+		store, err := database.NewSQLiteStore(sqlitePath())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		if err := store.SeedDemoData(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Demo users and apps seeded into", sqlitePath())
+	case "migrate-down":
+		if len(args) < 2 {
+			log.Fatal("Usage: migrate-down VERSION")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			log.Fatal("VERSION must be a non negative number")
+		}
+		db, err := database.OpenSQLite(sqlitePath())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if err := database.MigrateDown(db, version); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown command %q: use seed or migrate-down VERSION", args[0])
+	}
+}
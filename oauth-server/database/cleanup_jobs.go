@@ -0,0 +1,41 @@
+package database
+
+import (
+	"fmt"
+
+	cron "github.com/robfig/cron/v3"
+)
+
+// StartCleanupJobs schedules the deletion of the expired records from the stores
+func StartCleanupJobs(sessionStore SessionStore, tokenStore TokenStore, loginAttemptStore LoginAttemptStore, emailTokenStore EmailTokenStore) {
+	c := cron.New()
+	c.AddFunc("@every 1m", func() {
+		fmt.Println("Checking for expired Oauth2 sessions... [Job started]")
+		sessionStore.DeleteExpiredOauth2Sessions()
+		sessionStore.DeleteExpiredDeviceAuthorizations()
+		sessionStore.DeleteExpiredSSOSessions()
+		fmt.Println("Checking for expired Oauth2 sessions... [Job completed]")
+	})
+	c.AddFunc("@every 1m", func() {
+		fmt.Println("Checking for expired revoked tokens... [Job started]")
+		// once expired the token is rejected anyway, so it doesn't need to be in the revocation list anymore
+		tokenStore.DeleteExpiredRevokedTokens()
+		fmt.Println("Checking for expired revoked tokens... [Job completed]")
+	})
+	c.AddFunc("@every 1h", func() {
+		fmt.Println("Checking for expired refresh tokens... [Job started]")
+		tokenStore.DeleteExpiredRefreshTokens()
+		fmt.Println("Checking for expired refresh tokens... [Job completed]")
+	})
+	c.AddFunc("@every 1h", func() {
+		fmt.Println("Checking for expired login attempts... [Job started]")
+		loginAttemptStore.DeleteExpiredLoginAttempts()
+		fmt.Println("Checking for expired login attempts... [Job completed]")
+	})
+	c.AddFunc("@every 1h", func() {
+		fmt.Println("Checking for expired email tokens... [Job started]")
+		emailTokenStore.DeleteExpiredEmailTokens()
+		fmt.Println("Checking for expired email tokens... [Job completed]")
+	})
+	c.Start()
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// Consent represents the DB record for consents table: the scopes the user has granted to the app, and among them the
+// ones the user has asked to remember, so that the consent page is skipped until the app requests new scopes
+type Consent struct {
+	UserID          string
+	AppID           string
+	Scope           string    // space separated: all the scopes granted so far
+	RememberedScope string    // space separated: the granted scopes the consent page is skipped for
+	GrantedAt       time.Time // the last time the user has granted scopes
+}
+
+// Covers tells if all the space separated scopes have been granted and remembered
+func (c *Consent) Covers(scope string) bool {
+	return len(c.MissingScopes(scope)) == 0
+}
+
+// MissingScopes returns the space separated scopes that have not been granted and remembered yet
+func (c *Consent) MissingScopes(scope string) []string {
+	granted := strings.Fields(c.RememberedScope)
+	var missing []string
+	for _, requested := range strings.Fields(scope) {
+		if !containsScope(granted, requested) && !containsScope(missing, requested) {
+			missing = append(missing, requested)
+		}
+	}
+	return missing
+}
+
+// mergeScopes adds the newly granted scopes to the ones already granted
+func mergeScopes(granted, scope string) string {
+	merged := strings.Fields(granted)
+	for _, s := range strings.Fields(scope) {
+		if !containsScope(merged, s) {
+			merged = append(merged, s)
+		}
+	}
+	return strings.Join(merged, " ")
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func consentKey(userID, appID string) string {
+	return userID + " " + appID
+}
+
+func (s *MemoryStore) FindConsent(userID, appID string) *Consent {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	consent := s.consentsTable[consentKey(userID, appID)]
+	if consent == nil {
+		return nil
+	}
+	consentCopy := *consent
+	return &consentCopy
+}
+
+// SaveConsent records that the user has granted the space separated scopes to the app, besides the ones granted before,
+// and remembers them if asked
+func (s *MemoryStore) SaveConsent(userID, appID, scope string, remember bool) (*Consent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := consentKey(userID, appID)
+	consent := s.consentsTable[key]
+	if consent == nil {
+		consent = &Consent{UserID: userID, AppID: appID}
+		s.consentsTable[key] = consent
+	}
+	consent.Scope = mergeScopes(consent.Scope, scope)
+	if remember {
+		consent.RememberedScope = mergeScopes(consent.RememberedScope, scope)
+	}
+	consent.GrantedAt = time.Now()
+	consentCopy := *consent
+	return &consentCopy, nil
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DeviceCodeExpiresIn is the validity of device_code and user_code in seconds
+	DeviceCodeExpiresIn = 10 * 60
+	// DeviceCodeInterval is the minimum amount of seconds the device must wait between polling requests
+	DeviceCodeInterval = 5
+)
+
+// user codes are typed by the user so they use only consonants (no vowels means no accidental words, RFC 8628 section 6.1)
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceAuthorization represents a pending device authorization grant (RFC 8628)
+type DeviceAuthorization struct {
+	DeviceCode   string // works as an ID
+	UserCode     string
+	AppID        string
+	Scope        string
+	Email        *string   // set when the user approves the request on the verification page
+	AMR          []string  // OpenID Connect: how the user logged in to approve the request
+	AuthTime     time.Time // OpenID Connect: when the user logged in to approve the request
+	Denied       bool      // set when the user denies the request on the verification page
+	Interval     int
+	LastPolledAt time.Time
+	CreatedAt    time.Time
+	ExpiresIn    int
+}
+
+// IsExpired tells if the device_code and user_code have outlived their validity
+func (d *DeviceAuthorization) IsExpired() bool {
+	return time.Since(d.CreatedAt) > time.Duration(d.ExpiresIn)*time.Second
+}
+
+// DeleteExpiredDeviceAuthorizations removes the device authorizations whose codes have expired
+func (s *MemoryStore) DeleteExpiredDeviceAuthorizations() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Loop over the slice in reverse order
+	for i := len(s.deviceAuthorizationsTable) - 1; i >= 0; i-- {
+		if s.deviceAuthorizationsTable[i].IsExpired() {
+			s.deviceAuthorizationsTable = append(s.deviceAuthorizationsTable[:i], s.deviceAuthorizationsTable[i+1:]...)
+		}
+	}
+}
+
+// UpdateDeviceAuthorizationPolling records the last polling request of the device and the interval it must respect
+func (s *MemoryStore) UpdateDeviceAuthorizationPolling(deviceCode string, lastPolledAt time.Time, interval int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deviceAuthorization := s.findDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil {
+		return fmt.Errorf("Device authorization not found")
+	}
+	deviceAuthorization.LastPolledAt = lastPolledAt
+	deviceAuthorization.Interval = interval
+	return nil
+}
+
+// SaveNewDeviceAuthorization starts a new device authorization grant generating the device_code and the user_code
+func (s *MemoryStore) SaveNewDeviceAuthorization(clientID, scope string) (*DeviceAuthorization, error) {
+	app := s.FindRegisteredAppByClientID(clientID)
+	if app == nil {
+		return nil, fmt.Errorf("App not found among the registered apps")
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+	deviceAuthorization := &DeviceAuthorization{
+		DeviceCode: uuid.New().String(),
+		UserCode:   userCode,
+		AppID:      app.ID,
+		Scope:      scope,
+		Interval:   DeviceCodeInterval,
+		CreatedAt:  time.Now(),
+		ExpiresIn:  DeviceCodeExpiresIn,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deviceAuthorizationsTable = append(s.deviceAuthorizationsTable, deviceAuthorization)
+	return copyDeviceAuthorization(deviceAuthorization), nil
+}
+
+func (s *MemoryStore) FindDeviceAuthorizationByDeviceCode(deviceCode string) *DeviceAuthorization {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyDeviceAuthorization(s.findDeviceAuthorizationByDeviceCode(deviceCode))
+}
+
+// FindDeviceAuthorizationByUserCode looks for the user_code ignoring case, spaces and dashes typed by the user
+func (s *MemoryStore) FindDeviceAuthorizationByUserCode(userCode string) *DeviceAuthorization {
+	userCode = NormalizeUserCode(userCode)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, deviceAuthorization := range s.deviceAuthorizationsTable {
+		if NormalizeUserCode(deviceAuthorization.UserCode) == userCode {
+			return copyDeviceAuthorization(deviceAuthorization)
+		}
+	}
+	return nil
+}
+
+// ApproveDeviceAuthorization records the user who has approved the device, how the user logged in and the scopes granted
+func (s *MemoryStore) ApproveDeviceAuthorization(deviceCode, email, scope string, amr []string, authTime time.Time) (*DeviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deviceAuthorization := s.findDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil {
+		return nil, fmt.Errorf("Device authorization not found")
+	}
+	deviceAuthorization.Email = &email
+	deviceAuthorization.Scope = scope
+	deviceAuthorization.AMR = append([]string(nil), amr...)
+	deviceAuthorization.AuthTime = authTime
+	return copyDeviceAuthorization(deviceAuthorization), nil
+}
+
+// DenyDeviceAuthorization records that the user has denied the request: the device gets access_denied
+func (s *MemoryStore) DenyDeviceAuthorization(deviceCode string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deviceAuthorization := s.findDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil {
+		return fmt.Errorf("Device authorization not found")
+	}
+	deviceAuthorization.Denied = true
+	return nil
+}
+
+// DeleteDeviceAuthorization removes the device authorization once the device_code has been exchanged with the tokens
+func (s *MemoryStore) DeleteDeviceAuthorization(deviceCode string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, deviceAuthorization := range s.deviceAuthorizationsTable {
+		if deviceAuthorization.DeviceCode == deviceCode {
+			s.deviceAuthorizationsTable = append(s.deviceAuthorizationsTable[:i], s.deviceAuthorizationsTable[i+1:]...)
+			return
+		}
+	}
+}
+
+// RedeemDeviceAuthorization removes the approved device authorization and returns it: only one of the concurrent
+// polls of the device can get it, so that the device_code is exchanged with the tokens only once
+func (s *MemoryStore) RedeemDeviceAuthorization(deviceCode string) *DeviceAuthorization {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, deviceAuthorization := range s.deviceAuthorizationsTable {
+		if deviceAuthorization.DeviceCode == deviceCode {
+			if deviceAuthorization.Email == nil || deviceAuthorization.Denied {
+				return nil
+			}
+			s.deviceAuthorizationsTable = append(s.deviceAuthorizationsTable[:i], s.deviceAuthorizationsTable[i+1:]...)
+			return deviceAuthorization
+		}
+	}
+	return nil
+}
+
+// findDeviceAuthorizationByDeviceCode returns the stored record: the caller must hold the mutex
+func (s *MemoryStore) findDeviceAuthorizationByDeviceCode(deviceCode string) *DeviceAuthorization {
+	for _, deviceAuthorization := range s.deviceAuthorizationsTable {
+		if deviceAuthorization.DeviceCode == deviceCode {
+			return deviceAuthorization
+		}
+	}
+	return nil
+}
+
+func copyDeviceAuthorization(deviceAuthorization *DeviceAuthorization) *DeviceAuthorization {
+	if deviceAuthorization == nil {
+		return nil
+	}
+	deviceAuthorizationCopy := *deviceAuthorization
+	deviceAuthorizationCopy.AMR = append([]string(nil), deviceAuthorization.AMR...)
+	return &deviceAuthorizationCopy
+}
+
+// NormalizeUserCode makes the user_code comparable regardless of how the user typed it
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.ReplaceAll(userCode, "-", "")
+	return strings.ReplaceAll(userCode, " ", "")
+}
+
+// generateUserCode generates a user_code in the form XXXX-XXXX
+func generateUserCode() (string, error) {
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	userCode := make([]byte, 0, 9)
+	for i, b := range randomBytes {
+		if i == 4 {
+			userCode = append(userCode, '-')
+		}
+		userCode = append(userCode, userCodeCharset[int(b)%len(userCodeCharset)])
+	}
+	return string(userCode), nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// purposes of the links sent by email
+const (
+	EmailTokenPurposeVerifyEmail   = "verify_email"
+	EmailTokenPurposeResetPassword = "reset_password"
+)
+
+// how long the links sent by email can be used, in seconds
+const (
+	EmailVerificationTokenExpiresIn = 24 * 60 * 60 // 24 hours
+	PasswordResetTokenExpiresIn     = 60 * 60      // 1 hour: the link gives access to the account
+)
+
+// EmailToken represents the DB record for email_tokens table: the single-use tokens of the links sent by email.
+// Only the hash of the token is stored, the token itself is known only to the owner of the mailbox
+type EmailToken struct {
+	TokenHash string
+	UserID    string
+	Purpose   string
+	CreatedAt time.Time
+	ExpiresIn int
+}
+
+// IsExpired tells if the link can't be used anymore
+func (t *EmailToken) IsExpired() bool {
+	return time.Since(t.CreatedAt) > time.Duration(t.ExpiresIn)*time.Second
+}
+
+// SaveNewEmailToken stores the hash of a token sent to the user
+func (s *MemoryStore) SaveNewEmailToken(tokenHash, userID, purpose string, expiresIn int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.emailTokensTable[tokenHash]; exists {
+		return fmt.Errorf("Email token already exists")
+	}
+	s.emailTokensTable[tokenHash] = &EmailToken{
+		TokenHash: tokenHash,
+		UserID:    userID,
+		Purpose:   purpose,
+		CreatedAt: time.Now(),
+		ExpiresIn: expiresIn,
+	}
+	return nil
+}
+
+// FindEmailToken returns the token without using it: nil if it doesn't exist for the purpose
+func (s *MemoryStore) FindEmailToken(tokenHash, purpose string) *EmailToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	emailToken := s.emailTokensTable[tokenHash]
+	if emailToken == nil || emailToken.Purpose != purpose {
+		return nil
+	}
+	emailTokenCopy := *emailToken
+	return &emailTokenCopy
+}
+
+// ConsumeEmailToken deletes the token and returns it, so that a link works only once: nil if it doesn't exist for the purpose
+func (s *MemoryStore) ConsumeEmailToken(tokenHash, purpose string) *EmailToken {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	emailToken := s.emailTokensTable[tokenHash]
+	if emailToken == nil || emailToken.Purpose != purpose {
+		return nil
+	}
+	delete(s.emailTokensTable, tokenHash)
+	return emailToken
+}
+
+// DeleteEmailTokensOfUser invalidates the links with the purpose sent to the user
+func (s *MemoryStore) DeleteEmailTokensOfUser(userID, purpose string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for tokenHash, emailToken := range s.emailTokensTable {
+		if emailToken.UserID == userID && emailToken.Purpose == purpose {
+			delete(s.emailTokensTable, tokenHash)
+		}
+	}
+}
+
+// DeleteExpiredEmailTokens removes the links nobody has used in time
+func (s *MemoryStore) DeleteExpiredEmailTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for tokenHash, emailToken := range s.emailTokensTable {
+		if emailToken.IsExpired() {
+			delete(s.emailTokensTable, tokenHash)
+		}
+	}
+}
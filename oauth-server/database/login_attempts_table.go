@@ -0,0 +1,91 @@
+package database
+
+import "time"
+
+// LoginAttemptExpiresIn is how long the failed logins are remembered after the last one, in seconds (24 hours)
+const LoginAttemptExpiresIn = 24 * 60 * 60
+
+// LoginAttempt represents the DB record for login_attempts table: the failed logins of an account or of an IP address
+type LoginAttempt struct {
+	Key          string // email:<email> or ip:<address>
+	Failures     int
+	LastFailedAt time.Time
+}
+
+// LoginRetryAfterFunc tells how long the next login of the key must wait given its failed logins (nil if none): 0 or less if allowed now
+type LoginRetryAfterFunc func(key string, loginAttempt *LoginAttempt) time.Duration
+
+// DeleteExpiredLoginAttempts forgets the failed logins older than LoginAttemptExpiresIn
+func (s *MemoryStore) DeleteExpiredLoginAttempts() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, loginAttempt := range s.loginAttemptsTable {
+		if time.Since(loginAttempt.LastFailedAt) > LoginAttemptExpiresIn*time.Second {
+			delete(s.loginAttemptsTable, key)
+		}
+	}
+}
+
+func (s *MemoryStore) FindLoginAttempt(key string) *LoginAttempt {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loginAttempt := s.loginAttemptsTable[key]
+	if loginAttempt == nil {
+		return nil
+	}
+	loginAttemptCopy := *loginAttempt
+	return &loginAttemptCopy
+}
+
+// ReserveLoginAttempt counts a failed login for every key before the credentials are verified, so that concurrent logins
+// can't all be verified against the same count. Nothing is counted if one of the keys must wait: the longest wait is returned
+func (s *MemoryStore) ReserveLoginAttempt(keys []string, retryAfter LoginRetryAfterFunc) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		var loginAttemptCopy *LoginAttempt
+		if loginAttempt := s.loginAttemptsTable[key]; loginAttempt != nil {
+			copied := *loginAttempt
+			loginAttemptCopy = &copied
+		}
+		if keyWait := retryAfter(key, loginAttemptCopy); keyWait > wait {
+			wait = keyWait
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	now := time.Now()
+	for _, key := range keys {
+		loginAttempt := s.loginAttemptsTable[key]
+		if loginAttempt == nil {
+			loginAttempt = &LoginAttempt{Key: key}
+			s.loginAttemptsTable[key] = loginAttempt
+		}
+		loginAttempt.Failures++
+		loginAttempt.LastFailedAt = now
+	}
+	return 0, nil
+}
+
+// ReleaseLoginAttempt gives back the failed login reserved for the key once the credentials turn out to be right
+func (s *MemoryStore) ReleaseLoginAttempt(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	loginAttempt := s.loginAttemptsTable[key]
+	if loginAttempt == nil {
+		return
+	}
+	loginAttempt.Failures--
+	if loginAttempt.Failures <= 0 {
+		delete(s.loginAttemptsTable, key)
+	}
+}
+
+// DeleteLoginAttempt forgets the failed logins of the key: after a successful login or when an admin unlocks it
+func (s *MemoryStore) DeleteLoginAttempt(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.loginAttemptsTable, key)
+}
@@ -0,0 +1,47 @@
+package database
+
+import "sync"
+
+// MemoryStore keeps all the tables in memory: it implements UserStore, ClientStore, SessionStore, TokenStore, LoginAttemptStore and EmailTokenStore
+// The handlers and the cleanup jobs run concurrently, so every table is guarded by the mutex
+// and the records are returned as copies that can be read without holding it
+type MemoryStore struct {
+	mutex                     sync.RWMutex
+	usersTable                []*User
+	registeredOauth2AppsTable []*RegisteredOauth2App
+	oauth2SessionsByID        map[string]*Oauth2Session
+	oauth2SessionsByCode      map[string]*Oauth2Session
+	deviceAuthorizationsTable []*DeviceAuthorization
+	refreshTokensTable        []*RefreshToken
+	revokedTokensTable        []*RevokedToken
+	loginAttemptsTable        map[string]*LoginAttempt
+	emailTokensTable          map[string]*EmailToken
+	ssoSessionsTable          map[string]*SSOSession
+	consentsTable             map[string]*Consent // by user and app
+}
+
+// NewMemoryStore creates an in-memory store filled with the demo users and apps
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		usersTable:                DemoUsers(),
+		registeredOauth2AppsTable: DemoRegisteredOauth2Apps(),
+		oauth2SessionsByID:        map[string]*Oauth2Session{},
+		oauth2SessionsByCode:      map[string]*Oauth2Session{},
+		deviceAuthorizationsTable: []*DeviceAuthorization{},
+		refreshTokensTable:        []*RefreshToken{},
+		revokedTokensTable:        []*RevokedToken{},
+		loginAttemptsTable:        map[string]*LoginAttempt{},
+		emailTokensTable:          map[string]*EmailToken{},
+		ssoSessionsTable:          map[string]*SSOSession{},
+		consentsTable:             map[string]*Consent{},
+	}
+}
+
+// the in-memory store implements all the store interfaces
+var (
+	_ UserStore    = (*MemoryStore)(nil)
+	_ ClientStore  = (*MemoryStore)(nil)
+	_ SessionStore = (*MemoryStore)(nil)
+	_ TokenStore   = (*MemoryStore)(nil)
+	_ Store        = (*MemoryStore)(nil)
+)
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a versioned change of the SQL schema, with the statements to apply and to roll it back
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations are applied in order of version: never change an applied migration, add a new one instead
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create users and registered applications",
+		Up: `
+			CREATE TABLE users (
+				id       TEXT PRIMARY KEY,
+				name     TEXT NOT NULL,
+				email    TEXT NOT NULL UNIQUE,
+				password TEXT NOT NULL,
+				roles    TEXT NOT NULL
+			);
+			CREATE TABLE registered_applications (
+				id             TEXT PRIMARY KEY,
+				client_id      TEXT NOT NULL UNIQUE,
+				client_secret  TEXT NOT NULL,
+				redirect_uri   TEXT NOT NULL,
+				name           TEXT NOT NULL,
+				require_pkce   INTEGER NOT NULL DEFAULT 0,
+				allowed_scopes TEXT NOT NULL DEFAULT ''
+			);`,
+		Down: `
+			DROP TABLE registered_applications;
+			DROP TABLE users;`,
+	},
+	{
+		Version: 2,
+		Name:    "create oauth2 sessions and device authorizations",
+		Up: `
+			CREATE TABLE oauth2_sessions (
+				state                 TEXT PRIMARY KEY,
+				app_id                TEXT NOT NULL,
+				code                  TEXT UNIQUE,
+				scope                 TEXT NOT NULL,
+				email                 TEXT,
+				code_challenge        TEXT NOT NULL DEFAULT '',
+				code_challenge_method TEXT NOT NULL DEFAULT '',
+				device_code           TEXT NOT NULL DEFAULT '',
+				nonce                 TEXT NOT NULL DEFAULT '',
+				auth_time             INTEGER NOT NULL DEFAULT 0,
+				created_at            INTEGER NOT NULL
+			);
+			CREATE TABLE device_authorizations (
+				device_code    TEXT PRIMARY KEY,
+				user_code      TEXT NOT NULL UNIQUE,
+				app_id         TEXT NOT NULL,
+				scope          TEXT NOT NULL,
+				email          TEXT,
+				interval       INTEGER NOT NULL,
+				last_polled_at INTEGER NOT NULL DEFAULT 0,
+				created_at     INTEGER NOT NULL,
+				expires_in     INTEGER NOT NULL
+			);`,
+		Down: `
+			DROP TABLE device_authorizations;
+			DROP TABLE oauth2_sessions;`,
+	},
+	{
+		Version: 3,
+		Name:    "create refresh tokens and revoked tokens",
+		Up: `
+			CREATE TABLE refresh_tokens (
+				token            TEXT PRIMARY KEY,
+				family_id        TEXT NOT NULL,
+				app_id           TEXT NOT NULL,
+				user_id          TEXT NOT NULL,
+				scope            TEXT NOT NULL,
+				access_token_jti TEXT NOT NULL DEFAULT '',
+				used             INTEGER NOT NULL DEFAULT 0,
+				revoked          INTEGER NOT NULL DEFAULT 0,
+				created_at       INTEGER NOT NULL,
+				expires_in       INTEGER NOT NULL
+			);
+			CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);
+			CREATE INDEX refresh_tokens_access_token_jti ON refresh_tokens (access_token_jti);
+			CREATE TABLE revoked_tokens (
+				jti        TEXT PRIMARY KEY,
+				expires_at INTEGER NOT NULL,
+				revoked_at INTEGER NOT NULL
+			);`,
+		Down: `
+			DROP TABLE revoked_tokens;
+			DROP TABLE refresh_tokens;`,
+	},
+	{
+		Version: 4,
+		Name:    "create consents",
+		Up: `
+			CREATE TABLE consents (
+				user_id    TEXT NOT NULL,
+				app_id     TEXT NOT NULL,
+				scope      TEXT NOT NULL,
+				granted_at INTEGER NOT NULL,
+				PRIMARY KEY (user_id, app_id)
+			);`,
+		Down: `
+			DROP TABLE consents;`,
+	},
+	{
+		Version: 5,
+		Name:    "bind authorization codes to the redirect uri and make them single use",
+		Up: `
+			ALTER TABLE oauth2_sessions ADD COLUMN redirect_uri TEXT NOT NULL DEFAULT '';
+			ALTER TABLE oauth2_sessions ADD COLUMN code_issued_at INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE oauth2_sessions ADD COLUMN code_redeemed INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE oauth2_sessions ADD COLUMN family_id TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE oauth2_sessions DROP COLUMN family_id;
+			ALTER TABLE oauth2_sessions DROP COLUMN code_redeemed;
+			ALTER TABLE oauth2_sessions DROP COLUMN code_issued_at;
+			ALTER TABLE oauth2_sessions DROP COLUMN redirect_uri;`,
+	},
+	{
+		Version: 6,
+		Name:    "create login attempts",
+		Up: `
+			CREATE TABLE login_attempts (
+				key            TEXT PRIMARY KEY,
+				failures       INTEGER NOT NULL,
+				last_failed_at INTEGER NOT NULL
+			);`,
+		Down: `
+			DROP TABLE login_attempts;`,
+	},
+	{
+		Version: 7,
+		Name:    "add the totp second factor",
+		Up: `
+			ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+			ALTER TABLE users ADD COLUMN totp_confirmed INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '';
+			ALTER TABLE oauth2_sessions ADD COLUMN amr TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE oauth2_sessions DROP COLUMN amr;
+			ALTER TABLE users DROP COLUMN recovery_codes;
+			ALTER TABLE users DROP COLUMN totp_last_step;
+			ALTER TABLE users DROP COLUMN totp_confirmed;
+			ALTER TABLE users DROP COLUMN totp_secret;`,
+	},
+	{
+		Version: 8,
+		Name:    "add the email verification",
+		Up: `
+			ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+			UPDATE users SET email_verified = 1;
+			CREATE TABLE email_tokens (
+				token_hash TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				purpose    TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_in INTEGER NOT NULL
+			);`,
+		Down: `
+			DROP TABLE email_tokens;
+			ALTER TABLE users DROP COLUMN email_verified;`,
+	},
+	{
+		Version: 9,
+		Name:    "create sso sessions",
+		Up: `
+			CREATE TABLE sso_sessions (
+				id              TEXT PRIMARY KEY,
+				user_id         TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				amr             TEXT NOT NULL DEFAULT '',
+				auth_time       INTEGER NOT NULL,
+				idle_expires_at INTEGER NOT NULL,
+				expires_at      INTEGER NOT NULL
+			);
+			CREATE INDEX sso_sessions_user_id ON sso_sessions (user_id);`,
+		Down: `
+			DROP TABLE sso_sessions;`,
+	},
+	{
+		Version: 10,
+		Name:    "add the rp-initiated logout settings of the registered applications",
+		Up: `
+			ALTER TABLE registered_applications ADD COLUMN post_logout_redirect_uris TEXT NOT NULL DEFAULT '';
+			ALTER TABLE registered_applications ADD COLUMN revoke_tokens_on_logout INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE registered_applications DROP COLUMN revoke_tokens_on_logout;
+			ALTER TABLE registered_applications DROP COLUMN post_logout_redirect_uris;`,
+	},
+	{
+		Version: 11,
+		Name:    "add the back-channel and front-channel logout of the apps",
+		Up: `
+			ALTER TABLE registered_applications ADD COLUMN backchannel_logout_uri TEXT NOT NULL DEFAULT '';
+			ALTER TABLE registered_applications ADD COLUMN frontchannel_logout_uri TEXT NOT NULL DEFAULT '';
+			ALTER TABLE sso_sessions ADD COLUMN sid TEXT NOT NULL DEFAULT '';
+			ALTER TABLE sso_sessions ADD COLUMN app_ids TEXT NOT NULL DEFAULT '';
+			UPDATE sso_sessions SET sid = LOWER(HEX(RANDOMBLOB(16)));
+			ALTER TABLE oauth2_sessions ADD COLUMN sso_session_id TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE oauth2_sessions DROP COLUMN sso_session_id;
+			ALTER TABLE sso_sessions DROP COLUMN app_ids;
+			ALTER TABLE sso_sessions DROP COLUMN sid;
+			ALTER TABLE registered_applications DROP COLUMN frontchannel_logout_uri;
+			ALTER TABLE registered_applications DROP COLUMN backchannel_logout_uri;`,
+	},
+	{
+		Version: 12,
+		Name:    "record the device authorizations denied by the user",
+		Up: `
+			ALTER TABLE device_authorizations ADD COLUMN denied INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE device_authorizations DROP COLUMN denied;`,
+	},
+	{
+		Version: 13,
+		Name:    "record every consent, remembered or not",
+		Up: `
+			ALTER TABLE consents ADD COLUMN remembered_scope TEXT NOT NULL DEFAULT '';
+			UPDATE consents SET remembered_scope = scope;`,
+		Down: `
+			DELETE FROM consents WHERE remembered_scope = '';
+			ALTER TABLE consents DROP COLUMN remembered_scope;`,
+	},
+	{
+		Version: 14,
+		Name:    "identify the oauth2 sessions by an ID generated by the server",
+		Up: `
+			CREATE TABLE oauth2_sessions_by_id (
+				id                    TEXT PRIMARY KEY,
+				state                 TEXT NOT NULL DEFAULT '',
+				app_id                TEXT NOT NULL,
+				redirect_uri          TEXT NOT NULL DEFAULT '',
+				code                  TEXT UNIQUE,
+				code_issued_at        INTEGER NOT NULL DEFAULT 0,
+				code_redeemed         INTEGER NOT NULL DEFAULT 0,
+				family_id             TEXT NOT NULL DEFAULT '',
+				scope                 TEXT NOT NULL,
+				email                 TEXT,
+				amr                   TEXT NOT NULL DEFAULT '',
+				code_challenge        TEXT NOT NULL DEFAULT '',
+				code_challenge_method TEXT NOT NULL DEFAULT '',
+				device_code           TEXT NOT NULL DEFAULT '',
+				nonce                 TEXT NOT NULL DEFAULT '',
+				auth_time             INTEGER NOT NULL DEFAULT 0,
+				sso_session_id        TEXT NOT NULL DEFAULT '',
+				created_at            INTEGER NOT NULL
+			);
+			INSERT INTO oauth2_sessions_by_id SELECT state, state, ` + oauth2SessionCopiedColumns + ` FROM oauth2_sessions;
+			DROP TABLE oauth2_sessions;
+			ALTER TABLE oauth2_sessions_by_id RENAME TO oauth2_sessions;`,
+		Down: `
+			CREATE TABLE oauth2_sessions_by_state (
+				state                 TEXT PRIMARY KEY,
+				app_id                TEXT NOT NULL,
+				redirect_uri          TEXT NOT NULL DEFAULT '',
+				code                  TEXT UNIQUE,
+				code_issued_at        INTEGER NOT NULL DEFAULT 0,
+				code_redeemed         INTEGER NOT NULL DEFAULT 0,
+				family_id             TEXT NOT NULL DEFAULT '',
+				scope                 TEXT NOT NULL,
+				email                 TEXT,
+				amr                   TEXT NOT NULL DEFAULT '',
+				code_challenge        TEXT NOT NULL DEFAULT '',
+				code_challenge_method TEXT NOT NULL DEFAULT '',
+				device_code           TEXT NOT NULL DEFAULT '',
+				nonce                 TEXT NOT NULL DEFAULT '',
+				auth_time             INTEGER NOT NULL DEFAULT 0,
+				sso_session_id        TEXT NOT NULL DEFAULT '',
+				created_at            INTEGER NOT NULL
+			);
+			INSERT INTO oauth2_sessions_by_state SELECT id, ` + oauth2SessionCopiedColumns + ` FROM oauth2_sessions;
+			DROP TABLE oauth2_sessions;
+			ALTER TABLE oauth2_sessions_by_state RENAME TO oauth2_sessions;`,
+	},
+	{
+		Version: 15,
+		Name:    "add the first-party applications",
+		Up: `
+			ALTER TABLE registered_applications ADD COLUMN first_party INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE registered_applications DROP COLUMN first_party;`,
+	},
+	{
+		Version: 16,
+		Name:    "record how the user logged in to approve a device",
+		Up: `
+			ALTER TABLE device_authorizations ADD COLUMN amr TEXT NOT NULL DEFAULT '';
+			ALTER TABLE device_authorizations ADD COLUMN auth_time INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE device_authorizations DROP COLUMN auth_time;
+			ALTER TABLE device_authorizations DROP COLUMN amr;`,
+	},
+	{
+		Version: 17,
+		Name:    "record how the user logged in to grant the refresh tokens",
+		Up: `
+			ALTER TABLE refresh_tokens ADD COLUMN amr TEXT NOT NULL DEFAULT '';
+			ALTER TABLE refresh_tokens ADD COLUMN auth_time INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE refresh_tokens DROP COLUMN auth_time;
+			ALTER TABLE refresh_tokens DROP COLUMN amr;`,
+	},
+}
+
+// oauth2SessionCopiedColumns are the columns of the oauth2 sessions copied as they are when the table is rebuilt with another key
+const oauth2SessionCopiedColumns = `app_id, redirect_uri, code, code_issued_at, code_redeemed, family_id, scope, email, amr,
+	code_challenge, code_challenge_method, device_code, nonce, auth_time, sso_session_id, created_at`
+
+// MigrateUp applies all the migrations not yet applied to the database
+func MigrateUp(db *sql.DB) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("Applying migration %d: %s\n", m.Version, m.Name)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, m.Version, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown rolls back the applied migrations until the schema is at the target version (0 drops everything)
+func MigrateDown(db *sql.DB, targetVersion int) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= targetVersion {
+			continue
+		}
+		log.Printf("Rolling back migration %d: %s\n", m.Version, m.Name)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the last applied migration, creating the schema_migrations table if needed
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
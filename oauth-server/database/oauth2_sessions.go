@@ -4,104 +4,222 @@ import (
 	"fmt"
 	"time"
 
-	cron "github.com/robfig/cron/v3"
+	"github.com/google/uuid"
 )
 
 // Oauth2Session represents a oauth2 session to get the access_token
 type Oauth2Session struct {
-	State     string // works as an ID
-	AppID     string
-	Code      *string
-	Scope     string
-	Email     *string
-	CreatedAt time.Time
-}
-
-var oauth2SessionsTable = []*Oauth2Session{}
-
-func init() {
-	c := cron.New()
-	c.AddFunc("@every 1m", func() {
-		fmt.Println("Checking for expired Oauth2 sessions... [Job started]")
-
-		// Loop over the slice in reverse order
-		for i := len(oauth2SessionsTable) - 1; i >= 0; i-- {
-			elapsed := time.Since(oauth2SessionsTable[i].CreatedAt)
-			if elapsed.Minutes() > 10 {
-				// If more than 10 minutes have passed, remove the element from the slice
-				oauth2SessionsTable = append(oauth2SessionsTable[:i], oauth2SessionsTable[i+1:]...)
-			}
+	ID                  string // generated by the server: carried by the login, consent and TOTP pages
+	State               string // chosen by the client and echoed in the redirect: it can't identify the session
+	AppID               string
+	RedirectURI         string // the code can be exchanged only with the redirect_uri of the authorize request
+	Code                *string
+	CodeIssuedAt        time.Time // the code expires after a short window independent of the session
+	CodeRedeemed        bool      // the code can be exchanged only once
+	FamilyID            string    // the refresh token family issued from the code: revoked if the code is replayed
+	Scope               string
+	Email               *string
+	AMR                 []string  // OpenID Connect: the authentication methods used by the user (pwd, otp)
+	CodeChallenge       string    // PKCE (RFC 7636): empty if the client didn't send it
+	CodeChallengeMethod string    // PKCE (RFC 7636): S256 or plain
+	DeviceCode          string    // device authorization grant (RFC 8628): set if the session approves a device instead of issuing a code
+	Nonce               string    // OpenID Connect: echoed in the id_token
+	AuthTime            time.Time // OpenID Connect: when the user submitted the credentials
+	SSOSessionID        string    // the SSO session of the browser the user has logged in with, if any
+	CreatedAt           time.Time
+}
+
+const (
+	// Oauth2SessionExpiresIn is the validity of an Oauth2 session in seconds (10 minutes)
+	Oauth2SessionExpiresIn = 10 * 60
+	// AuthorizationCodeExpiresIn is the default validity of an authorization code in seconds (RFC 6749 section 4.1.2)
+	AuthorizationCodeExpiresIn = 60
+)
+
+// IsCodeExpired tells if the authorization code has been issued longer than expiresIn ago
+func (session *Oauth2Session) IsCodeExpired(expiresIn time.Duration) bool {
+	return time.Since(session.CodeIssuedAt) > expiresIn
+}
+
+// isExpired tells if the session can be deleted: once its code has been redeemed the session is kept as a tombstone
+// as long as the refresh tokens issued from the code can be valid, so that a replay of the code still revokes them
+func (session *Oauth2Session) isExpired() bool {
+	if session.CodeRedeemed {
+		return time.Since(session.CodeIssuedAt) > RefreshTokenExpiresIn*time.Second
+	}
+	return time.Since(session.CreatedAt) > Oauth2SessionExpiresIn*time.Second
+}
+
+// DeleteExpiredOauth2Sessions removes the sessions older than Oauth2SessionExpiresIn, and the redeemed ones
+// whose code has been issued longer than RefreshTokenExpiresIn ago
+func (s *MemoryStore) DeleteExpiredOauth2Sessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, session := range s.oauth2SessionsByID {
+		if session.isExpired() {
+			s.deleteOauth2Session(id)
 		}
-		fmt.Println("Checking for expired Oauth2 sessions... [Job completed]")
-	})
-	c.Start()
+	}
 }
 
-// SaveNewOauth2Session
-func SaveNewOauth2Session(clientID, scope, state string) error {
-	app := FindRegisteredAppByClientID(clientID)
+// DeleteOauth2SessionsByEmail ends the logins of the user still in progress
+func (s *MemoryStore) DeleteOauth2SessionsByEmail(email string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, session := range s.oauth2SessionsByID {
+		if session.Email != nil && *session.Email == email {
+			s.deleteOauth2Session(id)
+		}
+	}
+}
+
+// SaveNewOauth2Session starts the login of an authorize request generating the ID of the session
+func (s *MemoryStore) SaveNewOauth2Session(clientID, redirectURI, scope, state, codeChallenge, codeChallengeMethod, nonce string) (*Oauth2Session, error) {
+	app := s.FindRegisteredAppByClientID(clientID)
 	if app == nil {
-		return fmt.Errorf("App not found among the registered apps")
-	}
-	oauth2SessionsTable = append(oauth2SessionsTable, &Oauth2Session{
-		State:     state,
-		AppID:     app.ID,
-		Code:      nil,
-		Scope:     scope,
-		CreatedAt: time.Now(),
+		return nil, fmt.Errorf("App not found among the registered apps")
+	}
+	return s.saveOauth2Session(&Oauth2Session{
+		ID:                  uuid.New().String(),
+		State:               state,
+		AppID:               app.ID,
+		RedirectURI:         redirectURI,
+		Code:                nil,
+		Scope:               scope,
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+		Nonce:               nonce,
+		CreatedAt:           time.Now(),
 	})
-	return nil
 }
 
-func FindOauth2SessionByParams(clientID, clientSecret, redirectURI, code string) *Oauth2Session {
-	for _, session := range oauth2SessionsTable {
-		if session.Code != nil && *session.Code == code {
-			app := FindRegisteredAppByClientID(clientID)
-			if app != nil {
-				if app.ClientSecret == clientSecret && app.RedirectURI == redirectURI {
-					return session
-				}
-			}
-		}
+// SaveNewOauth2SessionForDevice starts the login of the user who is approving a device authorization on the verification page
+func (s *MemoryStore) SaveNewOauth2SessionForDevice(deviceCode string) (*Oauth2Session, error) {
+	deviceAuthorization := s.FindDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil {
+		return nil, fmt.Errorf("Device authorization not found")
 	}
-	return nil
+	return s.saveOauth2Session(&Oauth2Session{
+		ID:         uuid.New().String(),
+		AppID:      deviceAuthorization.AppID,
+		Scope:      deviceAuthorization.Scope,
+		DeviceCode: deviceCode,
+		CreatedAt:  time.Now(),
+	})
+}
+
+func (s *MemoryStore) FindOauth2SessionByCode(code string) *Oauth2Session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyOauth2Session(s.oauth2SessionsByCode[code])
 }
 
-func UpdateOauth2SessionWithAuthCode(state, code string) (*Oauth2Session, error) {
-	oauthSession := FindOauth2SessionByState(state)
+// RedeemAuthorizationCode marks the code as exchanged with the tokens of the given refresh token family:
+// if the code had already been redeemed the session is returned untouched with alreadyRedeemed set
+func (s *MemoryStore) RedeemAuthorizationCode(code, familyID string) (oauthSession *Oauth2Session, alreadyRedeemed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	storedSession := s.oauth2SessionsByCode[code]
+	if storedSession == nil {
+		return nil, false
+	}
+	if storedSession.CodeRedeemed {
+		return copyOauth2Session(storedSession), true
+	}
+	storedSession.CodeRedeemed = true
+	storedSession.FamilyID = familyID
+	return copyOauth2Session(storedSession), false
+}
+
+// UpdateOauth2SessionWithAuthCode issues a new code for the session unless its code has already been redeemed
+func (s *MemoryStore) UpdateOauth2SessionWithAuthCode(id, code string) (*Oauth2Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oauthSession := s.oauth2SessionsByID[id]
 	if oauthSession == nil {
 		return nil, fmt.Errorf("Oauth2 session not found")
 	}
+	if oauthSession.CodeRedeemed {
+		return nil, fmt.Errorf("Authorization code already redeemed for the Oauth2 session")
+	}
+	if oauthSession.Code != nil {
+		delete(s.oauth2SessionsByCode, *oauthSession.Code)
+	}
 	oauthSession.Code = &code
-	return oauthSession, nil
+	oauthSession.CodeIssuedAt = time.Now()
+	s.oauth2SessionsByCode[code] = oauthSession
+	return copyOauth2Session(oauthSession), nil
 }
 
-func UpdateOauth2SessionWithEmail(state, email string) (*Oauth2Session, error) {
-	oauthSession := FindOauth2SessionByState(state)
+// UpdateOauth2SessionWithEmail records the user authenticated with the given methods at authTime
+func (s *MemoryStore) UpdateOauth2SessionWithEmail(id, email string, amr []string, authTime time.Time) (*Oauth2Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oauthSession := s.oauth2SessionsByID[id]
 	if oauthSession == nil {
 		return nil, fmt.Errorf("Oauth2 session not found")
 	}
 	oauthSession.Email = &email
-	return oauthSession, nil
+	oauthSession.AMR = amr
+	oauthSession.AuthTime = authTime
+	return copyOauth2Session(oauthSession), nil
 }
 
-func FindOauth2SessionByState(state string) *Oauth2Session {
-	for _, session := range oauth2SessionsTable {
-		if session.State == state {
-			return session
-		}
+// UpdateOauth2SessionWithSSOSession records the SSO session of the browser the user has logged in with
+func (s *MemoryStore) UpdateOauth2SessionWithSSOSession(id, ssoSessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oauthSession := s.oauth2SessionsByID[id]
+	if oauthSession == nil {
+		return fmt.Errorf("Oauth2 session not found")
+	}
+	oauthSession.SSOSessionID = ssoSessionID
+	return nil
+}
+
+// UpdateOauth2SessionScope keeps only the scopes the user has granted on the consent page
+func (s *MemoryStore) UpdateOauth2SessionScope(id, scope string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oauthSession := s.oauth2SessionsByID[id]
+	if oauthSession == nil {
+		return fmt.Errorf("Oauth2 session not found")
 	}
+	oauthSession.Scope = scope
 	return nil
 }
 
-// ~~~~~~~~~~~~~
+func (s *MemoryStore) FindOauth2SessionByID(id string) *Oauth2Session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyOauth2Session(s.oauth2SessionsByID[id])
+}
 
-// AccessToken represents the token in the database
-type AccessToken struct {
-	Token     string
-	CreatedAt time.Time
-	ExpiresIn int
-	UserId    string
+// saveOauth2Session adds the session to the table and returns a copy of it
+func (s *MemoryStore) saveOauth2Session(oauthSession *Oauth2Session) (*Oauth2Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.oauth2SessionsByID[oauthSession.ID] = oauthSession
+	return copyOauth2Session(oauthSession), nil
 }
 
-var accessTokensTable = []AccessToken{}
+// deleteOauth2Session removes the session from both the indexes: the caller must hold the mutex
+func (s *MemoryStore) deleteOauth2Session(id string) {
+	oauthSession := s.oauth2SessionsByID[id]
+	if oauthSession == nil {
+		return
+	}
+	if oauthSession.Code != nil {
+		delete(s.oauth2SessionsByCode, *oauthSession.Code)
+	}
+	delete(s.oauth2SessionsByID, id)
+}
+
+// copyOauth2Session returns a copy of the session that can be read while the stored one is updated
+func copyOauth2Session(oauthSession *Oauth2Session) *Oauth2Session {
+	if oauthSession == nil {
+		return nil
+	}
+	sessionCopy := *oauthSession
+	return &sessionCopy
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshTokenExpiresIn is the validity of a refresh token in seconds (30 days)
+const RefreshTokenExpiresIn = 30 * 24 * 60 * 60
+
+// RefreshToken represents the DB record for refresh_tokens table
+type RefreshToken struct {
+	Token          string
+	FamilyID       string // shared by all the refresh tokens rotated from the same authorization grant
+	AppID          string
+	UserID         string
+	Scope          string
+	AccessTokenJTI string    // the access token issued together with this refresh token
+	AMR            []string  // OpenID Connect: how the user logged in to grant the token family
+	AuthTime       time.Time // OpenID Connect: when the user logged in to grant the token family
+	Used           bool      // set when the token is rotated: if it is presented again it has been stolen
+	Revoked        bool
+	CreatedAt      time.Time
+	ExpiresIn      int
+}
+
+// IsExpired tells if the refresh token has outlived its validity
+func (t *RefreshToken) IsExpired() bool {
+	return time.Since(t.CreatedAt) > time.Duration(t.ExpiresIn)*time.Second
+}
+
+// DeleteExpiredRefreshTokens removes the refresh tokens that have outlived their validity
+func (s *MemoryStore) DeleteExpiredRefreshTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Loop over the slice in reverse order
+	for i := len(s.refreshTokensTable) - 1; i >= 0; i-- {
+		if s.refreshTokensTable[i].IsExpired() {
+			s.refreshTokensTable = append(s.refreshTokensTable[:i], s.refreshTokensTable[i+1:]...)
+		}
+	}
+}
+
+// SaveNewRefreshToken creates a new refresh token: if familyID is empty a new token family is started.
+// The login of the user is carried along the rotations of the family
+func (s *MemoryStore) SaveNewRefreshToken(appID, userID, scope, familyID, accessTokenJTI string, amr []string, authTime time.Time) (*RefreshToken, error) {
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+	refreshToken := &RefreshToken{
+		Token:          uuid.New().String(),
+		FamilyID:       familyID,
+		AppID:          appID,
+		UserID:         userID,
+		Scope:          scope,
+		AccessTokenJTI: accessTokenJTI,
+		AMR:            append([]string(nil), amr...),
+		AuthTime:       authTime,
+		CreatedAt:      time.Now(),
+		ExpiresIn:      RefreshTokenExpiresIn,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refreshTokensTable = append(s.refreshTokensTable, refreshToken)
+	return copyRefreshToken(refreshToken), nil
+}
+
+func (s *MemoryStore) FindRefreshToken(token string) *RefreshToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyRefreshToken(s.findRefreshToken(token))
+}
+
+// MarkRefreshTokenAsUsed rotates the token: alreadyUsed is set if it had already been rotated,
+// so that only one of two concurrent refreshes with the same token succeeds
+func (s *MemoryStore) MarkRefreshTokenAsUsed(token string) (alreadyUsed bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	refreshToken := s.findRefreshToken(token)
+	if refreshToken == nil {
+		return false, fmt.Errorf("Refresh token not found")
+	}
+	if refreshToken.Used {
+		return true, nil
+	}
+	refreshToken.Used = true
+	return false, nil
+}
+
+// RevokeRefreshTokenFamily revokes all the refresh tokens rotated from the same authorization grant
+// and the access tokens issued together with them
+func (s *MemoryStore) RevokeRefreshTokenFamily(familyID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, refreshToken := range s.refreshTokensTable {
+		if refreshToken.FamilyID == familyID {
+			refreshToken.Revoked = true
+			s.revokeAccessToken(refreshToken.AccessTokenJTI, refreshToken.CreatedAt.Add(AccessTokenExpiresIn*time.Second))
+		}
+	}
+}
+
+// RevokeRefreshTokensOfUser revokes all the refresh tokens of the user issued to the app, or to any app if appID is empty,
+// and the access tokens issued together with them
+func (s *MemoryStore) RevokeRefreshTokensOfUser(userID, appID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, refreshToken := range s.refreshTokensTable {
+		if refreshToken.UserID == userID && (appID == "" || refreshToken.AppID == appID) && !refreshToken.Revoked {
+			refreshToken.Revoked = true
+			s.revokeAccessToken(refreshToken.AccessTokenJTI, refreshToken.CreatedAt.Add(AccessTokenExpiresIn*time.Second))
+		}
+	}
+}
+
+// FindRefreshTokenByAccessTokenJTI looks for the refresh token issued together with the access token
+func (s *MemoryStore) FindRefreshTokenByAccessTokenJTI(jti string) *RefreshToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, refreshToken := range s.refreshTokensTable {
+		if refreshToken.AccessTokenJTI == jti {
+			return copyRefreshToken(refreshToken)
+		}
+	}
+	return nil
+}
+
+// findRefreshToken returns the stored record: the caller must hold the mutex
+func (s *MemoryStore) findRefreshToken(token string) *RefreshToken {
+	for _, refreshToken := range s.refreshTokensTable {
+		if refreshToken.Token == token {
+			return refreshToken
+		}
+	}
+	return nil
+}
+
+func copyRefreshToken(refreshToken *RefreshToken) *RefreshToken {
+	if refreshToken == nil {
+		return nil
+	}
+	refreshTokenCopy := *refreshToken
+	refreshTokenCopy.AMR = append([]string(nil), refreshToken.AMR...)
+	return &refreshTokenCopy
+}
@@ -1,38 +1,90 @@
 package database
 
+import "strings"
+
 // RegisteredOauth2App represents the table containing the registered applications
 type RegisteredOauth2App struct {
-	ID           string
-	ClientID     string
-	ClientSecret string
-	RedirectURI  string
-	Name         string
+	ID            string
+	ClientID      string
+	ClientSecret  string
+	RedirectURI   string
+	Name          string
+	RequirePKCE   bool     // if true the app must send a code_challenge in the authorize request
+	AllowedScopes []string // scopes the app can request on its own behalf with the client_credentials grant
+	FirstParty    bool     // if true the app can request the first-party scopes, like the management of the user's account
+	// OpenID Connect RP-initiated logout: where the browser can be sent back after the logout,
+	// and if the tokens issued to the app must be revoked when the user logs out from it
+	PostLogoutRedirectURIs []string
+	RevokeTokensOnLogout   bool
+	// OpenID Connect back-channel and front-channel logout: where the app is told that the user has logged out,
+	// with a logout token posted by the server or with a page loaded in an iframe of the browser
+	BackchannelLogoutURI  string
+	FrontchannelLogoutURI string
 }
 
-var registeredOauth2AppsTable = []*RegisteredOauth2App{
-	&RegisteredOauth2App{
-		ID:           "4b3d6d22-a317-456c-9f2e-793bd6a29ac0",
-		ClientID:     "12345",
-		ClientSecret: "dkjdqqdkjdqjdqjkqefv",
-		RedirectURI:  "http://localhost:8081/redirect",
-		Name:         "TheCommunity",
-	},
+// DemoRegisteredOauth2Apps returns the registered apps the demo starts with
+func DemoRegisteredOauth2Apps() []*RegisteredOauth2App {
+	return []*RegisteredOauth2App{
+		&RegisteredOauth2App{
+			ID:            "4b3d6d22-a317-456c-9f2e-793bd6a29ac0",
+			ClientID:      "12345",
+			ClientSecret:  "dkjdqqdkjdqjdqjkqefv",
+			RedirectURI:   "http://localhost:8081/redirect",
+			Name:          "TheCommunity",
+			AllowedScopes: []string{"profile", "email"},
+			FirstParty:    true,
+
+			PostLogoutRedirectURIs: []string{"http://localhost:8081/login"},
+			RevokeTokensOnLogout:   true,
+			BackchannelLogoutURI:   "http://localhost:8082/backchannel-logout",
+			FrontchannelLogoutURI:  "http://localhost:8081/frontchannel-logout",
+		},
+	}
 }
 
-func FindRegisteredAppByID(appID string) *RegisteredOauth2App {
-	for _, app := range registeredOauth2AppsTable {
+func (s *MemoryStore) FindRegisteredAppByID(appID string) *RegisteredOauth2App {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, app := range s.registeredOauth2AppsTable {
 		if app.ID == appID {
-			return app
+			return copyRegisteredApp(app)
 		}
 	}
 	return nil
 }
 
-func FindRegisteredAppByClientID(clientID string) *RegisteredOauth2App {
-	for _, app := range registeredOauth2AppsTable {
+func (s *MemoryStore) FindRegisteredAppByClientID(clientID string) *RegisteredOauth2App {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, app := range s.registeredOauth2AppsTable {
 		if app.ClientID == clientID {
-			return app
+			return copyRegisteredApp(app)
 		}
 	}
 	return nil
 }
+
+// AllowsScope tells if all the space separated scopes are among the ones the app is allowed to request
+func (app *RegisteredOauth2App) AllowsScope(scope string) bool {
+	for _, requested := range strings.Fields(scope) {
+		allowed := false
+		for _, allowedScope := range app.AllowedScopes {
+			if requested == allowedScope {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// copyRegisteredApp returns a copy of the app that doesn't share the slices with the stored one
+func copyRegisteredApp(app *RegisteredOauth2App) *RegisteredOauth2App {
+	appCopy := *app
+	appCopy.AllowedScopes = append([]string(nil), app.AllowedScopes...)
+	appCopy.PostLogoutRedirectURIs = append([]string(nil), app.PostLogoutRedirectURIs...)
+	return &appCopy
+}
@@ -0,0 +1,59 @@
+package database
+
+import "time"
+
+// AccessTokenExpiresIn is the validity of an access token in seconds (1 hour)
+const AccessTokenExpiresIn = 60 * 60
+
+// RevokedToken represents the DB record for revoked_tokens table: the access tokens revoked before their expiration
+type RevokedToken struct {
+	JTI       string // the jti claim of the revoked jwt
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+// DeleteExpiredRevokedTokens removes the revoked tokens that have expired in the meantime
+func (s *MemoryStore) DeleteExpiredRevokedTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Loop over the slice in reverse order
+	for i := len(s.revokedTokensTable) - 1; i >= 0; i-- {
+		if time.Now().After(s.revokedTokensTable[i].ExpiresAt) {
+			s.revokedTokensTable = append(s.revokedTokensTable[:i], s.revokedTokensTable[i+1:]...)
+		}
+	}
+}
+
+// RevokeAccessToken adds the jti of an access token to the revocation list until the token expires
+func (s *MemoryStore) RevokeAccessToken(jti string, expiresAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revokeAccessToken(jti, expiresAt)
+}
+
+func (s *MemoryStore) IsAccessTokenRevoked(jti string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.isAccessTokenRevoked(jti)
+}
+
+// revokeAccessToken adds the jti to the revocation list: the caller must hold the mutex
+func (s *MemoryStore) revokeAccessToken(jti string, expiresAt time.Time) {
+	if jti == "" || s.isAccessTokenRevoked(jti) {
+		return
+	}
+	s.revokedTokensTable = append(s.revokedTokensTable, &RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+		RevokedAt: time.Now(),
+	})
+}
+
+func (s *MemoryStore) isAccessTokenRevoked(jti string) bool {
+	for _, revokedToken := range s.revokedTokensTable {
+		if revokedToken.JTI == jti {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (s *SQLiteStore) FindConsent(userID, appID string) *Consent {
+	consent := &Consent{}
+	var grantedAt int64
+	err := s.db.QueryRow(`SELECT user_id, app_id, scope, remembered_scope, granted_at FROM consents WHERE user_id = ? AND app_id = ?`, userID, appID).
+		Scan(&consent.UserID, &consent.AppID, &consent.Scope, &consent.RememberedScope, &grantedAt)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	consent.GrantedAt = fromUnixNano(grantedAt)
+	return consent
+}
+
+// SaveConsent records that the user has granted the space separated scopes to the app, besides the ones granted before,
+// and remembers them if asked
+func (s *SQLiteStore) SaveConsent(userID, appID, scope string, remember bool) (*Consent, error) {
+	consent := &Consent{UserID: userID, AppID: appID, GrantedAt: time.Now()}
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		var granted, remembered string
+		err := tx.QueryRow(`SELECT scope, remembered_scope FROM consents WHERE user_id = ? AND app_id = ?`, userID, appID).
+			Scan(&granted, &remembered)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		consent.Scope = mergeScopes(granted, scope)
+		consent.RememberedScope = remembered
+		if remember {
+			consent.RememberedScope = mergeScopes(remembered, scope)
+		}
+		_, err = tx.Exec(`INSERT INTO consents (user_id, app_id, scope, remembered_scope, granted_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, app_id) DO UPDATE SET scope = excluded.scope, remembered_scope = excluded.remembered_scope,
+			granted_at = excluded.granted_at`,
+			userID, appID, consent.Scope, consent.RememberedScope, toUnixNano(consent.GrantedAt))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return consent, nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const emailTokenColumns = `token_hash, user_id, purpose, created_at, expires_in`
+
+// SaveNewEmailToken stores the hash of a token sent to the user
+func (s *SQLiteStore) SaveNewEmailToken(tokenHash, userID, purpose string, expiresIn int) error {
+	_, err := s.db.Exec(`INSERT INTO email_tokens (token_hash, user_id, purpose, created_at, expires_in) VALUES (?, ?, ?, ?, ?)`,
+		tokenHash, userID, purpose, toUnixNano(time.Now()), expiresIn)
+	return err
+}
+
+// FindEmailToken returns the token without using it: nil if it doesn't exist for the purpose
+func (s *SQLiteStore) FindEmailToken(tokenHash, purpose string) *EmailToken {
+	emailToken, err := scanEmailToken(s.db.QueryRow(`SELECT `+emailTokenColumns+` FROM email_tokens WHERE token_hash = ? AND purpose = ?`, tokenHash, purpose))
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	return emailToken
+}
+
+// ConsumeEmailToken deletes the token and returns it, so that a link works only once: nil if it doesn't exist for the purpose
+func (s *SQLiteStore) ConsumeEmailToken(tokenHash, purpose string) *EmailToken {
+	var emailToken *EmailToken
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		token, err := scanEmailToken(tx.QueryRow(`SELECT `+emailTokenColumns+` FROM email_tokens WHERE token_hash = ? AND purpose = ?`, tokenHash, purpose))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM email_tokens WHERE token_hash = ?`, tokenHash); err != nil {
+			return err
+		}
+		emailToken = token
+		return nil
+	})
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	return emailToken
+}
+
+// DeleteEmailTokensOfUser invalidates the links with the purpose sent to the user
+func (s *SQLiteStore) DeleteEmailTokensOfUser(userID, purpose string) {
+	if _, err := s.db.Exec(`DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?`, userID, purpose); err != nil {
+		logQueryError(err)
+	}
+}
+
+// DeleteExpiredEmailTokens removes the links nobody has used in time
+func (s *SQLiteStore) DeleteExpiredEmailTokens() {
+	// the lifetime is per record, so the expiry is computed in the query
+	_, err := s.db.Exec(`DELETE FROM email_tokens WHERE created_at + expires_in * 1000000000 < ?`, toUnixNano(time.Now()))
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+func scanEmailToken(row *sql.Row) (*EmailToken, error) {
+	emailToken := &EmailToken{}
+	var createdAt int64
+	if err := row.Scan(&emailToken.TokenHash, &emailToken.UserID, &emailToken.Purpose, &createdAt, &emailToken.ExpiresIn); err != nil {
+		return nil, err
+	}
+	emailToken.CreatedAt = fromUnixNano(createdAt)
+	return emailToken, nil
+}
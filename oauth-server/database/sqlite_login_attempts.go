@@ -0,0 +1,90 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DeleteExpiredLoginAttempts forgets the failed logins older than LoginAttemptExpiresIn
+func (s *SQLiteStore) DeleteExpiredLoginAttempts() {
+	lastFailedBefore := time.Now().Add(-LoginAttemptExpiresIn * time.Second)
+	if _, err := s.db.Exec(`DELETE FROM login_attempts WHERE last_failed_at < ?`, toUnixNano(lastFailedBefore)); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (s *SQLiteStore) FindLoginAttempt(key string) *LoginAttempt {
+	loginAttempt, err := scanLoginAttempt(s.db.QueryRow(`SELECT key, failures, last_failed_at FROM login_attempts WHERE key = ?`, key))
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	return loginAttempt
+}
+
+// ReserveLoginAttempt counts a failed login for every key before the credentials are verified, so that concurrent logins
+// can't all be verified against the same count. Nothing is counted if one of the keys must wait: the longest wait is returned
+func (s *SQLiteStore) ReserveLoginAttempt(keys []string, retryAfter LoginRetryAfterFunc) (time.Duration, error) {
+	var wait time.Duration
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		for _, key := range keys {
+			loginAttempt, err := scanLoginAttempt(tx.QueryRow(`SELECT key, failures, last_failed_at FROM login_attempts WHERE key = ?`, key))
+			if err == sql.ErrNoRows {
+				loginAttempt, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+			if keyWait := retryAfter(key, loginAttempt); keyWait > wait {
+				wait = keyWait
+			}
+		}
+		if wait > 0 {
+			return nil
+		}
+		now := toUnixNano(time.Now())
+		for _, key := range keys {
+			_, err := tx.Exec(`INSERT INTO login_attempts (key, failures, last_failed_at) VALUES (?, 1, ?)
+				ON CONFLICT (key) DO UPDATE SET failures = failures + 1, last_failed_at = excluded.last_failed_at`, key, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
+
+// ReleaseLoginAttempt gives back the failed login reserved for the key once the credentials turn out to be right
+func (s *SQLiteStore) ReleaseLoginAttempt(key string) {
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE login_attempts SET failures = failures - 1 WHERE key = ?`, key); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM login_attempts WHERE key = ? AND failures <= 0`, key)
+		return err
+	})
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+// DeleteLoginAttempt forgets the failed logins of the key: after a successful login or when an admin unlocks it
+func (s *SQLiteStore) DeleteLoginAttempt(key string) {
+	if _, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = ?`, key); err != nil {
+		logQueryError(err)
+	}
+}
+
+func scanLoginAttempt(row *sql.Row) (*LoginAttempt, error) {
+	loginAttempt := &LoginAttempt{}
+	var lastFailedAt int64
+	if err := row.Scan(&loginAttempt.Key, &loginAttempt.Failures, &lastFailedAt); err != nil {
+		return nil, err
+	}
+	loginAttempt.LastFailedAt = fromUnixNano(lastFailedAt)
+	return loginAttempt, nil
+}
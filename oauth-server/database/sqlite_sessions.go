@@ -0,0 +1,256 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const oauth2SessionColumns = `id, state, app_id, redirect_uri, code, code_issued_at, code_redeemed, family_id, scope, email, amr, code_challenge, code_challenge_method, device_code, nonce, auth_time, sso_session_id, created_at`
+
+// DeleteExpiredOauth2Sessions removes the sessions older than Oauth2SessionExpiresIn, and the redeemed ones
+// whose code has been issued longer than RefreshTokenExpiresIn ago: until then they are the tombstones of their code
+func (s *SQLiteStore) DeleteExpiredOauth2Sessions() {
+	createdBefore := time.Now().Add(-Oauth2SessionExpiresIn * time.Second)
+	codeIssuedBefore := time.Now().Add(-RefreshTokenExpiresIn * time.Second)
+	_, err := s.db.Exec(`DELETE FROM oauth2_sessions WHERE (code_redeemed = 0 AND created_at < ?) OR (code_redeemed = 1 AND code_issued_at < ?)`,
+		toUnixNano(createdBefore), toUnixNano(codeIssuedBefore))
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+// DeleteOauth2SessionsByEmail ends the logins of the user still in progress
+func (s *SQLiteStore) DeleteOauth2SessionsByEmail(email string) {
+	if _, err := s.db.Exec(`DELETE FROM oauth2_sessions WHERE email = ?`, email); err != nil {
+		logQueryError(err)
+	}
+}
+
+// SaveNewOauth2Session starts the login of an authorize request generating the ID of the session
+func (s *SQLiteStore) SaveNewOauth2Session(clientID, redirectURI, scope, state, codeChallenge, codeChallengeMethod, nonce string) (*Oauth2Session, error) {
+	app := s.FindRegisteredAppByClientID(clientID)
+	if app == nil {
+		return nil, fmt.Errorf("App not found among the registered apps")
+	}
+	id := uuid.New().String()
+	_, err := s.db.Exec(`INSERT INTO oauth2_sessions (id, state, app_id, redirect_uri, scope, code_challenge, code_challenge_method, nonce, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, state, app.ID, redirectURI, scope, codeChallenge, codeChallengeMethod, nonce, toUnixNano(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return s.FindOauth2SessionByID(id), nil
+}
+
+// SaveNewOauth2SessionForDevice starts the login of the user who is approving a device authorization on the verification page
+func (s *SQLiteStore) SaveNewOauth2SessionForDevice(deviceCode string) (*Oauth2Session, error) {
+	deviceAuthorization := s.FindDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil {
+		return nil, fmt.Errorf("Device authorization not found")
+	}
+	id := uuid.New().String()
+	_, err := s.db.Exec(`INSERT INTO oauth2_sessions (id, app_id, scope, device_code, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id, deviceAuthorization.AppID, deviceAuthorization.Scope, deviceCode, toUnixNano(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return s.FindOauth2SessionByID(id), nil
+}
+
+func (s *SQLiteStore) FindOauth2SessionByCode(code string) *Oauth2Session {
+	return s.findOauth2Session(`SELECT `+oauth2SessionColumns+` FROM oauth2_sessions WHERE code = ?`, code)
+}
+
+// RedeemAuthorizationCode marks the code as exchanged with the tokens of the given refresh token family:
+// if the code had already been redeemed the session is returned untouched with alreadyRedeemed set
+func (s *SQLiteStore) RedeemAuthorizationCode(code, familyID string) (oauthSession *Oauth2Session, alreadyRedeemed bool) {
+	// the condition on code_redeemed makes the update atomic: only one of the concurrent requests can redeem the code
+	result, err := s.db.Exec(`UPDATE oauth2_sessions SET code_redeemed = 1, family_id = ? WHERE code = ? AND code_redeemed = 0`, familyID, code)
+	if err != nil {
+		logQueryError(err)
+		return nil, false
+	}
+	redeemed, _ := result.RowsAffected()
+	oauthSession = s.FindOauth2SessionByCode(code)
+	return oauthSession, oauthSession != nil && redeemed == 0
+}
+
+// UpdateOauth2SessionWithAuthCode issues a new code for the session unless its code has already been redeemed
+func (s *SQLiteStore) UpdateOauth2SessionWithAuthCode(id, code string) (*Oauth2Session, error) {
+	if oauthSession := s.FindOauth2SessionByID(id); oauthSession != nil && oauthSession.CodeRedeemed {
+		return nil, fmt.Errorf("Authorization code already redeemed for the Oauth2 session")
+	}
+	if err := s.updateOauth2Session(`UPDATE oauth2_sessions SET code = ?, code_issued_at = ? WHERE id = ? AND code_redeemed = 0`, code, toUnixNano(time.Now()), id); err != nil {
+		return nil, err
+	}
+	return s.FindOauth2SessionByID(id), nil
+}
+
+// UpdateOauth2SessionWithEmail records the user authenticated with the given methods at authTime
+func (s *SQLiteStore) UpdateOauth2SessionWithEmail(id, email string, amr []string, authTime time.Time) (*Oauth2Session, error) {
+	if err := s.updateOauth2Session(`UPDATE oauth2_sessions SET email = ?, amr = ?, auth_time = ? WHERE id = ?`,
+		email, strings.Join(amr, " "), toUnixNano(authTime), id); err != nil {
+		return nil, err
+	}
+	return s.FindOauth2SessionByID(id), nil
+}
+
+// UpdateOauth2SessionWithSSOSession records the SSO session of the browser the user has logged in with
+func (s *SQLiteStore) UpdateOauth2SessionWithSSOSession(id, ssoSessionID string) error {
+	return s.updateOauth2Session(`UPDATE oauth2_sessions SET sso_session_id = ? WHERE id = ?`, ssoSessionID, id)
+}
+
+// UpdateOauth2SessionScope keeps only the scopes the user has granted on the consent page
+func (s *SQLiteStore) UpdateOauth2SessionScope(id, scope string) error {
+	return s.updateOauth2Session(`UPDATE oauth2_sessions SET scope = ? WHERE id = ?`, scope, id)
+}
+
+func (s *SQLiteStore) FindOauth2SessionByID(id string) *Oauth2Session {
+	return s.findOauth2Session(`SELECT `+oauth2SessionColumns+` FROM oauth2_sessions WHERE id = ?`, id)
+}
+
+func (s *SQLiteStore) updateOauth2Session(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("Oauth2 session not found")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) findOauth2Session(query string, args ...interface{}) *Oauth2Session {
+	session := &Oauth2Session{}
+	var code, email sql.NullString
+	var amr string
+	var codeIssuedAt, authTime, createdAt int64
+	err := s.db.QueryRow(query, args...).Scan(&session.ID, &session.State, &session.AppID, &session.RedirectURI, &code, &codeIssuedAt, &session.CodeRedeemed,
+		&session.FamilyID, &session.Scope, &email, &amr, &session.CodeChallenge, &session.CodeChallengeMethod, &session.DeviceCode, &session.Nonce, &authTime, &session.SSOSessionID, &createdAt)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	session.Code = fromNullString(code)
+	session.CodeIssuedAt = fromUnixNano(codeIssuedAt)
+	session.Email = fromNullString(email)
+	session.AMR = strings.Fields(amr)
+	session.AuthTime = fromUnixNano(authTime)
+	session.CreatedAt = fromUnixNano(createdAt)
+	return session
+}
+
+const deviceAuthorizationColumns = `device_code, user_code, app_id, scope, email, amr, auth_time, denied, interval, last_polled_at, created_at, expires_in`
+
+// DeleteExpiredDeviceAuthorizations removes the device authorizations whose codes have expired
+func (s *SQLiteStore) DeleteExpiredDeviceAuthorizations() {
+	if _, err := s.db.Exec(`DELETE FROM device_authorizations WHERE created_at + expires_in * 1000000000 < ?`, toUnixNano(time.Now())); err != nil {
+		logQueryError(err)
+	}
+}
+
+// UpdateDeviceAuthorizationPolling records the last polling request of the device and the interval it must respect
+func (s *SQLiteStore) UpdateDeviceAuthorizationPolling(deviceCode string, lastPolledAt time.Time, interval int) error {
+	return s.updateDeviceAuthorization(`UPDATE device_authorizations SET last_polled_at = ?, interval = ? WHERE device_code = ?`,
+		toUnixNano(lastPolledAt), interval, deviceCode)
+}
+
+// SaveNewDeviceAuthorization starts a new device authorization grant generating the device_code and the user_code
+func (s *SQLiteStore) SaveNewDeviceAuthorization(clientID, scope string) (*DeviceAuthorization, error) {
+	app := s.FindRegisteredAppByClientID(clientID)
+	if app == nil {
+		return nil, fmt.Errorf("App not found among the registered apps")
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+	deviceAuthorization := &DeviceAuthorization{
+		DeviceCode: uuid.New().String(),
+		UserCode:   userCode,
+		AppID:      app.ID,
+		Scope:      scope,
+		Interval:   DeviceCodeInterval,
+		CreatedAt:  time.Now(),
+		ExpiresIn:  DeviceCodeExpiresIn,
+	}
+	_, err = s.db.Exec(`INSERT INTO device_authorizations (device_code, user_code, app_id, scope, interval, created_at, expires_in) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		deviceAuthorization.DeviceCode, deviceAuthorization.UserCode, deviceAuthorization.AppID, deviceAuthorization.Scope,
+		deviceAuthorization.Interval, toUnixNano(deviceAuthorization.CreatedAt), deviceAuthorization.ExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	return deviceAuthorization, nil
+}
+
+func (s *SQLiteStore) FindDeviceAuthorizationByDeviceCode(deviceCode string) *DeviceAuthorization {
+	return s.findDeviceAuthorization(`SELECT `+deviceAuthorizationColumns+` FROM device_authorizations WHERE device_code = ?`, deviceCode)
+}
+
+// FindDeviceAuthorizationByUserCode looks for the user_code ignoring case, spaces and dashes typed by the user
+func (s *SQLiteStore) FindDeviceAuthorizationByUserCode(userCode string) *DeviceAuthorization {
+	return s.findDeviceAuthorization(`SELECT `+deviceAuthorizationColumns+` FROM device_authorizations WHERE REPLACE(user_code, '-', '') = ?`,
+		NormalizeUserCode(userCode))
+}
+
+// ApproveDeviceAuthorization records the user who has approved the device, how the user logged in and the scopes granted
+func (s *SQLiteStore) ApproveDeviceAuthorization(deviceCode, email, scope string, amr []string, authTime time.Time) (*DeviceAuthorization, error) {
+	if err := s.updateDeviceAuthorization(`UPDATE device_authorizations SET email = ?, scope = ?, amr = ?, auth_time = ? WHERE device_code = ?`,
+		email, scope, strings.Join(amr, " "), toUnixNano(authTime), deviceCode); err != nil {
+		return nil, err
+	}
+	return s.FindDeviceAuthorizationByDeviceCode(deviceCode), nil
+}
+
+// DenyDeviceAuthorization records that the user has denied the request: the device gets access_denied
+func (s *SQLiteStore) DenyDeviceAuthorization(deviceCode string) error {
+	return s.updateDeviceAuthorization(`UPDATE device_authorizations SET denied = 1 WHERE device_code = ?`, deviceCode)
+}
+
+// DeleteDeviceAuthorization removes the device authorization once the device_code has been exchanged with the tokens
+func (s *SQLiteStore) DeleteDeviceAuthorization(deviceCode string) {
+	if _, err := s.db.Exec(`DELETE FROM device_authorizations WHERE device_code = ?`, deviceCode); err != nil {
+		logQueryError(err)
+	}
+}
+
+// RedeemDeviceAuthorization removes the approved device authorization and returns it: only one of the concurrent
+// polls of the device can get it, so that the device_code is exchanged with the tokens only once
+func (s *SQLiteStore) RedeemDeviceAuthorization(deviceCode string) *DeviceAuthorization {
+	return s.findDeviceAuthorization(`DELETE FROM device_authorizations WHERE device_code = ? AND email IS NOT NULL AND denied = 0 RETURNING `+deviceAuthorizationColumns,
+		deviceCode)
+}
+
+func (s *SQLiteStore) updateDeviceAuthorization(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("Device authorization not found")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) findDeviceAuthorization(query string, args ...interface{}) *DeviceAuthorization {
+	deviceAuthorization := &DeviceAuthorization{}
+	var email sql.NullString
+	var amr string
+	var authTime, lastPolledAt, createdAt int64
+	err := s.db.QueryRow(query, args...).Scan(&deviceAuthorization.DeviceCode, &deviceAuthorization.UserCode, &deviceAuthorization.AppID,
+		&deviceAuthorization.Scope, &email, &amr, &authTime, &deviceAuthorization.Denied, &deviceAuthorization.Interval, &lastPolledAt, &createdAt,
+		&deviceAuthorization.ExpiresIn)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	deviceAuthorization.Email = fromNullString(email)
+	deviceAuthorization.AMR = strings.Fields(amr)
+	deviceAuthorization.AuthTime = fromUnixNano(authTime)
+	deviceAuthorization.LastPolledAt = fromUnixNano(lastPolledAt)
+	deviceAuthorization.CreatedAt = fromUnixNano(createdAt)
+	return deviceAuthorization
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ssoSessionColumns = `id, sid, user_id, amr, auth_time, idle_expires_at, expires_at, app_ids`
+
+// SaveNewSSOSession starts the session of the user who has just logged in
+func (s *SQLiteStore) SaveNewSSOSession(userID string, amr []string, authTime time.Time, idleTimeout, maxLifetime time.Duration) (*SSOSession, error) {
+	ssoSession := newSSOSession(userID, amr, authTime, idleTimeout, maxLifetime)
+	_, err := s.db.Exec(`INSERT INTO sso_sessions (`+ssoSessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		ssoSession.ID, ssoSession.SID, ssoSession.UserID, strings.Join(ssoSession.AMR, " "), toUnixNano(ssoSession.AuthTime),
+		toUnixNano(ssoSession.IdleExpiresAt), toUnixNano(ssoSession.ExpiresAt), strings.Join(ssoSession.AppIDs, " "))
+	if err != nil {
+		return nil, err
+	}
+	return ssoSession, nil
+}
+
+func (s *SQLiteStore) FindSSOSession(id string) *SSOSession {
+	ssoSession, err := scanSSOSession(s.db.QueryRow(`SELECT `+ssoSessionColumns+` FROM sso_sessions WHERE id = ?`, id))
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	return ssoSession
+}
+
+// TouchSSOSession extends the idle expiry of the session that has just been used
+func (s *SQLiteStore) TouchSSOSession(id string, idleTimeout time.Duration) error {
+	_, err := s.db.Exec(`UPDATE sso_sessions SET idle_expires_at = MIN(?, expires_at) WHERE id = ?`,
+		toUnixNano(time.Now().Add(idleTimeout)), id)
+	return err
+}
+
+// AddAppToSSOSession records that the user has logged in to the app within the session
+func (s *SQLiteStore) AddAppToSSOSession(id, appID string) error {
+	result, err := s.db.Exec(`UPDATE sso_sessions SET app_ids = TRIM(app_ids || ' ' || ?)
+		WHERE id = ? AND (' ' || app_ids || ' ') NOT LIKE ('% ' || ? || ' %')`, appID, id, appID)
+	if err != nil {
+		return err
+	}
+	// nothing updated if the app is already in the session
+	if updated, _ := result.RowsAffected(); updated == 0 && s.FindSSOSession(id) == nil {
+		return fmt.Errorf("SSO session not found")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteSSOSession(id string) {
+	if _, err := s.db.Exec(`DELETE FROM sso_sessions WHERE id = ?`, id); err != nil {
+		logQueryError(err)
+	}
+}
+
+// DeleteSSOSessionsOfUser logs the user out of all the browsers, returning the sessions ended
+func (s *SQLiteStore) DeleteSSOSessionsOfUser(userID string) []*SSOSession {
+	var deleted []*SSOSession
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+ssoSessionColumns+` FROM sso_sessions WHERE user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ssoSession, err := scanSSOSession(rows)
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, ssoSession)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM sso_sessions WHERE user_id = ?`, userID)
+		return err
+	})
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	return deleted
+}
+
+// DeleteExpiredSSOSessions removes the sessions idle for too long or past their absolute expiry
+func (s *SQLiteStore) DeleteExpiredSSOSessions() {
+	now := toUnixNano(time.Now())
+	if _, err := s.db.Exec(`DELETE FROM sso_sessions WHERE idle_expires_at < ? OR expires_at < ?`, now, now); err != nil {
+		logQueryError(err)
+	}
+}
+
+// rowScanner is either a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSSOSession(row rowScanner) (*SSOSession, error) {
+	ssoSession := &SSOSession{}
+	var amr, appIDs string
+	var authTime, idleExpiresAt, expiresAt int64
+	err := row.Scan(&ssoSession.ID, &ssoSession.SID, &ssoSession.UserID, &amr, &authTime, &idleExpiresAt, &expiresAt, &appIDs)
+	if err != nil {
+		return nil, err
+	}
+	ssoSession.AMR = strings.Fields(amr)
+	ssoSession.AuthTime = fromUnixNano(authTime)
+	ssoSession.IdleExpiresAt = fromUnixNano(idleExpiresAt)
+	ssoSession.ExpiresAt = fromUnixNano(expiresAt)
+	ssoSession.AppIDs = strings.Fields(appIDs)
+	return ssoSession, nil
+}
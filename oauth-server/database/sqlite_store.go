@@ -0,0 +1,242 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps all the tables in an embedded SQLite database: it implements UserStore, ClientStore, SessionStore, TokenStore, LoginAttemptStore and EmailTokenStore
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database at path and applies the pending migrations
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := MigrateUp(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// OpenSQLite opens the SQLite database at path without touching its schema
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writes, which SQLite can't run concurrently anyway
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// the SQLite store implements all the store interfaces
+var _ Store = (*SQLiteStore)(nil)
+
+// Close releases the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// SeedDemoData inserts the demo users and apps, leaving untouched the ones already there
+func (s *SQLiteStore) SeedDemoData() error {
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		for _, user := range DemoUsers() {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO users (id, name, email, password, roles, email_verified) VALUES (?, ?, ?, ?, ?, ?)`,
+				user.ID, user.Name, user.Email, user.Password, user.Roles, user.EmailVerified)
+			if err != nil {
+				return err
+			}
+		}
+		for _, app := range DemoRegisteredOauth2Apps() {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO registered_applications (`+registeredAppColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				app.ID, app.ClientID, app.ClientSecret, app.RedirectURI, app.Name, app.RequirePKCE, strings.Join(app.AllowedScopes, " "),
+				strings.Join(app.PostLogoutRedirectURIs, " "), app.RevokeTokensOnLogout, app.BackchannelLogoutURI, app.FrontchannelLogoutURI, app.FirstParty)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const userColumns = `id, name, email, password, roles, email_verified, totp_secret, totp_confirmed, totp_last_step, recovery_codes`
+
+// SaveNewUser stores the user signed up: the email must not belong to another user
+func (s *SQLiteStore) SaveNewUser(user *User) error {
+	var taken bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, user.Email).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailAlreadyRegistered
+	}
+	_, err := s.db.Exec(`INSERT INTO users (id, name, email, password, roles, email_verified) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Name, user.Email, user.Password, user.Roles, user.EmailVerified)
+	return err
+}
+
+// MarkUserEmailAsVerified records that the user owns the email address
+func (s *SQLiteStore) MarkUserEmailAsVerified(userID string) error {
+	result, err := s.db.Exec(`UPDATE users SET email_verified = 1 WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("User not found")
+	}
+	return nil
+}
+
+// UpdateUserPassword replaces the password hash of the user
+func (s *SQLiteStore) UpdateUserPassword(userID, passwordHash string) error {
+	result, err := s.db.Exec(`UPDATE users SET password = ? WHERE id = ?`, passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("User not found")
+	}
+	return nil
+}
+
+// UpdateUserTOTP enrolls the user to the TOTP second factor: an empty secret removes the enrollment
+func (s *SQLiteStore) UpdateUserTOTP(userID, secret string, confirmed bool, recoveryCodes []string) error {
+	result, err := s.db.Exec(`UPDATE users SET totp_secret = ?, totp_confirmed = ?, totp_last_step = 0, recovery_codes = ? WHERE id = ?`,
+		secret, confirmed, strings.Join(recoveryCodes, " "), userID)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("User not found")
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of a verified code: false if a code of the same or a later step has already been used
+func (s *SQLiteStore) UseTOTPStep(userID string, step int64) bool {
+	result, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+	updated, _ := result.RowsAffected()
+	return updated == 1
+}
+
+// UseRecoveryCode removes the recovery code from the unused ones: false if it is not among them
+func (s *SQLiteStore) UseRecoveryCode(userID, recoveryCodeHash string) bool {
+	used := false
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		var recoveryCodes string
+		if err := tx.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, userID).Scan(&recoveryCodes); err != nil {
+			return err
+		}
+		unused := []string{}
+		for _, hash := range strings.Fields(recoveryCodes) {
+			if hash == recoveryCodeHash && !used {
+				used = true
+				continue
+			}
+			unused = append(unused, hash)
+		}
+		if !used {
+			return nil
+		}
+		_, err := tx.Exec(`UPDATE users SET recovery_codes = ? WHERE id = ?`, strings.Join(unused, " "), userID)
+		return err
+	})
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+	return used
+}
+
+func (s *SQLiteStore) FindUserByEmail(email string) *User {
+	return s.findUser(`SELECT `+userColumns+` FROM users WHERE email = ?`, email)
+}
+
+func (s *SQLiteStore) FindUserByID(userID string) *User {
+	return s.findUser(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID)
+}
+
+func (s *SQLiteStore) findUser(query string, args ...interface{}) *User {
+	user := &User{}
+	var recoveryCodes string
+	err := s.db.QueryRow(query, args...).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Roles, &user.EmailVerified,
+		&user.TOTPSecret, &user.TOTPConfirmed, &user.TOTPLastStep, &recoveryCodes)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	user.RecoveryCodes = strings.Fields(recoveryCodes)
+	return user
+}
+
+const registeredAppColumns = `id, client_id, client_secret, redirect_uri, name, require_pkce, allowed_scopes, post_logout_redirect_uris, revoke_tokens_on_logout, backchannel_logout_uri, frontchannel_logout_uri, first_party`
+
+func (s *SQLiteStore) FindRegisteredAppByID(appID string) *RegisteredOauth2App {
+	return s.findRegisteredApp(`SELECT `+registeredAppColumns+` FROM registered_applications WHERE id = ?`, appID)
+}
+
+func (s *SQLiteStore) FindRegisteredAppByClientID(clientID string) *RegisteredOauth2App {
+	return s.findRegisteredApp(`SELECT `+registeredAppColumns+` FROM registered_applications WHERE client_id = ?`, clientID)
+}
+
+func (s *SQLiteStore) findRegisteredApp(query string, args ...interface{}) *RegisteredOauth2App {
+	app := &RegisteredOauth2App{}
+	var allowedScopes, postLogoutRedirectURIs string
+	err := s.db.QueryRow(query, args...).Scan(&app.ID, &app.ClientID, &app.ClientSecret, &app.RedirectURI, &app.Name, &app.RequirePKCE, &allowedScopes,
+		&postLogoutRedirectURIs, &app.RevokeTokensOnLogout, &app.BackchannelLogoutURI, &app.FrontchannelLogoutURI, &app.FirstParty)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	app.AllowedScopes = strings.Fields(allowedScopes)
+	app.PostLogoutRedirectURIs = strings.Fields(postLogoutRedirectURIs)
+	return app
+}
+
+// logQueryError logs the failures of the queries: a missing record is not a failure
+func logQueryError(err error) {
+	if err != sql.ErrNoRows {
+		log.Println("SQLite query failed:", err)
+	}
+}
+
+// times are stored as unix nanoseconds, 0 being the zero time
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// nullable columns are scanned into sql.NullString and exposed as *string
+func fromNullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
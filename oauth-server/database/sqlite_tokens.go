@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const refreshTokenColumns = `token, family_id, app_id, user_id, scope, access_token_jti, amr, auth_time, used, revoked, created_at, expires_in`
+
+// DeleteExpiredRefreshTokens removes the refresh tokens that have outlived their validity
+func (s *SQLiteStore) DeleteExpiredRefreshTokens() {
+	if _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE created_at + expires_in * 1000000000 < ?`, toUnixNano(time.Now())); err != nil {
+		logQueryError(err)
+	}
+}
+
+// SaveNewRefreshToken creates a new refresh token: if familyID is empty a new token family is started.
+// The login of the user is carried along the rotations of the family
+func (s *SQLiteStore) SaveNewRefreshToken(appID, userID, scope, familyID, accessTokenJTI string, amr []string, authTime time.Time) (*RefreshToken, error) {
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+	refreshToken := &RefreshToken{
+		Token:          uuid.New().String(),
+		FamilyID:       familyID,
+		AppID:          appID,
+		UserID:         userID,
+		Scope:          scope,
+		AccessTokenJTI: accessTokenJTI,
+		AMR:            amr,
+		AuthTime:       authTime,
+		CreatedAt:      time.Now(),
+		ExpiresIn:      RefreshTokenExpiresIn,
+	}
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		refreshToken.Token, refreshToken.FamilyID, refreshToken.AppID, refreshToken.UserID, refreshToken.Scope,
+		refreshToken.AccessTokenJTI, strings.Join(amr, " "), toUnixNano(authTime), refreshToken.Used, refreshToken.Revoked, toUnixNano(refreshToken.CreatedAt), refreshToken.ExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	return refreshToken, nil
+}
+
+func (s *SQLiteStore) FindRefreshToken(token string) *RefreshToken {
+	return s.findRefreshToken(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token = ?`, token)
+}
+
+// MarkRefreshTokenAsUsed rotates the token: alreadyUsed is set if it had already been rotated,
+// so that only one of two concurrent refreshes with the same token succeeds
+func (s *SQLiteStore) MarkRefreshTokenAsUsed(token string) (alreadyUsed bool, err error) {
+	result, err := s.db.Exec(`UPDATE refresh_tokens SET used = 1 WHERE token = ? AND used = 0`, token)
+	if err != nil {
+		return false, err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		if s.FindRefreshToken(token) == nil {
+			return false, fmt.Errorf("Refresh token not found")
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// RevokeRefreshTokenFamily revokes all the refresh tokens rotated from the same authorization grant
+// and the access tokens issued together with them
+func (s *SQLiteStore) RevokeRefreshTokenFamily(familyID string) {
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at, revoked_at)
+			SELECT access_token_jti, created_at + ?, ? FROM refresh_tokens WHERE family_id = ? AND access_token_jti != ''`,
+			int64(AccessTokenExpiresIn*time.Second), toUnixNano(time.Now()), familyID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE family_id = ?`, familyID)
+		return err
+	})
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+// RevokeRefreshTokensOfUser revokes all the refresh tokens of the user issued to the app, or to any app if appID is empty,
+// and the access tokens issued together with them
+func (s *SQLiteStore) RevokeRefreshTokensOfUser(userID, appID string) {
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at, revoked_at)
+			SELECT access_token_jti, created_at + ?, ? FROM refresh_tokens
+			WHERE user_id = ? AND (? = '' OR app_id = ?) AND revoked = 0 AND access_token_jti != ''`,
+			int64(AccessTokenExpiresIn*time.Second), toUnixNano(time.Now()), userID, appID, appID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ? AND (? = '' OR app_id = ?)`, userID, appID, appID)
+		return err
+	})
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+// FindRefreshTokenByAccessTokenJTI looks for the refresh token issued together with the access token
+func (s *SQLiteStore) FindRefreshTokenByAccessTokenJTI(jti string) *RefreshToken {
+	return s.findRefreshToken(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE access_token_jti = ?`, jti)
+}
+
+func (s *SQLiteStore) findRefreshToken(query string, args ...interface{}) *RefreshToken {
+	refreshToken := &RefreshToken{}
+	var amr string
+	var authTime, createdAt int64
+	err := s.db.QueryRow(query, args...).Scan(&refreshToken.Token, &refreshToken.FamilyID, &refreshToken.AppID, &refreshToken.UserID,
+		&refreshToken.Scope, &refreshToken.AccessTokenJTI, &amr, &authTime, &refreshToken.Used, &refreshToken.Revoked, &createdAt, &refreshToken.ExpiresIn)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	refreshToken.AMR = strings.Fields(amr)
+	refreshToken.AuthTime = fromUnixNano(authTime)
+	refreshToken.CreatedAt = fromUnixNano(createdAt)
+	return refreshToken
+}
+
+// DeleteExpiredRevokedTokens removes the revoked tokens that have expired in the meantime
+func (s *SQLiteStore) DeleteExpiredRevokedTokens() {
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, toUnixNano(time.Now())); err != nil {
+		logQueryError(err)
+	}
+}
+
+// RevokeAccessToken adds the jti of an access token to the revocation list until the token expires
+func (s *SQLiteStore) RevokeAccessToken(jti string, expiresAt time.Time) {
+	if jti == "" {
+		return
+	}
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at, revoked_at) VALUES (?, ?, ?)`,
+		jti, toUnixNano(expiresAt), toUnixNano(time.Now()))
+	if err != nil {
+		logQueryError(err)
+	}
+}
+
+func (s *SQLiteStore) IsAccessTokenRevoked(jti string) bool {
+	var revoked int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?`, jti).Scan(&revoked)
+	if err != nil {
+		logQueryError(err)
+		// if the revocation list can't be read the token must not be trusted
+		return true
+	}
+	return revoked > 0
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SSOSession represents the DB record for sso_sessions table: the browser of a user who has completed the login,
+// so that the next authorization requests from any app skip the login form until the session expires
+type SSOSession struct {
+	ID       string // the value of the signed cookie
+	SID      string // OpenID Connect: the sid claim identifying the session to the apps, that never see the cookie
+	UserID   string
+	AMR      []string  // the methods the user authenticated with (RFC 8176)
+	AuthTime time.Time // when the user logged in: the auth_time claim of the id_tokens issued within the session
+	// the session ends when it has been idle too long or at its absolute expiry, whatever comes first
+	IdleExpiresAt time.Time
+	ExpiresAt     time.Time
+	// the apps the user has logged in to within the session: they are notified when the user logs out
+	AppIDs []string
+}
+
+// IsExpired tells if the session can't be used anymore
+func (s *SSOSession) IsExpired() bool {
+	now := time.Now()
+	return now.After(s.IdleExpiresAt) || now.After(s.ExpiresAt)
+}
+
+// newSSOSession creates the session of the user who has just logged in: the absolute expiry counts from the login
+func newSSOSession(userID string, amr []string, authTime time.Time, idleTimeout, maxLifetime time.Duration) *SSOSession {
+	ssoSession := &SSOSession{
+		ID:        uuid.New().String(),
+		SID:       uuid.New().String(),
+		UserID:    userID,
+		AMR:       amr,
+		AuthTime:  authTime,
+		ExpiresAt: authTime.Add(maxLifetime),
+	}
+	ssoSession.IdleExpiresAt = idleExpiry(ssoSession, idleTimeout)
+	return ssoSession
+}
+
+// idleExpiry moves the idle expiry after the session is used, never past the absolute one
+func idleExpiry(ssoSession *SSOSession, idleTimeout time.Duration) time.Time {
+	idleExpiresAt := time.Now().Add(idleTimeout)
+	if idleExpiresAt.After(ssoSession.ExpiresAt) {
+		return ssoSession.ExpiresAt
+	}
+	return idleExpiresAt
+}
+
+// SaveNewSSOSession starts the session of the user who has just logged in
+func (s *MemoryStore) SaveNewSSOSession(userID string, amr []string, authTime time.Time, idleTimeout, maxLifetime time.Duration) (*SSOSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.findUserByID(userID) == nil {
+		return nil, fmt.Errorf("User not found")
+	}
+	ssoSession := newSSOSession(userID, amr, authTime, idleTimeout, maxLifetime)
+	s.ssoSessionsTable[ssoSession.ID] = ssoSession
+	return copySSOSession(ssoSession), nil
+}
+
+func (s *MemoryStore) FindSSOSession(id string) *SSOSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copySSOSession(s.ssoSessionsTable[id])
+}
+
+// TouchSSOSession extends the idle expiry of the session that has just been used
+func (s *MemoryStore) TouchSSOSession(id string, idleTimeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ssoSession := s.ssoSessionsTable[id]
+	if ssoSession == nil {
+		return fmt.Errorf("SSO session not found")
+	}
+	ssoSession.IdleExpiresAt = idleExpiry(ssoSession, idleTimeout)
+	return nil
+}
+
+// AddAppToSSOSession records that the user has logged in to the app within the session
+func (s *MemoryStore) AddAppToSSOSession(id, appID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ssoSession := s.ssoSessionsTable[id]
+	if ssoSession == nil {
+		return fmt.Errorf("SSO session not found")
+	}
+	for _, loggedInAppID := range ssoSession.AppIDs {
+		if loggedInAppID == appID {
+			return nil
+		}
+	}
+	ssoSession.AppIDs = append(ssoSession.AppIDs, appID)
+	return nil
+}
+
+func (s *MemoryStore) DeleteSSOSession(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.ssoSessionsTable, id)
+}
+
+// DeleteSSOSessionsOfUser logs the user out of all the browsers, returning the sessions ended
+func (s *MemoryStore) DeleteSSOSessionsOfUser(userID string) []*SSOSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var deleted []*SSOSession
+	for id, ssoSession := range s.ssoSessionsTable {
+		if ssoSession.UserID == userID {
+			deleted = append(deleted, ssoSession)
+			delete(s.ssoSessionsTable, id)
+		}
+	}
+	return deleted
+}
+
+// DeleteExpiredSSOSessions removes the sessions idle for too long or past their absolute expiry
+func (s *MemoryStore) DeleteExpiredSSOSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, ssoSession := range s.ssoSessionsTable {
+		if ssoSession.IsExpired() {
+			delete(s.ssoSessionsTable, id)
+		}
+	}
+}
+
+// copySSOSession returns a copy of the session that can be read while the stored one is updated
+func copySSOSession(ssoSession *SSOSession) *SSOSession {
+	if ssoSession == nil {
+		return nil
+	}
+	ssoSessionCopy := *ssoSession
+	ssoSessionCopy.AMR = append([]string(nil), ssoSession.AMR...)
+	ssoSessionCopy.AppIDs = append([]string(nil), ssoSession.AppIDs...)
+	return &ssoSessionCopy
+}
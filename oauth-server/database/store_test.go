@@ -0,0 +1,387 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUserID   = "af8ab5ea-8cc9-44a0-8d83-c4e9462166bc"
+	testEmail    = "john.doe@email.com"
+	testAppID    = "4b3d6d22-a317-456c-9f2e-793bd6a29ac0"
+	testClientID = "12345"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.SeedDemoData(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestStoreContract runs the same checks against both stores: the handlers must not tell them apart
+func TestStoreContract(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemoryStore() },
+		"sqlite": func(t *testing.T) Store { return newTestSQLiteStore(t) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("users", func(t *testing.T) { testUsers(t, newStore(t)) })
+			t.Run("oauth2 sessions", func(t *testing.T) { testOauth2Sessions(t, newStore(t)) })
+			t.Run("refresh tokens", func(t *testing.T) { testRefreshTokens(t, newStore(t)) })
+			t.Run("device authorizations", func(t *testing.T) { testDeviceAuthorizations(t, newStore(t)) })
+			t.Run("sso sessions", func(t *testing.T) { testSSOSessions(t, newStore(t)) })
+			t.Run("email tokens", func(t *testing.T) { testEmailTokens(t, newStore(t)) })
+			t.Run("consents", func(t *testing.T) { testConsents(t, newStore(t)) })
+			t.Run("login attempts", func(t *testing.T) { testLoginAttempts(t, newStore(t)) })
+		})
+	}
+}
+
+func testUsers(t *testing.T, store Store) {
+	user := store.FindUserByEmail(testEmail)
+	if user == nil || user.ID != testUserID || store.FindUserByID(testUserID).Email != testEmail {
+		t.Fatalf("demo user not found: %+v", user)
+	}
+	if app := store.FindRegisteredAppByClientID(testClientID); app == nil || app.ID != testAppID {
+		t.Fatalf("demo app not found: %+v", app)
+	}
+	if err := store.SaveNewUser(&User{ID: "other", Name: "Other", Email: testEmail, Roles: "user"}); err != ErrEmailAlreadyRegistered {
+		t.Errorf("same email signed up twice: got %v", err)
+	}
+	if err := store.UpdateUserPassword(testUserID, "new-hash"); err != nil || store.FindUserByID(testUserID).Password != "new-hash" {
+		t.Errorf("password not updated: %v", err)
+	}
+	if err := store.UpdateUserPassword("unknown", "new-hash"); err == nil {
+		t.Error("unknown user: the password update must fail")
+	}
+}
+
+func testOauth2Sessions(t *testing.T, store Store) {
+	saved, err := store.SaveNewOauth2Session(testClientID, "http://localhost:8081/redirect", "openid profile", "state", "", "", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the state is chosen by the client: another login with the same state is another session
+	if other, err := store.SaveNewOauth2Session(testClientID, "http://localhost:8081/redirect", "openid", "state", "", "", ""); err != nil || other.ID == saved.ID {
+		t.Errorf("a login with the same state must start a new session: got %+v, %v", other, err)
+	}
+	if err := store.UpdateOauth2SessionScope(saved.ID, "openid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOauth2SessionWithEmail(saved.ID, testEmail, []string{"pwd"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOauth2SessionWithAuthCode(saved.ID, "code"); err != nil {
+		t.Fatal(err)
+	}
+	session := store.FindOauth2SessionByCode("code")
+	if session == nil || session.ID != saved.ID || session.State != "state" || session.Scope != "openid" || *session.Email != testEmail || session.Nonce != "nonce" {
+		t.Fatalf("session not found by code: %+v", session)
+	}
+
+	if _, alreadyRedeemed := store.RedeemAuthorizationCode("code", "family"); alreadyRedeemed {
+		t.Fatal("first redemption reported as a reuse")
+	}
+	session, alreadyRedeemed := store.RedeemAuthorizationCode("code", "other-family")
+	if !alreadyRedeemed || session.FamilyID != "family" {
+		t.Errorf("second redemption: got alreadyRedeemed %v and family %q", alreadyRedeemed, session.FamilyID)
+	}
+	if _, err := store.UpdateOauth2SessionWithAuthCode(saved.ID, "new-code"); err == nil {
+		t.Error("no new code can be issued once the code has been redeemed")
+	}
+	if err := store.UpdateOauth2SessionScope("unknown", "openid"); err == nil {
+		t.Error("unknown session: the scope update must fail")
+	}
+}
+
+func testRefreshTokens(t *testing.T, store Store) {
+	authTime := time.Now().Truncate(time.Second)
+	first, err := store.SaveNewRefreshToken(testAppID, testUserID, "openid", "", "jti-1", []string{"pwd", "otp"}, authTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := store.SaveNewRefreshToken(testAppID, testUserID, "openid", first.FamilyID, "jti-2", first.AMR, first.AuthTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := store.FindRefreshToken(first.Token); found == nil || found.FamilyID == "" || found.Scope != "openid" {
+		t.Fatalf("refresh token not found: %+v", found)
+	}
+	if found := store.FindRefreshToken(rotated.Token); strings.Join(found.AMR, " ") != "pwd otp" || !found.AuthTime.Equal(authTime) {
+		t.Errorf("the rotated refresh token must keep the login of the user: %+v", found)
+	}
+	if found := store.FindRefreshTokenByAccessTokenJTI("jti-2"); found == nil || found.Token != rotated.Token {
+		t.Fatalf("refresh token not found by jti: %+v", found)
+	}
+
+	if alreadyUsed, err := store.MarkRefreshTokenAsUsed(first.Token); alreadyUsed || err != nil {
+		t.Fatalf("first rotation: got alreadyUsed %v, err %v", alreadyUsed, err)
+	}
+	if alreadyUsed, err := store.MarkRefreshTokenAsUsed(first.Token); !alreadyUsed || err != nil {
+		t.Errorf("second rotation: got alreadyUsed %v, err %v, want the reuse reported", alreadyUsed, err)
+	}
+	if _, err := store.MarkRefreshTokenAsUsed("unknown"); err == nil {
+		t.Error("unknown token: the rotation must fail")
+	}
+
+	store.RevokeRefreshTokenFamily(first.FamilyID)
+	for _, token := range []*RefreshToken{first, rotated} {
+		if !store.FindRefreshToken(token.Token).Revoked || !store.IsAccessTokenRevoked(token.AccessTokenJTI) {
+			t.Errorf("the refresh token %s and its access token must be revoked with the family", token.Token)
+		}
+	}
+}
+
+func testDeviceAuthorizations(t *testing.T, store Store) {
+	approved, err := store.SaveNewDeviceAuthorization(testClientID, "openid profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := store.FindDeviceAuthorizationByUserCode(approved.UserCode); found == nil || found.DeviceCode != approved.DeviceCode {
+		t.Fatalf("device authorization not found by user code: %+v", found)
+	}
+	if store.RedeemDeviceAuthorization(approved.DeviceCode) != nil {
+		t.Error("a pending device authorization can't be redeemed")
+	}
+	authTime := time.Now().Truncate(time.Second)
+	if _, err := store.ApproveDeviceAuthorization(approved.DeviceCode, testEmail, "openid", []string{"pwd", "otp"}, authTime); err != nil {
+		t.Fatal(err)
+	}
+	if found := store.FindDeviceAuthorizationByDeviceCode(approved.DeviceCode); found.Email == nil || *found.Email != testEmail || found.Scope != "openid" {
+		t.Errorf("the approval must record the user and the granted scopes: %+v", found)
+	}
+	redeemed := store.RedeemDeviceAuthorization(approved.DeviceCode)
+	if redeemed == nil || *redeemed.Email != testEmail || strings.Join(redeemed.AMR, " ") != "pwd otp" || !redeemed.AuthTime.Equal(authTime) {
+		t.Fatalf("the approved device authorization must be redeemed with the login of the user: %+v", redeemed)
+	}
+	if store.RedeemDeviceAuthorization(approved.DeviceCode) != nil || store.FindDeviceAuthorizationByDeviceCode(approved.DeviceCode) != nil {
+		t.Error("the device authorization must be redeemed only once")
+	}
+
+	denied, _ := store.SaveNewDeviceAuthorization(testClientID, "openid")
+	if err := store.DenyDeviceAuthorization(denied.DeviceCode); err != nil || !store.FindDeviceAuthorizationByDeviceCode(denied.DeviceCode).Denied {
+		t.Errorf("device authorization not denied: %v", err)
+	}
+	if store.RedeemDeviceAuthorization(denied.DeviceCode) != nil {
+		t.Error("a denied device authorization can't be redeemed")
+	}
+	store.DeleteDeviceAuthorization(denied.DeviceCode)
+	if store.FindDeviceAuthorizationByDeviceCode(denied.DeviceCode) != nil {
+		t.Error("device authorization not deleted")
+	}
+}
+
+func testSSOSessions(t *testing.T, store Store) {
+	ssoSession, err := store.SaveNewSSOSession(testUserID, []string{"pwd"}, time.Now(), time.Hour, 12*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.AddAppToSSOSession(ssoSession.ID, testAppID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found := store.FindSSOSession(ssoSession.ID); found == nil || len(found.AppIDs) != 1 || found.SID != ssoSession.SID {
+		t.Fatalf("the app must be recorded once in the SSO session: %+v", found)
+	}
+	if err := store.AddAppToSSOSession("unknown", testAppID); err == nil {
+		t.Error("unknown SSO session: adding the app must fail")
+	}
+	if deleted := store.DeleteSSOSessionsOfUser(testUserID); len(deleted) != 1 || deleted[0].ID != ssoSession.ID {
+		t.Errorf("the ended sessions must be returned: %+v", deleted)
+	}
+	if store.FindSSOSession(ssoSession.ID) != nil {
+		t.Error("SSO session not deleted")
+	}
+}
+
+func testEmailTokens(t *testing.T, store Store) {
+	if err := store.SaveNewEmailToken("hash", testUserID, "verify", 60); err != nil {
+		t.Fatal(err)
+	}
+	if store.FindEmailToken("hash", "reset") != nil {
+		t.Error("a token can't be used for another purpose")
+	}
+	if token := store.ConsumeEmailToken("hash", "verify"); token == nil || token.UserID != testUserID {
+		t.Fatalf("token not consumed: %+v", token)
+	}
+	if store.ConsumeEmailToken("hash", "verify") != nil {
+		t.Error("a token can be consumed only once")
+	}
+}
+
+func testConsents(t *testing.T, store Store) {
+	if _, err := store.SaveConsent(testUserID, testAppID, "openid profile", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveConsent(testUserID, testAppID, "profile email", true); err != nil {
+		t.Fatal(err)
+	}
+	consent := store.FindConsent(testUserID, testAppID)
+	if consent == nil || consent.Scope != "openid profile email" || !consent.Covers("email openid") {
+		t.Errorf("the granted scopes must be merged: %+v", consent)
+	}
+
+	if _, err := store.SaveConsent(testUserID, "other-app", "openid", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveConsent(testUserID, "other-app", "profile", false); err != nil {
+		t.Fatal(err)
+	}
+	consent = store.FindConsent(testUserID, "other-app")
+	if consent == nil || consent.Scope != "openid profile" || consent.RememberedScope != "openid" || consent.Covers("openid profile") {
+		t.Errorf("the scopes granted without remembering them must be recorded but not cover the requests: %+v", consent)
+	}
+}
+
+func testLoginAttempts(t *testing.T, store Store) {
+	// at most 2 failures per key
+	retryAfter := func(key string, loginAttempt *LoginAttempt) time.Duration {
+		if loginAttempt != nil && loginAttempt.Failures >= 2 {
+			return time.Minute
+		}
+		return 0
+	}
+	keys := []string{"email:" + testEmail, "ip:192.0.2.1"}
+	for i := 0; i < 2; i++ {
+		if wait, err := store.ReserveLoginAttempt(keys, retryAfter); wait != 0 || err != nil {
+			t.Fatalf("attempt %d: got wait %v, err %v", i, wait, err)
+		}
+	}
+	if wait, err := store.ReserveLoginAttempt(keys, retryAfter); wait != time.Minute || err != nil {
+		t.Fatalf("third attempt: got wait %v, err %v, want to wait", wait, err)
+	}
+	if loginAttempt := store.FindLoginAttempt(keys[1]); loginAttempt == nil || loginAttempt.Failures != 2 {
+		t.Errorf("the throttled attempt must not be counted: %+v", loginAttempt)
+	}
+
+	// a key throttled blocks the others without counting them
+	if wait, _ := store.ReserveLoginAttempt([]string{"email:other@email.com", keys[1]}, retryAfter); wait != time.Minute {
+		t.Errorf("throttled IP address: got wait %v", wait)
+	}
+	if loginAttempt := store.FindLoginAttempt("email:other@email.com"); loginAttempt != nil {
+		t.Errorf("nothing must be counted when a key is throttled: %+v", loginAttempt)
+	}
+
+	store.ReleaseLoginAttempt(keys[1])
+	if loginAttempt := store.FindLoginAttempt(keys[1]); loginAttempt == nil || loginAttempt.Failures != 1 {
+		t.Errorf("the released attempt must be given back: %+v", loginAttempt)
+	}
+	store.ReleaseLoginAttempt(keys[1])
+	if loginAttempt := store.FindLoginAttempt(keys[1]); loginAttempt != nil {
+		t.Errorf("the key with no failures left must be forgotten: %+v", loginAttempt)
+	}
+}
+
+// TestRedeemedOauth2SessionsKeptAsTombstones checks that the cleanup keeps the redeemed codes as long as the refresh
+// tokens issued from them: a replay must still be detected
+func TestRedeemedOauth2SessionsKeptAsTombstones(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	sqliteStore := newTestSQLiteStore(t)
+	stores := map[string]struct {
+		store    Store
+		backdate func(id string, age time.Duration)
+	}{
+		"memory": {memoryStore, func(id string, age time.Duration) {
+			session := memoryStore.oauth2SessionsByID[id]
+			session.CreatedAt = session.CreatedAt.Add(-age)
+			session.CodeIssuedAt = session.CodeIssuedAt.Add(-age)
+		}},
+		"sqlite": {sqliteStore, func(id string, age time.Duration) {
+			_, err := sqliteStore.db.Exec(`UPDATE oauth2_sessions SET created_at = created_at - ?, code_issued_at = code_issued_at - ? WHERE id = ?`,
+				age.Nanoseconds(), age.Nanoseconds(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for name, test := range stores {
+		store, backdate := test.store, test.backdate
+		t.Run(name, func(t *testing.T) {
+			withCode := func(code string) string {
+				session, err := store.SaveNewOauth2Session(testClientID, "http://localhost:8081/redirect", "openid", "", "", "", "")
+				if err == nil {
+					_, err = store.UpdateOauth2SessionWithAuthCode(session.ID, code)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				return session.ID
+			}
+			redeemed, pending := withCode("redeemed-code"), withCode("pending-code")
+			store.RedeemAuthorizationCode("redeemed-code", "family")
+
+			backdate(redeemed, 2*Oauth2SessionExpiresIn*time.Second)
+			backdate(pending, 2*Oauth2SessionExpiresIn*time.Second)
+			store.DeleteExpiredOauth2Sessions()
+			if store.FindOauth2SessionByID(pending) != nil {
+				t.Error("the expired session must be deleted")
+			}
+			if session, alreadyRedeemed := store.RedeemAuthorizationCode("redeemed-code", "other-family"); !alreadyRedeemed || session.FamilyID != "family" {
+				t.Errorf("the redeemed code must be kept: got alreadyRedeemed %v and %+v", alreadyRedeemed, session)
+			}
+
+			backdate(redeemed, RefreshTokenExpiresIn*time.Second)
+			store.DeleteExpiredOauth2Sessions()
+			if store.FindOauth2SessionByID(redeemed) != nil {
+				t.Error("the tombstone must be deleted once the refresh tokens issued from the code have expired")
+			}
+		})
+	}
+}
+
+// TestSaveNewRefreshTokenFailure checks that a failed insert is reported instead of returning a nil token
+func TestSaveNewRefreshTokenFailure(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	store.Close()
+	if token, err := store.SaveNewRefreshToken(testAppID, testUserID, "openid", "", "jti", nil, time.Now()); err == nil || token != nil {
+		t.Errorf("closed database: got %+v and err %v", token, err)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "migrations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	latest := migrations[len(migrations)-1].Version
+
+	for round := 0; round < 2; round++ {
+		if err := MigrateUp(db); err != nil {
+			t.Fatal(err)
+		}
+		if version, _ := schemaVersion(db); version != latest {
+			t.Fatalf("after the migrations: got version %d, want %d", version, latest)
+		}
+		// applying them again changes nothing
+		if err := MigrateUp(db); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := MigrateDown(db, 1); err != nil {
+			t.Fatal(err)
+		}
+		if version, _ := schemaVersion(db); version != 1 {
+			t.Fatalf("after the rollback to 1: got version %d", version)
+		}
+		if err := MigrateDown(db, 0); err != nil {
+			t.Fatal(err)
+		}
+		var tables int
+		db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'`).Scan(&tables)
+		if tables != 0 {
+			t.Fatalf("after the rollback to 0: %d tables left", tables)
+		}
+	}
+}
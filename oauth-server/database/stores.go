@@ -0,0 +1,105 @@
+package database
+
+import "time"
+
+// Store gives access to all the tables
+type Store interface {
+	UserStore
+	ClientStore
+	SessionStore
+	TokenStore
+	LoginAttemptStore
+	EmailTokenStore
+	ConsentStore
+}
+
+// UserStore gives access to the users table
+type UserStore interface {
+	FindUserByID(userID string) *User
+	FindUserByEmail(email string) *User
+	SaveNewUser(user *User) error
+	MarkUserEmailAsVerified(userID string) error
+	UpdateUserPassword(userID, passwordHash string) error
+	UpdateUserTOTP(userID, secret string, confirmed bool, recoveryCodes []string) error
+	UseTOTPStep(userID string, step int64) bool
+	UseRecoveryCode(userID, recoveryCodeHash string) bool
+}
+
+// ClientStore gives access to the registered applications table
+type ClientStore interface {
+	FindRegisteredAppByID(appID string) *RegisteredOauth2App
+	FindRegisteredAppByClientID(clientID string) *RegisteredOauth2App
+}
+
+// SessionStore gives access to the login flows in progress, the Oauth2 sessions and the device authorizations,
+// and to the SSO sessions of the browsers where the users have logged in
+type SessionStore interface {
+	SaveNewOauth2Session(clientID, redirectURI, scope, state, codeChallenge, codeChallengeMethod, nonce string) (*Oauth2Session, error)
+	SaveNewOauth2SessionForDevice(deviceCode string) (*Oauth2Session, error)
+	FindOauth2SessionByID(id string) *Oauth2Session
+	FindOauth2SessionByCode(code string) *Oauth2Session
+	RedeemAuthorizationCode(code, familyID string) (oauthSession *Oauth2Session, alreadyRedeemed bool)
+	UpdateOauth2SessionWithAuthCode(id, code string) (*Oauth2Session, error)
+	UpdateOauth2SessionWithEmail(id, email string, amr []string, authTime time.Time) (*Oauth2Session, error)
+	UpdateOauth2SessionWithSSOSession(id, ssoSessionID string) error
+	UpdateOauth2SessionScope(id, scope string) error
+	DeleteExpiredOauth2Sessions()
+	DeleteOauth2SessionsByEmail(email string)
+
+	SaveNewDeviceAuthorization(clientID, scope string) (*DeviceAuthorization, error)
+	FindDeviceAuthorizationByDeviceCode(deviceCode string) *DeviceAuthorization
+	FindDeviceAuthorizationByUserCode(userCode string) *DeviceAuthorization
+	UpdateDeviceAuthorizationPolling(deviceCode string, lastPolledAt time.Time, interval int) error
+	ApproveDeviceAuthorization(deviceCode, email, scope string, amr []string, authTime time.Time) (*DeviceAuthorization, error)
+	DenyDeviceAuthorization(deviceCode string) error
+	DeleteDeviceAuthorization(deviceCode string)
+	RedeemDeviceAuthorization(deviceCode string) *DeviceAuthorization
+	DeleteExpiredDeviceAuthorizations()
+
+	SaveNewSSOSession(userID string, amr []string, authTime time.Time, idleTimeout, maxLifetime time.Duration) (*SSOSession, error)
+	FindSSOSession(id string) *SSOSession
+	TouchSSOSession(id string, idleTimeout time.Duration) error
+	AddAppToSSOSession(id, appID string) error
+	DeleteSSOSession(id string)
+	DeleteSSOSessionsOfUser(userID string) []*SSOSession
+	DeleteExpiredSSOSessions()
+}
+
+// TokenStore gives access to the refresh tokens and to the revocation list of the access tokens
+type TokenStore interface {
+	SaveNewRefreshToken(appID, userID, scope, familyID, accessTokenJTI string, amr []string, authTime time.Time) (*RefreshToken, error)
+	FindRefreshToken(token string) *RefreshToken
+	FindRefreshTokenByAccessTokenJTI(jti string) *RefreshToken
+	MarkRefreshTokenAsUsed(token string) (alreadyUsed bool, err error)
+	RevokeRefreshTokenFamily(familyID string)
+	RevokeRefreshTokensOfUser(userID, appID string)
+	DeleteExpiredRefreshTokens()
+
+	RevokeAccessToken(jti string, expiresAt time.Time)
+	IsAccessTokenRevoked(jti string) bool
+	DeleteExpiredRevokedTokens()
+}
+
+// LoginAttemptStore gives access to the failed logins, counted per account and per IP address
+type LoginAttemptStore interface {
+	FindLoginAttempt(key string) *LoginAttempt
+	ReserveLoginAttempt(keys []string, retryAfter LoginRetryAfterFunc) (wait time.Duration, err error)
+	ReleaseLoginAttempt(key string)
+	DeleteLoginAttempt(key string)
+	DeleteExpiredLoginAttempts()
+}
+
+// EmailTokenStore gives access to the single-use tokens of the links sent by email
+type EmailTokenStore interface {
+	SaveNewEmailToken(tokenHash, userID, purpose string, expiresIn int) error
+	FindEmailToken(tokenHash, purpose string) *EmailToken
+	ConsumeEmailToken(tokenHash, purpose string) *EmailToken
+	DeleteEmailTokensOfUser(userID, purpose string)
+	DeleteExpiredEmailTokens()
+}
+
+// ConsentStore gives access to the scopes the users have granted to the apps
+type ConsentStore interface {
+	FindConsent(userID, appID string) *Consent
+	SaveConsent(userID, appID, scope string, remember bool) (*Consent, error)
+}
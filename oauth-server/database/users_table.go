@@ -1,56 +1,174 @@
 package database
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
 )
 
+// ErrEmailAlreadyRegistered is returned when a user signs up with the email of another user
+var ErrEmailAlreadyRegistered = errors.New("Email already registered")
+
 // User represents the DB record for users table
 type User struct {
 	ID       string
 	Name     string
 	Email    string
-	Password string
+	Password string // PHC string of the password hash: legacy entries are the base64 of the plain text, rehashed on login
 	Roles    string
+	// the users who sign up can't log in until they open the link sent to their email
+	EmailVerified bool
+	// TOTP second factor (RFC 6238): required at login once the enrollment has been confirmed with a first code
+	TOTPSecret    string
+	TOTPConfirmed bool
+	TOTPLastStep  int64    // the last time step used, so that a code can't be replayed
+	RecoveryCodes []string // hashes of the unused recovery codes
 }
 
-var usersTable = []*User{
-	{
-		ID:       "af8ab5ea-8cc9-44a0-8d83-c4e9462166bc",
-		Name:     "John Doe",
-		Email:    "john.doe@email.com",
-		Password: "ampq", // jjj
-		Roles:    "*",
-	},
-	{
-		ID:       "2ea086fe-d0e1-4e05-b24b-d954c45a3f52",
-		Name:     "Marion Ruhl",
-		Email:    "marion.ruhl@email.com",
-		Password: "cGFzc3dvcmQ=", // password
-		Roles:    "user",
-	},
-	{
-		ID:       "bde77f50-7a67-4ce2-88a0-3ad3fcc05340",
-		Name:     "Angela Coghill",
-		Email:    "angela.coghill@email.com",
-		Password: "YW5nZWxhY29nMTIzNDU=", // angelacog12345
-		Roles:    "user",
-	},
-}
-
-func FindUserByEmailAndPassword(email, password string) *User {
-	for _, user := range usersTable {
-		if user.Email == email && user.Password == base64.StdEncoding.EncodeToString([]byte(password)) {
-			return user
+// DemoUsers returns the users the demo starts with
+func DemoUsers() []*User {
+	return []*User{
+		{
+			ID:       "af8ab5ea-8cc9-44a0-8d83-c4e9462166bc",
+			Name:     "John Doe",
+			Email:    "john.doe@email.com",
+			Password: "ampq", // jjj
+			Roles:    "*",
+
+			EmailVerified: true,
+		},
+		{
+			ID:       "2ea086fe-d0e1-4e05-b24b-d954c45a3f52",
+			Name:     "Marion Ruhl",
+			Email:    "marion.ruhl@email.com",
+			Password: "cGFzc3dvcmQ=", // password
+			Roles:    "user",
+
+			EmailVerified: true,
+		},
+		{
+			ID:       "bde77f50-7a67-4ce2-88a0-3ad3fcc05340",
+			Name:     "Angela Coghill",
+			Email:    "angela.coghill@email.com",
+			Password: "YW5nZWxhY29nMTIzNDU=", // angelacog12345
+			Roles:    "user",
+
+			EmailVerified: true,
+		},
+	}
+}
+
+// SaveNewUser stores the user signed up: the email must not belong to another user
+func (s *MemoryStore) SaveNewUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, u := range s.usersTable {
+		if u.Email == user.Email {
+			return ErrEmailAlreadyRegistered
 		}
 	}
-	fmt.Printf("Not found user %s with password %s", email, base64.StdEncoding.EncodeToString([]byte(password)))
+	userCopy := *user
+	s.usersTable = append(s.usersTable, &userCopy)
+	return nil
+}
+
+// MarkUserEmailAsVerified records that the user owns the email address
+func (s *MemoryStore) MarkUserEmailAsVerified(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByID(userID)
+	if user == nil {
+		return fmt.Errorf("User not found")
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+// UpdateUserPassword replaces the password hash of the user
+func (s *MemoryStore) UpdateUserPassword(userID, passwordHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByID(userID)
+	if user == nil {
+		return fmt.Errorf("User not found")
+	}
+	user.Password = passwordHash
+	return nil
+}
+
+// UpdateUserTOTP enrolls the user to the TOTP second factor: an empty secret removes the enrollment
+func (s *MemoryStore) UpdateUserTOTP(userID, secret string, confirmed bool, recoveryCodes []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByID(userID)
+	if user == nil {
+		return fmt.Errorf("User not found")
+	}
+	user.TOTPSecret = secret
+	user.TOTPConfirmed = confirmed
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = recoveryCodes
 	return nil
 }
 
-func FindUserByEmail(email string) *User {
-	for _, user := range usersTable {
+// UseTOTPStep records the time step of a verified code: false if a code of the same or a later step has already been used
+func (s *MemoryStore) UseTOTPStep(userID string, step int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByID(userID)
+	if user == nil || step <= user.TOTPLastStep {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// UseRecoveryCode removes the recovery code from the unused ones: false if it is not among them
+func (s *MemoryStore) UseRecoveryCode(userID, recoveryCodeHash string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.findUserByID(userID)
+	if user == nil {
+		return false
+	}
+	for i, hash := range user.RecoveryCodes {
+		if hash == recoveryCodeHash {
+			// a new slice: the copies of the user returned before keep sharing the old one
+			recoveryCodes := append([]string{}, user.RecoveryCodes[:i]...)
+			user.RecoveryCodes = append(recoveryCodes, user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) FindUserByEmail(email string) *User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, user := range s.usersTable {
 		if user.Email == email {
+			userCopy := *user
+			return &userCopy
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) FindUserByID(userID string) *User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, user := range s.usersTable {
+		if user.ID == userID {
+			userCopy := *user
+			return &userCopy
+		}
+	}
+	return nil
+}
+
+// findUserByID returns the stored record: the caller must hold the mutex
+func (s *MemoryStore) findUserByID(userID string) *User {
+	for _, user := range s.usersTable {
+		if user.ID == userID {
 			return user
 		}
 	}
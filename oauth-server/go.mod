@@ -6,7 +6,13 @@ require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/gyozatech/temaki v0.1.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/robfig/cron/v3 v3.0.1
 )
 
 require github.com/gyozatech/noodlog v0.0.0-20211006161024-c2cd168c8400 // indirect
+
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sys v0.13.0 // indirect
+)
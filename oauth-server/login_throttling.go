@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"provider/database"
+)
+
+// LoginThrottlingPolicy slows down the password guessing: every failed login doubles the time to wait before the next one
+// and after too many failures the account (or the IP address) is locked for a while
+type LoginThrottlingPolicy struct {
+	MaxFailuresPerAccount int
+	MaxFailuresPerIP      int // higher than the account one: many users can share an IP address
+	BaseBackoff           time.Duration
+	LockoutDuration       time.Duration
+}
+
+// DefaultLoginThrottlingPolicy locks an account after 5 failed logins and an IP address after 20, for 15 minutes
+func DefaultLoginThrottlingPolicy() LoginThrottlingPolicy {
+	return LoginThrottlingPolicy{
+		MaxFailuresPerAccount: 5,
+		MaxFailuresPerIP:      20,
+		BaseBackoff:           time.Second,
+		LockoutDuration:       15 * time.Minute,
+	}
+}
+
+// configureFromEnv overrides the thresholds and the lockout duration (in seconds) with
+// LOGIN_MAX_FAILURES_PER_ACCOUNT, LOGIN_MAX_FAILURES_PER_IP and LOGIN_LOCKOUT_DURATION
+func (p *LoginThrottlingPolicy) configureFromEnv() (err error) {
+	if p.MaxFailuresPerAccount, err = positiveIntFromEnv("LOGIN_MAX_FAILURES_PER_ACCOUNT", p.MaxFailuresPerAccount); err != nil {
+		return err
+	}
+	if p.MaxFailuresPerIP, err = positiveIntFromEnv("LOGIN_MAX_FAILURES_PER_IP", p.MaxFailuresPerIP); err != nil {
+		return err
+	}
+	lockoutDuration, err := positiveIntFromEnv("LOGIN_LOCKOUT_DURATION", int(p.LockoutDuration/time.Second))
+	if err != nil {
+		return err
+	}
+	p.LockoutDuration = time.Duration(lockoutDuration) * time.Second
+	return nil
+}
+
+// retryAfter tells how long to wait before the next login is allowed: 0 if it is allowed now
+func (p LoginThrottlingPolicy) retryAfter(loginAttempt *database.LoginAttempt, maxFailures int) time.Duration {
+	if loginAttempt == nil || loginAttempt.Failures == 0 {
+		return 0
+	}
+	wait := p.LockoutDuration
+	if loginAttempt.Failures < maxFailures {
+		// exponential backoff: 1s, 2s, 4s, ... never longer than the lockout
+		wait = p.BaseBackoff
+		for i := 1; i < loginAttempt.Failures && wait < p.LockoutDuration; i++ {
+			wait *= 2
+		}
+		if wait > p.LockoutDuration {
+			wait = p.LockoutDuration
+		}
+	}
+	return time.Until(loginAttempt.LastFailedAt.Add(wait))
+}
+
+// retryAfterKey tells how long the next login of the account or of the IP address of the key must wait
+func (p LoginThrottlingPolicy) retryAfterKey(key string, loginAttempt *database.LoginAttempt) time.Duration {
+	if strings.HasPrefix(key, ipLoginKey("")) {
+		return p.retryAfter(loginAttempt, p.MaxFailuresPerIP)
+	}
+	return p.retryAfter(loginAttempt, p.MaxFailuresPerAccount)
+}
+
+// reserveLoginAttempt counts the login of the account from the IP address as failed before the credentials are verified,
+// even if the account doesn't exist so that unknown emails behave like wrong passwords: the concurrent logins can't
+// outrun the throttling. It returns how long the login must wait instead, without counting it, if it isn't allowed now
+func (s *Server) reserveLoginAttempt(email, ip string) (time.Duration, error) {
+	return s.loginAttempts.ReserveLoginAttempt([]string{accountLoginKey(email), ipLoginKey(ip)}, s.loginThrottling.retryAfterKey)
+}
+
+// releaseLoginAttempt is called once the credentials are right: the failures of the account are forgotten and the IP
+// address gets back the attempt reserved, keeping its previous failures
+func (s *Server) releaseLoginAttempt(email, ip string) {
+	s.resetFailedLogins(email)
+	s.loginAttempts.ReleaseLoginAttempt(ipLoginKey(ip))
+}
+
+// resetFailedLogins forgets the failures of the account after a successful login: the IP address keeps its count
+func (s *Server) resetFailedLogins(email string) {
+	s.loginAttempts.DeleteLoginAttempt(accountLoginKey(email))
+}
+
+func accountLoginKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP is the address of the connection: the X-Forwarded-For header is not trusted since anyone can set it
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
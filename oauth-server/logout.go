@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+
+	"provider/database"
+	"provider/utils"
+)
+
+// endSessionHandler is the OpenID Connect RP-initiated logout: the app sends the browser here to log the user out of WalrusMail.
+// The id_token_hint tells which user and app are logging out; without it (or for another user) the user must confirm,
+// otherwise any page could log the user out with a link. The browser is sent back to the post_logout_redirect_uri,
+// if registered by the app, with the state. The apps the user has logged in to within the SSO session are notified
+// on their back-channel and front-channel logout URIs
+func (s *Server) endSessionHandler(w http.ResponseWriter, r *http.Request) {
+	idTokenHint := r.FormValue("id_token_hint")
+	clientID := r.FormValue("client_id")
+	postLogoutRedirectURI := r.FormValue("post_logout_redirect_uri")
+	state := r.FormValue("state")
+
+	var hintUserID string
+	if idTokenHint != "" {
+		claims, err := utils.VerifyIDTokenHint(idTokenHint)
+		if err != nil {
+			log.Println("Invalid id_token_hint:", err)
+			http.Error(w, "Invalid id_token_hint", http.StatusBadRequest)
+			return
+		}
+		audience, _ := claims["aud"].(string)
+		if clientID != "" && clientID != audience {
+			http.Error(w, "The client_id doesn't match the audience of the id_token_hint", http.StatusBadRequest)
+			return
+		}
+		clientID = audience
+		hintUserID, _ = claims["sub"].(string)
+	}
+
+	var app *database.RegisteredOauth2App
+	if clientID != "" {
+		if app = s.clients.FindRegisteredAppByClientID(clientID); app == nil {
+			http.Error(w, "Invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+	// the browser is sent only to the URIs registered by the app: the app must be known
+	if postLogoutRedirectURI != "" && (app == nil || !contains(app.PostLogoutRedirectURIs, postLogoutRedirectURI)) {
+		http.Error(w, "Invalid post_logout_redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	ssoSession := s.currentSSOSession(w, r)
+	confirmed := r.Method == http.MethodPost && r.FormValue("confirm") == "yes"
+	if ssoSession != nil && ssoSession.UserID != hintUserID && !confirmed {
+		s.writeLogoutPage(w, idTokenHint, clientID, postLogoutRedirectURI, state)
+		return
+	}
+
+	userID := hintUserID
+	if ssoSession != nil {
+		userID = ssoSession.UserID
+		s.sessions.DeleteSSOSession(ssoSession.ID)
+		s.notifyBackchannelLogout(ssoSession)
+		log.Printf("User %s logged out\n", userID)
+	}
+	clearSSOCookie(w)
+	if app != nil && app.RevokeTokensOnLogout && userID != "" {
+		s.tokens.RevokeRefreshTokensOfUser(userID, app.ID)
+	}
+
+	var continueURI string
+	if postLogoutRedirectURI != "" {
+		redirectURI, err := url.Parse(postLogoutRedirectURI)
+		if err != nil {
+			http.Error(w, "Invalid post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+		if state != "" {
+			query := redirectURI.Query()
+			query.Set("state", state)
+			redirectURI.RawQuery = query.Encode()
+		}
+		continueURI = redirectURI.String()
+	}
+	// the apps clearing their state in the browser get the chance to do it before the browser leaves
+	if ssoSession != nil {
+		if frontchannelLogoutURIs := s.frontchannelLogoutURIs(ssoSession); len(frontchannelLogoutURIs) > 0 {
+			writeFrontchannelLogoutPage(w, frontchannelLogoutURIs, continueURI)
+			return
+		}
+	}
+	if continueURI != "" {
+		http.Redirect(w, r, continueURI, http.StatusFound)
+		return
+	}
+	loggedOutPage, err := generatePage("logged_out", "")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, loggedOutPage)
+}
+
+// writeLogoutPage asks the user to confirm the logout, posting back the params of the request
+func (s *Server) writeLogoutPage(w http.ResponseWriter, idTokenHint, clientID, postLogoutRedirectURI, state string) {
+	logoutPage, err := generatePage("logout", "",
+		pageParam{Name: "state", Value: html.EscapeString(state)},
+		pageParam{Name: "id_token_hint", Value: html.EscapeString(idTokenHint)},
+		pageParam{Name: "client_id", Value: html.EscapeString(clientID)},
+		pageParam{Name: "post_logout_redirect_uri", Value: html.EscapeString(postLogoutRedirectURI)})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the logout page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, logoutPage)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
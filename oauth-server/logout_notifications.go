@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"provider/database"
+	"provider/utils"
+)
+
+// BackchannelLogoutPolicy sets how the apps are told on their back-channel logout URI that the user has logged out:
+// a notification that fails is retried, waiting twice as long each time, since the app may be briefly unavailable
+type BackchannelLogoutPolicy struct {
+	MaxAttempts  int
+	RetryBackoff time.Duration // the wait before the first retry
+	Client       *http.Client
+}
+
+// DefaultBackchannelLogoutPolicy tries 4 times in about 7 seconds, giving the app 5 seconds to respond each time
+func DefaultBackchannelLogoutPolicy() BackchannelLogoutPolicy {
+	return BackchannelLogoutPolicy{
+		MaxAttempts:  4,
+		RetryBackoff: time.Second,
+		Client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// notifyBackchannelLogout posts a logout token to the apps the user has logged in to within the ended SSO session.
+// The notifications are sent in the background: the logout doesn't wait for the apps
+func (s *Server) notifyBackchannelLogout(ssoSession *database.SSOSession) {
+	for _, appID := range ssoSession.AppIDs {
+		app := s.clients.FindRegisteredAppByID(appID)
+		if app == nil || app.BackchannelLogoutURI == "" {
+			continue
+		}
+		logoutToken, err := utils.IssueLogoutToken(ssoSession.UserID, app.ClientID, ssoSession.SID)
+		if err != nil {
+			log.Println("Unable to issue the logout token:", err)
+			continue
+		}
+		go s.backchannelLogout.send(app.BackchannelLogoutURI, logoutToken)
+	}
+}
+
+// send posts the logout token, retrying while the app can't be reached or fails with a server error:
+// any other response means that the app has processed or rejected the token, and it would do the same again
+func (p BackchannelLogoutPolicy) send(backchannelLogoutURI, logoutToken string) {
+	backoff := p.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := p.post(backchannelLogoutURI, logoutToken)
+		if err == nil {
+			log.Printf("Back-channel logout sent to %s\n", backchannelLogoutURI)
+			return
+		}
+		if !retry || attempt >= p.MaxAttempts {
+			log.Printf("Back-channel logout to %s failed after %d attempts: %v\n", backchannelLogoutURI, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (p BackchannelLogoutPolicy) post(backchannelLogoutURI, logoutToken string) (retry bool, err error) {
+	resp, err := p.Client.PostForm(backchannelLogoutURI, url.Values{"logout_token": {logoutToken}})
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode >= 500, fmt.Errorf("the app responded %s", resp.Status)
+}
+
+// frontchannelLogoutURIs returns the front-channel logout URIs of the apps the user has logged in to within the ended
+// SSO session, with the iss and sid params telling the apps which session has ended
+func (s *Server) frontchannelLogoutURIs(ssoSession *database.SSOSession) []string {
+	var uris []string
+	for _, appID := range ssoSession.AppIDs {
+		app := s.clients.FindRegisteredAppByID(appID)
+		if app == nil || app.FrontchannelLogoutURI == "" {
+			continue
+		}
+		uri, err := url.Parse(app.FrontchannelLogoutURI)
+		if err != nil {
+			log.Printf("Invalid front-channel logout URI of %s: %v\n", app.Name, err)
+			continue
+		}
+		query := uri.Query()
+		query.Set("iss", utils.Issuer)
+		query.Set("sid", ssoSession.SID)
+		uri.RawQuery = query.Encode()
+		uris = append(uris, uri.String())
+	}
+	return uris
+}
+
+// writeFrontchannelLogoutPage loads the front-channel logout URIs of the apps in hidden iframes, so that the apps can
+// clear their state in the browser, and then sends the browser to the continueURI (if empty the page says it's done)
+func writeFrontchannelLogoutPage(w http.ResponseWriter, frontchannelLogoutURIs []string, continueURI string) {
+	var iframes strings.Builder
+	for _, uri := range frontchannelLogoutURIs {
+		fmt.Fprintf(&iframes, "<iframe src=\"%s\" hidden></iframe>\n", html.EscapeString(uri))
+	}
+	frontchannelLogoutPage, err := generatePage("frontchannel_logout", "",
+		pageParam{Name: "iframes", Value: iframes.String()},
+		pageParam{Name: "continue_uri", Value: html.EscapeString(continueURI)})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, frontchannelLogoutPage)
+}
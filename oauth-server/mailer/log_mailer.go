@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// LogMailer writes the emails to the log instead of sending them: for local testing
+type LogMailer struct {
+	From string
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	email := Email{From: m.From, To: to, Subject: subject, Body: body}
+	log.Printf("Email not sent, printed instead:\n%s\n", email.message())
+	return nil
+}
+
+// FileMailer appends the emails to a file instead of sending them: for local testing
+type FileMailer struct {
+	Path string
+	From string
+
+	mutex sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	email := Email{From: m.From, To: to, Subject: subject, Body: body}
+	_, err = file.WriteString(email.message() + "\r\n\r\n")
+	return err
+}
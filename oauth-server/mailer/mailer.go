@@ -0,0 +1,34 @@
+package mailer
+
+import "strings"
+
+// Mailer sends the emails to the users, like the links to verify their address: any delivery can be plugged in
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Email is a plain text email
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// message formats the email as an RFC 5322 message: the new lines are removed from the headers
+// so that the values typed by the users can't add headers (or recipients) of their own
+func (e Email) message() string {
+	var message strings.Builder
+	message.WriteString("From: " + headerValue(e.From) + "\r\n")
+	message.WriteString("To: " + headerValue(e.To) + "\r\n")
+	message.WriteString("Subject: " + headerValue(e.Subject) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(e.Body, "\n", "\r\n"))
+	return message.String()
+}
+
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
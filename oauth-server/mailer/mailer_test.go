@@ -0,0 +1,28 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmailMessageHeaders(t *testing.T) {
+	email := Email{
+		From:    "no-reply@walrusmail.local",
+		To:      "john.doe@email.com\r\nBcc: attacker@email.com",
+		Subject: "Hi\nBcc: attacker@email.com",
+		Body:    "first line\nsecond line",
+	}
+	message := email.message()
+	headers, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found {
+		t.Fatalf("no blank line between headers and body: %q", message)
+	}
+	for _, header := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(header, "Bcc:") {
+			t.Errorf("header injected: %q", header)
+		}
+	}
+	if body != "first line\r\nsecond line" {
+		t.Errorf("got body %q", body)
+	}
+}
@@ -0,0 +1,26 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+)
+
+// SMTPMailer sends the emails through an SMTP server: the credentials are optional, since a local relay may not need them
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		// PLAIN authentication is refused by net/smtp unless the connection is encrypted with STARTTLS, or to localhost
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	email := Email{From: m.From, To: to, Subject: subject, Body: body}
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{headerValue(to)}, []byte(email.message()))
+}
@@ -4,11 +4,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
-	
+	"time"
+
 	"provider/database"
 	"provider/utils"
 
@@ -19,6 +24,57 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	// the keys used to sign the jwt: the PEM key of the deployment if provided, never rotated, otherwise the generated
+	// keys, saved in the key ring file if any so that the tokens issued before a restart can still be verified
+	var err error
+	switch {
+	case os.Getenv("JWT_SIGNING_KEY_FILE") != "":
+		err = utils.InitKeyRing(os.Getenv("JWT_SIGNING_ALG"), os.Getenv("JWT_SIGNING_KEY_FILE"))
+	case os.Getenv("JWT_KEY_RING_FILE") != "":
+		err = utils.LoadKeyRing(os.Getenv("JWT_SIGNING_ALG"), os.Getenv("JWT_KEY_RING_FILE"))
+	default:
+		log.Println("The signing keys are kept in memory: the tokens issued before a restart won't verify anymore, set JWT_KEY_RING_FILE to keep them")
+		err = utils.InitKeyRing(os.Getenv("JWT_SIGNING_ALG"), "")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := utils.StartKeyRotation(os.Getenv("JWT_KEY_ROTATION_SCHEDULE")); err != nil {
+		log.Fatal(err)
+	}
+	// the algorithm of the password hashes: the passwords hashed otherwise are upgraded on login
+	if err := utils.SetPasswordHashAlgorithm(os.Getenv("PASSWORD_HASH_ALG")); err != nil {
+		log.Fatal(err)
+	}
+
+	// the tables: in memory by default, any other implementation of the store interfaces can be plugged in
+	store, err := newStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	database.StartCleanupJobs(store, store, store, store)
+	server := NewServer(store, store, store, store, store, store, store)
+	// the emails to the users: printed to the log by default
+	if server.mailer, err = newMailer(); err != nil {
+		log.Fatal(err)
+	}
+	codeExpiresIn, err := positiveIntFromEnv("AUTHORIZATION_CODE_EXPIRES_IN", database.AuthorizationCodeExpiresIn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.authorizationCodeExpiresIn = time.Duration(codeExpiresIn) * time.Second
+	if err := server.loginThrottling.configureFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.ssoSessions.configureFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
 	router := temaki.NewRouter()
 
 	//middlewares.SetPrintLogger(log.New(os.Stdout, "", log.LstdFlags))
@@ -28,69 +84,274 @@ func main() {
 	router.UseMiddleware(middlewares.CORSMiddleware)
 	router.UseMiddleware(middlewares.RecoverPanicMiddleware)
 
-	// authorization server
-	router.GET("/oauth/v2/authorize", authorizeHandler)
-	router.GET("/oauth/v2/login", loginHandler)      // intermediate endpoint 1
-	router.POST("/oauth/v2/submit", submitHandler)   // intermediate endpoint 2
-	router.POST("/oauth/v2/consent", consentHandler) // intermediate endpoint 3
-	router.POST("/oauth/v2/token", tokenHandler)
-	// resource server
-	router.GET("/resources/v2/userinfo", userInfoHandler)
+	server.registerRoutes(router)
 
 	log.Fatal(router.Start(8080))
 
 }
 
+// registerRoutes registers the endpoints of the server on the router
+func (s *Server) registerRoutes(router *temaki.Router) {
+	// authorization server
+	router.GET(authorizePath, s.authorizeHandler)
+	router.GET(loginPath, loginHandler)                // intermediate endpoint 1
+	router.POST("/oauth/v2/submit", s.submitHandler)   // intermediate endpoint 2
+	router.POST("/oauth/v2/totp", s.totpHandler)       // intermediate endpoint 2b: only for the users enrolled to the second factor
+	router.POST("/oauth/v2/consent", s.consentHandler) // intermediate endpoint 3
+	router.POST(tokenPath, s.tokenHandler)
+	// sign up from the login page: the email must be verified with the link sent by email before logging in
+	router.GET(signupPath, signupPageHandler)
+	router.POST(signupPath, s.signupHandler)
+	router.GET(verifyEmailPath, s.verifyEmailHandler)
+	// password reset from the login page, with the link sent by email
+	router.GET(forgotPasswordPath, forgotPasswordPageHandler)
+	router.POST(forgotPasswordPath, s.forgotPasswordHandler)
+	router.GET(resetPasswordPath, s.resetPasswordPageHandler)
+	router.POST(resetPasswordPath, s.resetPasswordHandler)
+	router.POST(introspectPath, s.introspectHandler)
+	router.POST(revokePath, s.revokeHandler)
+	// OpenID Connect RP-initiated logout
+	router.GET(endSessionPath, s.endSessionHandler)
+	router.POST(endSessionPath, s.endSessionHandler)
+	// device authorization grant (RFC 8628)
+	router.POST(deviceAuthorizationPath, s.deviceAuthorizationHandler)
+	router.GET(devicePath, deviceHandler)                // verification page
+	router.POST(devicePath, s.deviceVerificationHandler) // starts the login of the user approving the device
+	// public keys to verify the issued jwt
+	router.GET(jwksPath, jwksHandler)
+	// discovery documents generated from the routes above
+	router.GET("/.well-known/openid-configuration", serverMetadataHandler)
+	router.GET("/.well-known/oauth-authorization-server", serverMetadataHandler)
+	// resource server
+	router.GET(userInfoPath, s.userInfoHandler)
+	// second factor enrollment of the user of the access token
+	router.POST("/account/v2/totp", s.totpEnrollmentHandler)
+	router.POST("/account/v2/totp/confirm", s.totpConfirmationHandler)
+	// administration
+	router.POST("/admin/v2/unlock", s.unlockHandler)
+}
+
+// routes published in the discovery documents
+const (
+	authorizePath           = "/oauth/v2/authorize"
+	loginPath               = "/oauth/v2/login"
+	signupPath              = "/oauth/v2/signup"
+	verifyEmailPath         = "/oauth/v2/verify_email"
+	forgotPasswordPath      = "/oauth/v2/forgot_password"
+	resetPasswordPath       = "/oauth/v2/reset_password"
+	tokenPath               = "/oauth/v2/token"
+	introspectPath          = "/oauth/v2/introspect"
+	revokePath              = "/oauth/v2/revoke"
+	endSessionPath          = "/oauth/v2/end_session"
+	deviceAuthorizationPath = "/oauth/v2/device_authorization"
+	devicePath              = "/oauth/v2/device"
+	jwksPath                = "/.well-known/jwks.json"
+	userInfoPath            = "/resources/v2/userinfo"
+)
+
+// authentication methods recorded in the amr claim (RFC 8176)
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+)
+
+// adminRole is the roles claim of the users who can run the administration endpoints
+const adminRole = "*"
+
+const (
+	deviceCodeGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceVerificationURI = utils.Issuer + devicePath
+)
+
+// capabilities published in the discovery documents
+var (
+	supportedGrantTypes           = []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType}
+	supportedResponseTypes        = []string{"code"}
+	supportedScopes               = registeredScopeNames()
+	supportedClaims               = []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "amr", "sid", "name", "email"}
+	supportedClientAuthMethods    = []string{"client_secret_basic", "client_secret_post"}
+	supportedCodeChallengeMethods = []string{utils.CodeChallengeMethodS256, utils.CodeChallengeMethodPlain}
+)
+
 // AccessTokenResponse is the response provided in the second step of the Oauth2 protocol
 type AccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// DeviceAuthorizationResponse is the response of the device authorization endpoint (RFC 8628)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Oauth2ErrorResponse is the JSON error response of the token endpoint (RFC 6749 section 5.2)
+type Oauth2ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IntrospectionResponse is the response of the token introspection endpoint (RFC 7662): only active is set for inactive tokens
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
 }
 
-// UserInfo contains the info about the user
+// ServerMetadata is the OpenID Connect discovery document, that is a superset of the
+// Oauth2 authorization server metadata (RFC 8414)
+type ServerMetadata struct {
+	Issuer                                    string   `json:"issuer"`
+	AuthorizationEndpoint                     string   `json:"authorization_endpoint"`
+	TokenEndpoint                             string   `json:"token_endpoint"`
+	UserInfoEndpoint                          string   `json:"userinfo_endpoint"`
+	JwksURI                                   string   `json:"jwks_uri"`
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint"`
+	RevocationEndpoint                        string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint               string   `json:"device_authorization_endpoint"`
+	EndSessionEndpoint                        string   `json:"end_session_endpoint"`
+	ScopesSupported                           []string `json:"scopes_supported"`
+	ResponseTypesSupported                    []string `json:"response_types_supported"`
+	GrantTypesSupported                       []string `json:"grant_types_supported"`
+	SubjectTypesSupported                     []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported          []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported         []string `json:"token_endpoint_auth_methods_supported"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	RevocationEndpointAuthMethodsSupported    []string `json:"revocation_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported             []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                           []string `json:"claims_supported"`
+	BackchannelLogoutSupported                bool     `json:"backchannel_logout_supported"`
+	BackchannelLogoutSessionSupported         bool     `json:"backchannel_logout_session_supported"`
+	FrontchannelLogoutSupported               bool     `json:"frontchannel_logout_supported"`
+	FrontchannelLogoutSessionSupported        bool     `json:"frontchannel_logout_session_supported"`
+}
+
+// UserInfo contains the info about the user returned by the userinfo endpoint, with the OpenID Connect claim names:
+// name and email are set only if the profile and email scopes have been granted to the access token
 type UserInfo struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Roles string `json:"roles"`
+	Sub           string `json:"sub"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Roles         string `json:"roles"`
 }
 
 // HANDLERS
 
-func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) authorizeHandler(w http.ResponseWriter, r *http.Request) {
 	// parse the query param
 	clientID := r.URL.Query().Get("client_id")
 	redirectURI := r.URL.Query().Get("redirect_uri")
 	responseType := r.URL.Query().Get("response_type")
 	scope := r.URL.Query().Get("scope")
-	state := r.URL.Query().Get("state") // optional from Client-side: if not present we generate it because shared as a sort of ID across all the flow
-	if state == "" {
-		state = uuid.New().String()
+	state := r.URL.Query().Get("state") // optional from Client-side: echoed in the redirect to the app
+	// PKCE (RFC 7636): optional unless the registered app requires it
+	codeChallenge := r.URL.Query().Get("code_challenge")
+	codeChallengeMethod := r.URL.Query().Get("code_challenge_method")
+	// OpenID Connect: optional, echoed in the id_token to mitigate replay attacks
+	nonce := r.URL.Query().Get("nonce")
+	// OpenID Connect: prompt=login asks to log in again even if the browser has an SSO session
+	forceLogin := hasPrompt(r.URL.Query().Get("prompt"), "login")
+
+	// Validate the client ID and redirect URI checking among the registered apps: until then the errors are shown
+	// to the user, since the redirect_uri may belong to an attacker
+	app := s.clients.FindRegisteredAppByClientID(clientID)
+	if app == nil || app.RedirectURI != redirectURI {
+		http.Error(w, "Invalid client ID or redirect URI", http.StatusBadRequest)
+		return
 	}
+	// from now on the errors are sent back to the app (RFC 6749 section 4.1.2.1)
 
 	if responseType != "code" {
-		http.Error(w, "Only Auth flow available is the Authorization Code flow, so query param response_type must be set to 'code'", http.StatusBadRequest)
+		redirectWithError(w, r, redirectURI, "unsupported_response_type", "only the Authorization Code flow is available: response_type must be 'code'", state)
 		return
 	}
-
-	// Validate the client ID and redirect URI checking among the registered apps
-	app := database.FindRegisteredAppByClientID(clientID)
-	if app == nil || app.RedirectURI != redirectURI {
-		http.Error(w, "Invalid client ID or redirect URI", http.StatusBadRequest)
+	if unknownScope := unsupportedScope(scope); unknownScope != "" {
+		redirectWithError(w, r, redirectURI, "invalid_scope", "unknown scope "+unknownScope, state)
+		return
+	}
+	if reservedScope := firstPartyScope(scope, app); reservedScope != "" {
+		redirectWithError(w, r, redirectURI, "invalid_scope", "the scope "+reservedScope+" is reserved to the first-party applications", state)
 		return
 	}
 
-	if err := database.SaveNewOauth2Session(clientID, scope, state); err != nil {
+	if codeChallenge == "" {
+		if app.RequirePKCE {
+			redirectWithError(w, r, redirectURI, "invalid_request", "the application requires PKCE: code_challenge must be set", state)
+			return
+		}
+		if codeChallengeMethod != "" {
+			redirectWithError(w, r, redirectURI, "invalid_request", "code_challenge_method cannot be set without code_challenge", state)
+			return
+		}
+	} else {
+		if codeChallengeMethod == "" {
+			// RFC 7636 section 4.3: defaults to plain if not present in the request
+			codeChallengeMethod = utils.CodeChallengeMethodPlain
+		}
+		if !utils.IsValidCodeChallengeMethod(codeChallengeMethod) {
+			redirectWithError(w, r, redirectURI, "invalid_request", "code_challenge_method must be 'S256' or 'plain'", state)
+			return
+		}
+		if !utils.IsValidPKCEValue(codeChallenge) {
+			redirectWithError(w, r, redirectURI, "invalid_request", "code_challenge must be 43 to 128 characters long and contain only unreserved characters", state)
+			return
+		}
+	}
+
+	oauthSession, err := s.sessions.SaveNewOauth2Session(clientID, redirectURI, scope, state, codeChallenge, codeChallengeMethod, nonce)
+	if err != nil {
 		log.Println(err)
-		http.Error(w, "Error while creating a new login session", http.StatusInternalServerError)
+		redirectWithError(w, r, redirectURI, "server_error", "unable to start the login", state)
+		return
+	}
+	if !forceLogin && s.resumeSSOSession(w, r, oauthSession.ID) {
 		return
 	}
-	http.Redirect(w, r, "http://localhost:8080/oauth/v2/login?state="+state, http.StatusFound)
+	http.Redirect(w, r, utils.Issuer+loginPath+"?session_id="+oauthSession.ID, http.StatusFound)
+}
+
+// unsupportedScope returns the first of the space separated scopes that is not supported, if any
+func unsupportedScope(scope string) string {
+	for _, requested := range strings.Fields(scope) {
+		supported := false
+		for _, supportedScope := range supportedScopes {
+			if requested == supportedScope {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return requested
+		}
+	}
+	return ""
+}
+
+// hasPrompt tells if the space separated prompt param contains the value
+func hasPrompt(prompt, value string) bool {
+	for _, p := range strings.Fields(prompt) {
+		if p == value {
+			return true
+		}
+	}
+	return false
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	state := r.URL.Query().Get("state")
-	loginPage, err := generateLoginPage(state)
+	loginPage, err := generateLoginPage(r.URL.Query().Get("session_id"))
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Error while creating a new login session", http.StatusInternalServerError)
@@ -100,120 +361,999 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, loginPage)
 }
 
-func submitHandler(w http.ResponseWriter, r *http.Request) {
-	state := r.FormValue("state")
+func (s *Server) submitHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.FormValue("session_id")
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 
-	user := database.FindUserByEmailAndPassword(email, password)
+	// the same responses whether the email exists or not: the attacker can't tell unknown emails from wrong passwords
+	ip := clientIP(r)
+	retryAfter, err := s.reserveLoginAttempt(email, ip)
+	if err != nil {
+		log.Println("Unable to reserve the login attempt:", err)
+		http.Error(w, "Error while checking the failed login attempts", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		log.Printf("Login of %s from %s throttled for %v\n", email, ip, retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+		http.Error(w, "Too many failed login attempts: retry later", http.StatusTooManyRequests)
+		return
+	}
+
+	user := s.authenticateUser(email, password)
 	if user == nil {
 		log.Println("User not found in the System: " + email)
 		http.Error(w, "Wrong credentials", http.StatusUnauthorized)
 		return
 	}
+	s.releaseLoginAttempt(email, ip)
+
+	// the password is right: telling that the email is not verified doesn't help an attacker
+	if !user.EmailVerified {
+		log.Println("Login of a user with the email not verified: " + email)
+		http.Error(w, "Verify your email address with the link we have sent you before logging in", http.StatusForbidden)
+		return
+	}
 
-	oauthSession, err := database.UpdateOauth2SessionWithEmail(state, email)
+	oauthSession, err := s.sessions.UpdateOauth2SessionWithEmail(sessionID, email, []string{amrPassword}, time.Now())
 	if err != nil || oauthSession == nil {
 		log.Println("Unable to update specified session")
 		http.Error(w, "Session unknown", http.StatusUnauthorized)
 		return
 	}
 
-	app := database.FindRegisteredAppByID(oauthSession.AppID)
+	// the users enrolled to the second factor must type the TOTP code before the consent
+	if user.TOTPConfirmed {
+		totpPage, err := generateTOTPPage(sessionID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error while creating the TOTP page", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, totpPage)
+		return
+	}
+
+	s.startSSOSession(w, user, oauthSession)
+	s.askConsent(w, r, user, oauthSession)
+}
+
+// totpHandler verifies the TOTP code (or a recovery code) of the user who has submitted the password
+func (s *Server) totpHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.FormValue("session_id")
+	code := strings.TrimSpace(r.FormValue("code"))
+
+	oauthSession := s.sessions.FindOauth2SessionByID(sessionID)
+	if oauthSession == nil || oauthSession.Email == nil || !hasAMR(oauthSession.AMR, amrPassword) {
+		http.Error(w, "Session unknown", http.StatusUnauthorized)
+		return
+	}
+	email := *oauthSession.Email
+
+	// wrong codes are throttled like wrong passwords
+	ip := clientIP(r)
+	retryAfter, err := s.reserveLoginAttempt(email, ip)
+	if err != nil {
+		log.Println("Unable to reserve the login attempt:", err)
+		http.Error(w, "Error while checking the failed login attempts", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		log.Printf("TOTP of %s from %s throttled for %v\n", email, ip, retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+		http.Error(w, "Too many failed login attempts: retry later", http.StatusTooManyRequests)
+		return
+	}
+
+	user := s.users.FindUserByEmail(email)
+	if user == nil || !user.TOTPConfirmed || !s.verifySecondFactor(user, code) {
+		http.Error(w, "Wrong code", http.StatusUnauthorized)
+		return
+	}
+	s.releaseLoginAttempt(email, ip)
+
+	oauthSession, err = s.sessions.UpdateOauth2SessionWithEmail(sessionID, email, []string{amrPassword, amrOTP}, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Session unknown", http.StatusUnauthorized)
+		return
+	}
+	s.startSSOSession(w, user, oauthSession)
+	s.askConsent(w, r, user, oauthSession)
+}
+
+// verifySecondFactor accepts the current TOTP code, once, or one of the unused recovery codes
+func (s *Server) verifySecondFactor(user *database.User, code string) bool {
+	if step, valid := utils.VerifyTOTP(user.TOTPSecret, code, time.Now()); valid {
+		return s.users.UseTOTPStep(user.ID, step)
+	}
+	if s.users.UseRecoveryCode(user.ID, utils.HashRecoveryCode(code)) {
+		log.Printf("Recovery code used by %s\n", user.Email)
+		return true
+	}
+	return false
+}
+
+// isAuthenticated tells if the user of the session has completed the login, second factor included
+func (s *Server) isAuthenticated(oauthSession *database.Oauth2Session) bool {
+	if oauthSession.Email == nil {
+		return false
+	}
+	user := s.users.FindUserByEmail(*oauthSession.Email)
+	return user != nil && isLoginComplete(user, oauthSession.AMR)
+}
+
+// isLoginComplete tells if the methods the user has authenticated with are enough to log in
+func isLoginComplete(user *database.User, amr []string) bool {
+	return user.EmailVerified && (!user.TOTPConfirmed || hasAMR(amr, amrOTP))
+}
+
+func hasAMR(amr []string, method string) bool {
+	for _, m := range amr {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// askConsent asks the authenticated user to consent to the app of the session, unless the user has already granted
+// all the requested scopes and asked to remember them. The devices are always approved on the consent page: the user must see which app is asking
+func (s *Server) askConsent(w http.ResponseWriter, r *http.Request, user *database.User, oauthSession *database.Oauth2Session) {
+	consent := s.consents.FindConsent(user.ID, oauthSession.AppID)
+	if consent != nil && consent.Covers(oauthSession.Scope) && oauthSession.DeviceCode == "" {
+		log.Printf("Consent of %s to app %s already granted for %q\n", user.Email, oauthSession.AppID, oauthSession.Scope)
+		s.issueAuthorizationCode(w, r, oauthSession)
+		return
+	}
+	// only the newly requested scopes are shown
+	s.writeConsentPage(w, r, oauthSession, scopesToAsk(consent, oauthSession.Scope))
+}
+
+// writeConsentPage asks the authenticated user to consent to the app of the session for the given scopes
+func (s *Server) writeConsentPage(w http.ResponseWriter, r *http.Request, oauthSession *database.Oauth2Session, scopes []string) {
+	app := s.clients.FindRegisteredAppByID(oauthSession.AppID)
 	if app == nil {
 		log.Println("App not found in the System")
-		http.Error(w, "App unknown", http.StatusInternalServerError)
+		authorizationError(w, r, oauthSession, "server_error", "unknown app")
 		return
 	}
 
-	consentPage, err := generateConsentPage(state, app.Name)
+	consentPage, err := generateConsentPage(oauthSession.ID, app.Name, scopes)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "Error while creating the consent page", http.StatusInternalServerError)
+		authorizationError(w, r, oauthSession, "server_error", "unable to create the consent page")
 		return
 	}
 	fmt.Fprint(w, consentPage)
 }
 
-func consentHandler(w http.ResponseWriter, r *http.Request) {
-	state := r.FormValue("state")
+// authenticateUser verifies the password of the user, upgrading the hash if it uses a legacy algorithm or outdated parameters
+func (s *Server) authenticateUser(email, password string) *database.User {
+	user := s.users.FindUserByEmail(email)
+	if user == nil {
+		// unknown emails take as long as wrong passwords
+		utils.VerifyDummyPassword(password)
+		return nil
+	}
+	valid, needsRehash := utils.VerifyPassword(password, user.Password)
+	if !valid {
+		return nil
+	}
+	if needsRehash {
+		passwordHash, err := utils.HashPassword(password)
+		if err == nil {
+			err = s.users.UpdateUserPassword(user.ID, passwordHash)
+		}
+		if err != nil {
+			// the user can log in anyway: the hash will be upgraded next time
+			log.Println("Unable to upgrade the password hash:", err)
+		}
+	}
+	return user
+}
+
+// consentHandler records the decision of the user: if denied the app gets access_denied, otherwise the session keeps
+// only the scopes granted, the consent is saved, remembered if the user asks to skip the page next time, and the
+// authorization code is issued
+func (s *Server) consentHandler(w http.ResponseWriter, r *http.Request) {
+	oauthSession := s.sessions.FindOauth2SessionByID(r.FormValue("session_id"))
+	if oauthSession == nil || !s.isAuthenticated(oauthSession) {
+		http.Error(w, "The user has not completed the login", http.StatusUnauthorized)
+		return
+	}
+	if r.FormValue("action") == "deny" {
+		s.denyAuthorization(w, r, oauthSession)
+		return
+	}
+	user := s.users.FindUserByEmail(*oauthSession.Email)
+	if user == nil {
+		http.Error(w, "User not found in the System", http.StatusInternalServerError)
+		return
+	}
+	asked := scopesToAsk(s.consents.FindConsent(user.ID, oauthSession.AppID), oauthSession.Scope)
+	if granted := grantedScope(oauthSession.Scope, asked, r.Form["scope"]); granted != oauthSession.Scope {
+		if err := s.sessions.UpdateOauth2SessionScope(oauthSession.ID, granted); err != nil {
+			log.Println(err)
+			authorizationError(w, r, oauthSession, "server_error", "unable to record the granted scopes")
+			return
+		}
+		log.Printf("%s granted only %q of %q to app %s\n", user.Email, granted, oauthSession.Scope, oauthSession.AppID)
+		oauthSession.Scope = granted
+	}
+	remember := r.FormValue("remember") == "yes"
+	if _, err := s.consents.SaveConsent(user.ID, oauthSession.AppID, oauthSession.Scope, remember); err != nil {
+		// the authorization goes on anyway: the user will be asked again next time
+		log.Println("Unable to save the consent:", err)
+	} else {
+		log.Printf("Consent of %s to app %s granted for %q (remembered: %v)\n", user.Email, oauthSession.AppID, oauthSession.Scope, remember)
+	}
+	s.issueAuthorizationCode(w, r, oauthSession)
+}
+
+// denyAuthorization sends the browser back to the app with access_denied, or denies the device of the session
+func (s *Server) denyAuthorization(w http.ResponseWriter, r *http.Request, oauthSession *database.Oauth2Session) {
+	log.Printf("Authorization of app %s denied by %s\n", oauthSession.AppID, *oauthSession.Email)
+	if oauthSession.DeviceCode == "" {
+		authorizationError(w, r, oauthSession, "access_denied", "the user has denied the request")
+		return
+	}
+	if err := s.sessions.DenyDeviceAuthorization(oauthSession.DeviceCode); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceDeniedPage, err := generatePage("device_denied", "")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the device denied page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, deviceDeniedPage)
+}
+
+// issueAuthorizationCode completes the authorization of the authenticated user: the browser is redirected to the app
+// with a new code, or the device of the session is approved
+func (s *Server) issueAuthorizationCode(w http.ResponseWriter, r *http.Request, oauthSession *database.Oauth2Session) {
 	// generate the temporary authorization code that will be exchanged with the access_token
 	code := uuid.New().String()
-	oauthSession, err := database.UpdateOauth2SessionWithAuthCode(r.FormValue("state"), code)
+	oauthSession, err := s.sessions.UpdateOauth2SessionWithAuthCode(oauthSession.ID, code)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	app := database.FindRegisteredAppByID(oauthSession.AppID)
+	app := s.clients.FindRegisteredAppByID(oauthSession.AppID)
 	if app == nil {
 		log.Printf("App %s not found in the System\n", oauthSession.AppID)
-		http.Error(w, "App not found in the System", http.StatusInternalServerError)
+		authorizationError(w, r, oauthSession, "server_error", "unknown app")
 		return
 	}
+	// the app will be notified when the user logs out of the SSO session
+	if oauthSession.SSOSessionID != "" {
+		if err := s.sessions.AddAppToSSOSession(oauthSession.SSOSessionID, app.ID); err != nil {
+			log.Println(err)
+		}
+	}
 
-	http.Redirect(w, r, fmt.Sprintf("%s?code=%s&state=%s", app.RedirectURI, code, state), http.StatusFound)
+	// device authorization grant: there's no redirect_uri, the device is polling the token endpoint
+	if oauthSession.DeviceCode != "" {
+		_, err := s.sessions.ApproveDeviceAuthorization(oauthSession.DeviceCode, *oauthSession.Email, oauthSession.Scope, oauthSession.AMR, oauthSession.AuthTime)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		deviceApprovedPage, err := generateDeviceApprovedPage(app.Name)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error while creating the device approved page", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, deviceApprovedPage)
+		return
+	}
+
+	redirectURI, err := url.Parse(app.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+	query := redirectURI.Query()
+	query.Set("code", code)
+	if oauthSession.State != "" {
+		query.Set("state", oauthSession.State)
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
 }
 
-func tokenHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	grantType := r.FormValue("grant_type")
+	clientID, clientSecret := getClientIDAndSecret(r)
+
+	if clientID == "" || clientSecret == "" || grantType == "" {
+		http.Error(w, "missing one or more of the following params from the 'POST /token' request: client_id, client_secret, grant_type", http.StatusBadRequest)
+		return
+	}
+
+	app := s.clients.FindRegisteredAppByClientID(clientID)
+	if app == nil || app.ClientSecret != clientSecret {
+		http.Error(w, "Invalid client ID or client secret", http.StatusUnauthorized)
+		return
+	}
+
+	switch grantType {
+	case "authorization_code":
+		s.authorizationCodeGrant(w, r, app)
+	case "refresh_token":
+		s.refreshTokenGrant(w, r, app)
+	case "client_credentials":
+		s.clientCredentialsGrant(w, r, app)
+	case deviceCodeGrantType:
+		s.deviceCodeGrant(w, r, app)
+	default:
+		http.Error(w, "Unsupported grant_type: must be one of "+strings.Join(supportedGrantTypes, ", "), http.StatusBadRequest)
+	}
+}
+
+// authorizationCodeGrant exchanges the authorization code with the access_token and a new refresh_token
+func (s *Server) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, app *database.RegisteredOauth2App) {
 	code := r.FormValue("code")
 	redirectURI := r.FormValue("redirect_uri")
-	clientID := r.FormValue("client_id")
-	clientSecret := r.FormValue("client_secret")
-	
-	// client_id and client_secret can be sent either as Basic Authorization header or as form url-encoded values
-	// SO IF THEY'RE NOT FOUND IN THE POSTED FORM, WE TRY TO FETCH THEM IN THE AUTHORIZATION HEADER
-	if clientID == "" && clientSecret == "" {
-		clientID, clientSecret = getClientIDAndSecretFromHeader(r.Header.Get("Authorization"))
-	}
+	codeVerifier := r.FormValue("code_verifier")
 
-	if code == "" || redirectURI == "" || clientID == "" || clientSecret == "" || grantType == "" {
-		http.Error(w, "missing one or more of the following params from the 'POST /token' request: code, redirect_uri, client_id, client_secret, grant_type", http.StatusBadRequest)
+	if code == "" || redirectURI == "" {
+		http.Error(w, "missing one or more of the following params from the 'POST /token' request: code, redirect_uri", http.StatusBadRequest)
 		return
 	}
 
-	if grantType != "authorization_code" {
-		http.Error(w, "Only Auth flow available is the Authorization Code flow, so query param grant_type must be set to 'authorization_code'", http.StatusBadRequest)
+	// the code is bound to the client and to the redirect_uri it has been issued for: checked with PKCE before the code is
+	// redeemed, so that whoever stole the code without the code_verifier can neither burn it nor revoke the tokens issued from it
+	oauthSession := s.sessions.FindOauth2SessionByCode(code)
+	if oauthSession == nil || oauthSession.AppID != app.ID || oauthSession.RedirectURI != redirectURI {
+		http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: failed to exchange authorization code with access token", http.StatusUnauthorized)
 		return
 	}
+	// PKCE (RFC 7636): if a code_challenge was sent to the authorize endpoint the matching code_verifier is mandatory
+	if oauthSession.CodeChallenge != "" {
+		if codeVerifier == "" {
+			http.Error(w, "missing the code_verifier param from the 'POST /token' request", http.StatusBadRequest)
+			return
+		}
+		if !utils.VerifyCodeChallenge(codeVerifier, oauthSession.CodeChallenge, oauthSession.CodeChallengeMethod) {
+			http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: code_verifier doesn't match the code_challenge", http.StatusUnauthorized)
+			return
+		}
+	}
 
-	oauthSession := database.FindOauth2SessionByParams(clientID, clientSecret, redirectURI, code)
+	// the code can be redeemed only once: a second attempt means it has been stolen (RFC 6749 section 4.1.2),
+	// so the tokens already issued from it are revoked
+	familyID := uuid.New().String()
+	oauthSession, alreadyRedeemed := s.sessions.RedeemAuthorizationCode(code, familyID)
 	if oauthSession == nil {
 		http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: failed to exchange authorization code with access token", http.StatusUnauthorized)
 		return
 	}
+	if alreadyRedeemed {
+		log.Printf("Authorization code reuse detected for app %s: revoking token family %s\n", app.ID, oauthSession.FamilyID)
+		if oauthSession.FamilyID != "" {
+			s.tokens.RevokeRefreshTokenFamily(oauthSession.FamilyID)
+		}
+		http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: the authorization code has already been used", http.StatusUnauthorized)
+		return
+	}
+	// checked once redeemed, so that a stolen code replayed after its expiry still revokes the tokens issued from it
+	if oauthSession.IsCodeExpired(s.authorizationCodeExpiresIn) {
+		http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: the authorization code has expired", http.StatusUnauthorized)
+		return
+	}
 
 	if oauthSession.Email == nil {
 		http.Error(w, "Oauth2 Authorization Code Flow Step 2 failed: failed to find the email associated with the authorization session", http.StatusUnauthorized)
 		return
 	}
-	user := database.FindUserByEmail(*oauthSession.Email)
+	user := s.users.FindUserByEmail(*oauthSession.Email)
+	if user == nil {
+		http.Error(w, "User not found in the System", http.StatusInternalServerError)
+		return
+	}
+
+	// a new refresh token family starts with every authorization code
+	s.writeAccessTokenResponse(w, user, app, oauthSession.Scope, familyID, &authentication{
+		AMR:      oauthSession.AMR,
+		AuthTime: oauthSession.AuthTime,
+		Nonce:    oauthSession.Nonce,
+		SID:      s.sessionID(oauthSession),
+	})
+}
+
+// refreshTokenGrant rotates the refresh_token issuing a new access_token and a new refresh_token of the same family.
+// If an already rotated refresh_token is presented again it has been leaked, so the whole family is revoked
+func (s *Server) refreshTokenGrant(w http.ResponseWriter, r *http.Request, app *database.RegisteredOauth2App) {
+	token := r.FormValue("refresh_token")
+	if token == "" {
+		http.Error(w, "missing the refresh_token param from the 'POST /token' request", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken := s.tokens.FindRefreshToken(token)
+	if refreshToken == nil || refreshToken.AppID != app.ID {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// marked as used and checked in one step: of two concurrent refreshes with the same token only one rotates it,
+	// the other is a reuse like any token presented again after its rotation
+	alreadyUsed, err := s.tokens.MarkRefreshTokenAsUsed(refreshToken.Token)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while rotating the refresh token", http.StatusInternalServerError)
+		return
+	}
+	if alreadyUsed {
+		log.Printf("Refresh token reuse detected for app %s: revoking token family %s\n", app.ID, refreshToken.FamilyID)
+		s.tokens.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if refreshToken.Revoked || refreshToken.IsExpired() {
+		http.Error(w, "Refresh token expired or revoked", http.StatusUnauthorized)
+		return
+	}
+
+	user := s.users.FindUserByID(refreshToken.UserID)
+	if user == nil {
+		http.Error(w, "User not found in the System", http.StatusInternalServerError)
+		return
+	}
+
+	// the refreshed tokens tell how the user logged in to grant the family, unless it has been granted before it was recorded
+	var login *authentication
+	if !refreshToken.AuthTime.IsZero() {
+		login = &authentication{AMR: refreshToken.AMR, AuthTime: refreshToken.AuthTime}
+	}
+	s.writeAccessTokenResponse(w, user, app, refreshToken.Scope, refreshToken.FamilyID, login)
+}
+
+// clientCredentialsGrant issues an access_token to the app itself, for machine-to-machine calls with no user involved.
+// No refresh_token is issued since the app can always authenticate again with its own credentials
+func (s *Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, app *database.RegisteredOauth2App) {
+	scope := r.FormValue("scope")
+	if scope == "" {
+		// if not specified the app gets all the scopes it's allowed to request
+		scope = strings.Join(app.AllowedScopes, " ")
+	}
+	if !app.AllowsScope(scope) {
+		http.Error(w, "Invalid scope: the application is not allowed to request the scope "+scope, http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := utils.IssueClientJWT(*app, scope)
+	if err != nil {
+		http.Error(w, "Error while issuing the access_token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokenResponse(w, AccessTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   database.AccessTokenExpiresIn,
+		Scope:       scope,
+	})
+}
+
+// deviceCodeGrant is polled by the device until the user approves the request on the verification page
+func (s *Server) deviceCodeGrant(w http.ResponseWriter, r *http.Request, app *database.RegisteredOauth2App) {
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_request", "missing the device_code param from the 'POST /token' request")
+		return
+	}
+
+	deviceAuthorization := s.sessions.FindDeviceAuthorizationByDeviceCode(deviceCode)
+	if deviceAuthorization == nil || deviceAuthorization.AppID != app.ID {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_grant", "unknown device_code")
+		return
+	}
+	if deviceAuthorization.IsExpired() {
+		writeOauth2Error(w, http.StatusBadRequest, "expired_token", "the device_code has expired, start a new device authorization")
+		return
+	}
+
+	// the device is polling too fast: RFC 8628 section 3.5 asks to increase the interval by 5 seconds
+	interval := deviceAuthorization.Interval
+	tooFast := time.Since(deviceAuthorization.LastPolledAt) < time.Duration(interval)*time.Second
+	if tooFast {
+		interval += 5
+	}
+	if err := s.sessions.UpdateDeviceAuthorizationPolling(deviceCode, time.Now(), interval); err != nil {
+		log.Println(err)
+		http.Error(w, "Error while updating the device authorization", http.StatusInternalServerError)
+		return
+	}
+	if tooFast {
+		writeOauth2Error(w, http.StatusBadRequest, "slow_down", fmt.Sprintf("polling interval increased to %d seconds", interval))
+		return
+	}
+
+	if deviceAuthorization.Denied {
+		s.sessions.DeleteDeviceAuthorization(deviceCode)
+		writeOauth2Error(w, http.StatusBadRequest, "access_denied", "the user has denied the request")
+		return
+	}
+	if deviceAuthorization.Email == nil {
+		writeOauth2Error(w, http.StatusBadRequest, "authorization_pending", "the user hasn't approved the request yet")
+		return
+	}
+	// the device_code can be exchanged only once: of the concurrent polls, only one gets the approved authorization
+	deviceAuthorization = s.sessions.RedeemDeviceAuthorization(deviceCode)
+	if deviceAuthorization == nil {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_grant", "the device_code has already been used")
+		return
+	}
+	user := s.users.FindUserByEmail(*deviceAuthorization.Email)
 	if user == nil {
 		http.Error(w, "User not found in the System", http.StatusInternalServerError)
 		return
 	}
+	s.writeAccessTokenResponse(w, user, app, deviceAuthorization.Scope, "", &authentication{
+		AMR:      deviceAuthorization.AMR,
+		AuthTime: deviceAuthorization.AuthTime,
+	})
+}
 
+// authentication tells how and when the user logged in to grant the tokens, for the amr and auth_time claims.
+// The id_token issued right after the login also echoes the nonce and the sid of the SSO session, if any
+type authentication struct {
+	AMR      []string
+	AuthTime time.Time
+	Nonce    string
+	SID      string
+}
+
+// writeAccessTokenResponse issues the access_token and a refresh_token belonging to the given family, for the granted scope.
+// If the user's authentication is known and the openid scope has been granted, the id_token is issued too
+func (s *Server) writeAccessTokenResponse(w http.ResponseWriter, user *database.User, app *database.RegisteredOauth2App, scope, familyID string, login *authentication) {
 	// generating the access_token as a jwt based on the user information
-	accessToken, err := utils.IssueJWT(*user)
+	var amr []string
+	if login != nil {
+		amr = login.AMR
+	}
+	accessToken, jti, err := utils.IssueJWT(*user, app.ClientID, scope, amr)
 	if err != nil {
 		http.Error(w, "Error while issuing the access_token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var idToken string
+	if login != nil && utils.HasScope(scope, "openid") {
+		idToken, err = utils.IssueIDToken(*user, app.ClientID, scope, login.Nonce, login.SID, login.AuthTime, amr, accessToken)
+		if err != nil {
+			http.Error(w, "Error while issuing the id_token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var authTime time.Time
+	if login != nil {
+		authTime = login.AuthTime
+	}
+	refreshToken, err := s.tokens.SaveNewRefreshToken(app.ID, user.ID, scope, familyID, jti, amr, authTime)
+	if err != nil {
+		log.Println("Unable to save the refresh token:", err)
+		writeOauth2Error(w, http.StatusInternalServerError, "server_error", "unable to issue the refresh token")
+		return
+	}
+
+	writeTokenResponse(w, AccessTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		ExpiresIn:    database.AccessTokenExpiresIn,
+		RefreshToken: refreshToken.Token,
+		Scope:        scope,
+		IDToken:      idToken,
+	})
+}
+
+func writeTokenResponse(w http.ResponseWriter, response AccessTokenResponse) {
 	// returning the access_token tas both response header and in the body response
-	w.Header().Set("access_token", accessToken)
+	w.Header().Set("access_token", response.AccessToken)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(AccessTokenResponse{
-		AccessToken: accessToken,
-		TokenType:   "bearer",
-		ExpiresIn:   3600,
+	json.NewEncoder(w).Encode(response)
+}
+
+// introspectHandler lets the resource servers, registered as client apps, validate a token without knowing how it is signed
+func (s *Server) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret := getClientIDAndSecret(r)
+	app := s.clients.FindRegisteredAppByClientID(clientID)
+	if app == nil || app.ClientSecret != clientSecret {
+		http.Error(w, "Invalid client ID or client secret", http.StatusUnauthorized)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing the token param from the 'POST /introspect' request", http.StatusBadRequest)
+		return
+	}
+
+	// the hint only decides which kind of token is looked up first
+	var response *IntrospectionResponse
+	if r.FormValue("token_type_hint") == "refresh_token" {
+		response = s.introspectRefreshToken(token)
+		if response == nil {
+			response = s.introspectAccessToken(token)
+		}
+	} else {
+		response = s.introspectAccessToken(token)
+		if response == nil {
+			response = s.introspectRefreshToken(token)
+		}
+	}
+	if response == nil {
+		response = &IntrospectionResponse{Active: false}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) introspectAccessToken(token string) *IntrospectionResponse {
+	claims, isValid := utils.DecodeJWT(token, s.tokens)
+	if !isValid {
+		return nil
+	}
+	response := &IntrospectionResponse{
+		Active:    true,
+		TokenType: "bearer",
+	}
+	response.Scope, _ = claims["scope"].(string)
+	response.ClientID, _ = claims["client_id"].(string)
+	response.Sub, _ = claims["sub"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		response.Exp = int64(exp)
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		response.Iat = int64(iat)
+	}
+	return response
+}
+
+func (s *Server) introspectRefreshToken(token string) *IntrospectionResponse {
+	refreshToken := s.tokens.FindRefreshToken(token)
+	if refreshToken == nil || refreshToken.Used || refreshToken.Revoked || refreshToken.IsExpired() {
+		return nil
+	}
+	app := s.clients.FindRegisteredAppByID(refreshToken.AppID)
+	if app == nil {
+		return nil
+	}
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     refreshToken.Scope,
+		ClientID:  app.ClientID,
+		Sub:       refreshToken.UserID,
+		Exp:       refreshToken.CreatedAt.Add(time.Duration(refreshToken.ExpiresIn) * time.Second).Unix(),
+		Iat:       refreshToken.CreatedAt.Unix(),
+		TokenType: "refresh_token",
+	}
+}
+
+// revokeHandler revokes an access_token or a refresh_token (RFC 7009) together with all the tokens issued from the same grant
+func (s *Server) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret := getClientIDAndSecret(r)
+	app := s.clients.FindRegisteredAppByClientID(clientID)
+	if app == nil || app.ClientSecret != clientSecret {
+		http.Error(w, "Invalid client ID or client secret", http.StatusUnauthorized)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing the token param from the 'POST /revoke' request", http.StatusBadRequest)
+		return
+	}
+
+	// the hint only decides which kind of token is looked up first
+	var revoked bool
+	var err error
+	if r.FormValue("token_type_hint") == "refresh_token" {
+		if revoked, err = s.revokeRefreshToken(token, app); err == nil && !revoked {
+			_, err = s.revokeAccessToken(token, app)
+		}
+	} else {
+		if revoked, err = s.revokeAccessToken(token, app); err == nil && !revoked {
+			_, err = s.revokeRefreshToken(token, app)
+		}
+	}
+	if err != nil {
+		writeOauth2Error(w, http.StatusBadRequest, "unauthorized_client", err.Error())
+		return
+	}
+
+	// invalid or unknown tokens don't cause an error response (RFC 7009 section 2.2)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) revokeAccessToken(token string, app *database.RegisteredOauth2App) (revoked bool, err error) {
+	claims, isValid := utils.DecodeJWT(token, s.tokens)
+	if !isValid {
+		return false, nil
+	}
+	if claims["client_id"] != app.ClientID {
+		return false, fmt.Errorf("the token has been issued to another application")
+	}
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	s.tokens.RevokeAccessToken(jti, time.Unix(int64(exp), 0))
+
+	// cascading on the refresh tokens issued from the same grant
+	if refreshToken := s.tokens.FindRefreshTokenByAccessTokenJTI(jti); refreshToken != nil {
+		s.tokens.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+	}
+	return true, nil
+}
+
+func (s *Server) revokeRefreshToken(token string, app *database.RegisteredOauth2App) (revoked bool, err error) {
+	refreshToken := s.tokens.FindRefreshToken(token)
+	if refreshToken == nil {
+		return false, nil
+	}
+	if refreshToken.AppID != app.ID {
+		return false, fmt.Errorf("the token has been issued to another application")
+	}
+	s.tokens.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+	return true, nil
+}
+
+func (s *Server) deviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret := getClientIDAndSecret(r)
+	scope := r.FormValue("scope")
+
+	app := s.clients.FindRegisteredAppByClientID(clientID)
+	if app == nil || app.ClientSecret != clientSecret {
+		http.Error(w, "Invalid client ID or client secret", http.StatusUnauthorized)
+		return
+	}
+	if unknownScope := unsupportedScope(scope); unknownScope != "" {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_scope", "unknown scope "+unknownScope)
+		return
+	}
+	if reservedScope := firstPartyScope(scope, app); reservedScope != "" {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_scope", "the scope "+reservedScope+" is reserved to the first-party applications")
+		return
+	}
+
+	deviceAuthorization, err := s.sessions.SaveNewDeviceAuthorization(clientID, scope)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating a new device authorization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DeviceAuthorizationResponse{
+		DeviceCode:              deviceAuthorization.DeviceCode,
+		UserCode:                deviceAuthorization.UserCode,
+		VerificationURI:         deviceVerificationURI,
+		VerificationURIComplete: deviceVerificationURI + "?user_code=" + url.QueryEscape(deviceAuthorization.UserCode),
+		ExpiresIn:               deviceAuthorization.ExpiresIn,
+		Interval:                deviceAuthorization.Interval,
 	})
 }
 
-func userInfoHandler(w http.ResponseWriter, r *http.Request) {
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	devicePage, err := generateDevicePage(r.URL.Query().Get("user_code"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the device verification page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
+	fmt.Fprint(w, devicePage)
+}
+
+func (s *Server) deviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	deviceAuthorization := s.sessions.FindDeviceAuthorizationByUserCode(r.FormValue("user_code"))
+	if deviceAuthorization == nil || deviceAuthorization.IsExpired() || deviceAuthorization.Email != nil {
+		http.Error(w, "Invalid or expired user code", http.StatusBadRequest)
+		return
+	}
+
+	// the user logs in and consents like in the authorization code flow, but the session approves the device at the end
+	oauthSession, err := s.sessions.SaveNewOauth2SessionForDevice(deviceAuthorization.DeviceCode)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating a new login session", http.StatusInternalServerError)
+		return
+	}
+	if s.resumeSSOSession(w, r, oauthSession.ID) {
+		return
+	}
+	http.Redirect(w, r, utils.Issuer+loginPath+"?session_id="+oauthSession.ID, http.StatusFound)
+}
+
+// unlockHandler lets an admin clear the failed logins of an account (email param) or of an IP address (ip param)
+func (s *Server) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	admin := s.bearerUser(w, r, adminScope)
+	if admin == nil {
+		return
+	}
+	if admin.Roles != adminRole {
+		http.Error(w, "Only an admin can unlock accounts", http.StatusForbidden)
+		return
+	}
+
+	email := r.FormValue("email")
+	ip := r.FormValue("ip")
+	if email == "" && ip == "" {
+		http.Error(w, "missing one of the following params from the 'POST /unlock' request: email, ip", http.StatusBadRequest)
+		return
+	}
+	if email != "" {
+		s.loginAttempts.DeleteLoginAttempt(accountLoginKey(email))
+		log.Printf("Account %s unlocked by %s\n", email, admin.Email)
+	}
+	if ip != "" {
+		s.loginAttempts.DeleteLoginAttempt(ipLoginKey(ip))
+		log.Printf("IP address %s unlocked by %s\n", ip, admin.Email)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TOTPEnrollmentResponse gives the shared secret to the authenticator app of the user
+type TOTPEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+// TOTPConfirmationResponse gives the recovery codes, shown only once
+type TOTPConfirmationResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpEnrollmentHandler starts the enrollment of the user to the second factor: the secret is used only once confirmed
+func (s *Server) totpEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := s.bearerUser(w, r, accountScope)
+	if user == nil {
+		return
+	}
+	if user.TOTPConfirmed {
+		http.Error(w, "The user is already enrolled to the second factor", http.StatusConflict)
+		return
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err == nil {
+		err = s.users.UpdateUserTOTP(user.ID, secret, false, nil)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while enrolling the user to the second factor", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TOTPEnrollmentResponse{
+		Secret:     secret,
+		OtpauthURI: utils.TOTPURI(user.Email, secret),
+	})
+}
+
+// totpConfirmationHandler completes the enrollment with the first code of the authenticator app and generates the recovery codes
+func (s *Server) totpConfirmationHandler(w http.ResponseWriter, r *http.Request) {
+	user := s.bearerUser(w, r, accountScope)
+	if user == nil {
+		return
+	}
+	if user.TOTPSecret == "" || user.TOTPConfirmed {
+		http.Error(w, "No pending enrollment to the second factor", http.StatusConflict)
+		return
+	}
+	step, valid := utils.VerifyTOTP(user.TOTPSecret, strings.TrimSpace(r.FormValue("code")), time.Now())
+	if !valid {
+		http.Error(w, "Wrong code", http.StatusBadRequest)
+		return
+	}
+	recoveryCodes, recoveryCodeHashes, err := utils.GenerateRecoveryCodes()
+	if err == nil {
+		err = s.users.UpdateUserTOTP(user.ID, user.TOTPSecret, true, recoveryCodeHashes)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while enrolling the user to the second factor", http.StatusInternalServerError)
+		return
+	}
+	// the code used to confirm can't be used to log in
+	s.users.UseTOTPStep(user.ID, step)
+	log.Printf("User %s enrolled to the second factor\n", user.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TOTPConfirmationResponse{RecoveryCodes: recoveryCodes})
+}
+
+// bearerUser returns the user of the access token in the Authorization header, writing the error response if there's none
+// or if the token hasn't been granted the scope. The first-party scopes must also have been granted to a first-party app
+func (s *Server) bearerUser(w http.ResponseWriter, r *http.Request, scope string) *database.User {
+	split := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+	if len(split) != 2 {
+		http.Error(w, "Missing access token", http.StatusUnauthorized)
+		return nil
+	}
+	claims, isValid := utils.DecodeJWT(split[1], s.tokens)
+	if !isValid {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return nil
+	}
+	if utils.IsClientJWT(claims) {
+		http.Error(w, "The access token has been issued to an application, not to a user", http.StatusForbidden)
+		return nil
+	}
+	grantedScope, _ := claims["scope"].(string)
+	if !utils.HasScope(grantedScope, scope) {
+		http.Error(w, "The access token hasn't been granted the scope "+scope, http.StatusForbidden)
+		return nil
+	}
+	clientID, _ := claims["client_id"].(string)
+	if app := s.clients.FindRegisteredAppByClientID(clientID); app == nil || firstPartyScope(scope, app) != "" {
+		http.Error(w, "The access token has been issued to an application that can't use the scope "+scope, http.StatusForbidden)
+		return nil
+	}
+	userID, _ := claims["sub"].(string)
+	user := s.users.FindUserByID(userID)
+	if user == nil {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return nil
+	}
+	return user
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(utils.PublicJWKS())
+}
+
+// serverMetadataHandler serves both /.well-known/openid-configuration and /.well-known/oauth-authorization-server
+func serverMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ServerMetadata{
+		Issuer:                                    utils.Issuer,
+		AuthorizationEndpoint:                     utils.Issuer + authorizePath,
+		TokenEndpoint:                             utils.Issuer + tokenPath,
+		UserInfoEndpoint:                          utils.Issuer + userInfoPath,
+		JwksURI:                                   utils.Issuer + jwksPath,
+		IntrospectionEndpoint:                     utils.Issuer + introspectPath,
+		RevocationEndpoint:                        utils.Issuer + revokePath,
+		DeviceAuthorizationEndpoint:               utils.Issuer + deviceAuthorizationPath,
+		EndSessionEndpoint:                        utils.Issuer + endSessionPath,
+		ScopesSupported:                           supportedScopes,
+		ResponseTypesSupported:                    supportedResponseTypes,
+		GrantTypesSupported:                       supportedGrantTypes,
+		SubjectTypesSupported:                     []string{"public"},
+		IDTokenSigningAlgValuesSupported:          []string{utils.SigningAlgorithm()},
+		TokenEndpointAuthMethodsSupported:         supportedClientAuthMethods,
+		IntrospectionEndpointAuthMethodsSupported: supportedClientAuthMethods,
+		RevocationEndpointAuthMethodsSupported:    supportedClientAuthMethods,
+		CodeChallengeMethodsSupported:             supportedCodeChallengeMethods,
+		ClaimsSupported:                           supportedClaims,
+		BackchannelLogoutSupported:                true,
+		BackchannelLogoutSessionSupported:         true,
+		FrontchannelLogoutSupported:               true,
+		FrontchannelLogoutSessionSupported:        true,
+	})
+}
+
+func (s *Server) userInfoHandler(w http.ResponseWriter, r *http.Request) {
 	authHeader := r.Header.Get("Authorization")
 	split := strings.Split(authHeader, "Bearer ")
 	if len(split) != 2 {
@@ -223,26 +1363,41 @@ func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 	accessToken := split[1]
 	log.Println("access-token: ", accessToken)
 
-	jwt, err := utils.VerifyJWT(accessToken)
+	jwt, err := utils.VerifyJWT(accessToken, s.tokens)
 	if err != nil {
 		log.Println("error while verifying access-token: ", err)
 	} else {
 		log.Printf("Token: %v", *jwt)
 	}
 
-	claims, isValid := utils.DecodeJWT(accessToken)
+	claims, isValid := utils.DecodeJWT(accessToken, s.tokens)
 	if !isValid {
 		http.Error(w, "Invalid access token", http.StatusUnauthorized)
 		return
 	}
 	log.Println("JWT claims: ", claims)
 
-	userInfo, err := utils.ClaimsToUser(claims)
-	log.Println("User converted from JWT claims: ", userInfo)
-	if err != nil {
-		http.Error(w, "Error while fetching the user: "+err.Error(), http.StatusInternalServerError)
+	if utils.IsClientJWT(claims) {
+		http.Error(w, "The access token has been issued to an application, not to a user", http.StatusForbidden)
+		return
+	}
+
+	// the user record is never encoded as is: it holds the password hash and the TOTP secrets
+	userID, _ := claims["sub"].(string)
+	user := s.users.FindUserByID(userID)
+	if user == nil {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
 		return
 	}
+	userInfo := UserInfo{Sub: user.ID, Roles: user.Roles}
+	scope, _ := claims["scope"].(string)
+	if utils.HasScope(scope, "profile") {
+		userInfo.Name = user.Name
+	}
+	if utils.HasScope(scope, "email") {
+		userInfo.Email = user.Email
+		userInfo.EmailVerified = &user.EmailVerified
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -251,12 +1406,32 @@ func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 // UTILITIES FUNCTIONS ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
-func generateLoginPage(state string) (htmlPage string, err error) {
-	return generatePage("login", state)
+func generateLoginPage(sessionID string) (htmlPage string, err error) {
+	return generatePage("login", html.EscapeString(sessionID))
+}
+
+func generateSignupPage(sessionID string) (htmlPage string, err error) {
+	return generatePage("signup", html.EscapeString(sessionID))
+}
+
+func generateSignupDonePage(email string) (htmlPage string, err error) {
+	return generatePage("signup_done", "", pageParam{Name: "email", Value: html.EscapeString(email)})
 }
 
-func generateConsentPage(state, appName string) (htmlPage string, err error) {
-	return generatePage("consent", state, pageParam{Name: "application", Value: appName})
+func generateTOTPPage(sessionID string) (htmlPage string, err error) {
+	return generatePage("totp", sessionID)
+}
+
+func generateConsentPage(sessionID, appName string, scopes []string) (htmlPage string, err error) {
+	return generatePage("consent", sessionID, pageParam{Name: "application", Value: appName}, pageParam{Name: "scopes", Value: scopeListItems(scopes)})
+}
+
+func generateDevicePage(userCode string) (htmlPage string, err error) {
+	return generatePage("device", "", pageParam{Name: "user_code", Value: html.EscapeString(userCode)})
+}
+
+func generateDeviceApprovedPage(appName string) (htmlPage string, err error) {
+	return generatePage("device_approved", "", pageParam{Name: "application", Value: appName})
 }
 
 type pageParam struct {
@@ -264,13 +1439,14 @@ type pageParam struct {
 	Value string
 }
 
-func generatePage(pageName, state string, params ...pageParam) (htmlPage string, err error) {
+// generatePage fills the page with the ID of the Oauth2 session, if any, and with the params
+func generatePage(pageName, sessionID string, params ...pageParam) (htmlPage string, err error) {
 	htmlBytes, err := ioutil.ReadFile(fmt.Sprintf("public/%s.html", pageName))
 	if err != nil {
 		return "", err
 	}
 
-	htmlPage = strings.Replace(string(htmlBytes), "<state>", state, -1)
+	htmlPage = strings.Replace(string(htmlBytes), "<session_id>", sessionID, -1)
 	for _, param := range params {
 		htmlPage = strings.Replace(htmlPage, fmt.Sprintf("<%s>", param.Name), param.Value, -1)
 	}
@@ -278,6 +1454,57 @@ func generatePage(pageName, state string, params ...pageParam) (htmlPage string,
 	return htmlPage, nil
 }
 
+// getClientIDAndSecret fetches the client credentials from the posted form or from the Basic Authorization header
+func getClientIDAndSecret(r *http.Request) (clientID, clientSecret string) {
+	clientID = r.FormValue("client_id")
+	clientSecret = r.FormValue("client_secret")
+
+	// client_id and client_secret can be sent either as Basic Authorization header or as form url-encoded values
+	// SO IF THEY'RE NOT FOUND IN THE POSTED FORM, WE TRY TO FETCH THEM IN THE AUTHORIZATION HEADER
+	if clientID == "" && clientSecret == "" {
+		clientID, clientSecret = getClientIDAndSecretFromHeader(r.Header.Get("Authorization"))
+	}
+	return clientID, clientSecret
+}
+
+// redirectWithError sends the browser back to the redirect_uri of the app with the error of the authorization request
+// (RFC 6749 section 4.1.2.1): the state is included if the app has sent it
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI, errorCode, description, state string) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+	query := uri.Query()
+	query.Set("error", errorCode)
+	query.Set("error_description", description)
+	if state != "" {
+		query.Set("state", state)
+	}
+	uri.RawQuery = query.Encode()
+	http.Redirect(w, r, uri.String(), http.StatusFound)
+}
+
+// authorizationError sends the browser back to the app of the session with the error, or shows it to the user
+// if the session approves a device, that has no redirect_uri
+func authorizationError(w http.ResponseWriter, r *http.Request, oauthSession *database.Oauth2Session, errorCode, description string) {
+	if oauthSession.DeviceCode != "" {
+		http.Error(w, description, http.StatusBadRequest)
+		return
+	}
+	redirectWithError(w, r, oauthSession.RedirectURI, errorCode, description, oauthSession.State)
+}
+
+func writeOauth2Error(w http.ResponseWriter, status int, errorCode, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Oauth2ErrorResponse{
+		Error:            errorCode,
+		ErrorDescription: description,
+	})
+}
+
 func getClientIDAndSecretFromHeader(authorizationHeader string) (clientID, clientSecret string) {
 	if !strings.HasPrefix(authorizationHeader, "Basic ") {
 		// because is "" or simply different
@@ -285,12 +1512,12 @@ func getClientIDAndSecretFromHeader(authorizationHeader string) (clientID, clien
 	}
 	decoded, err := base64.StdEncoding.DecodeString(authorizationHeader[6:])
 	if err != nil {
-		log.Error("error while decoding Authorization header: ", err)
+		log.Println("error while decoding Authorization header: ", err)
 		return "", ""
 	}
 	creds := strings.Split(string(decoded), ":")
 	if len(creds) != 2 {
-		log.Error("error decoding the Basic Auth header: expecting <client_id>:<client_secret>, got %s", creds)
+		log.Printf("error decoding the Basic Auth header: expecting <client_id>:<client_secret>, got %s\n", creds)
 		return "", ""
 	}
 	return creds[0], creds[1]
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"provider/database"
+	"provider/utils"
+)
+
+// forgotPasswordPageHandler shows the form asking the email of the account to recover
+func forgotPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	forgotPasswordPage, err := generatePage("forgot_password", html.EscapeString(r.URL.Query().Get("session_id")))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
+	fmt.Fprint(w, forgotPasswordPage)
+}
+
+// forgotPasswordHandler sends the reset link to the email: the response is the same whether the email has an account or not
+func (s *Server) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.FormValue("session_id")
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if email == "" {
+		http.Error(w, "missing the following param from the 'POST /forgot_password' request: email", http.StatusBadRequest)
+		return
+	}
+
+	if user := s.users.FindUserByEmail(email); user != nil {
+		if err := s.sendPasswordResetEmail(user, sessionID); err != nil {
+			log.Println("Unable to send the password reset email:", err)
+		}
+	} else {
+		log.Println("Password reset requested for an email not found in the System: " + email)
+	}
+
+	forgotPasswordDonePage, err := generatePage("forgot_password_done", "", pageParam{Name: "email", Value: html.EscapeString(email)})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, forgotPasswordDonePage)
+}
+
+// sendPasswordResetEmail sends the single-use link to choose a new password
+func (s *Server) sendPasswordResetEmail(user *database.User, sessionID string) error {
+	link, err := s.newEmailLink(user, database.EmailTokenPurposeResetPassword, database.PasswordResetTokenExpiresIn, resetPasswordPath, sessionID)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(user.Email, "Reset your WalrusMail password",
+		fmt.Sprintf("Hi %s,\n\nopen this link to choose a new password for your WalrusMail account:\n\n%s\n\n"+
+			"The link expires in %d minutes. If you didn't ask to reset your password, you can ignore this email.\n",
+			user.Name, link, database.PasswordResetTokenExpiresIn/60))
+}
+
+// resetPasswordPageHandler is the link sent by email: it shows the form for the new password.
+// The token is used only when the form is submitted, since some mail clients open the links to preview them
+func (s *Server) resetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	emailToken := s.emailTokens.FindEmailToken(utils.HashEmailToken(token), database.EmailTokenPurposeResetPassword)
+	if emailToken == nil || emailToken.IsExpired() {
+		http.Error(w, "The link is invalid or expired: ask for a new one", http.StatusBadRequest)
+		return
+	}
+	resetPasswordPage, err := generatePage("reset_password", html.EscapeString(r.URL.Query().Get("session_id")),
+		pageParam{Name: "token", Value: html.EscapeString(token)})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	fmt.Fprint(w, resetPasswordPage)
+}
+
+// resetPasswordHandler writes the new password and logs the user out everywhere:
+// whoever knew the old password loses the sessions and the tokens obtained with it
+func (s *Server) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	password := r.FormValue("password")
+	if err := validatePassword(password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	emailToken := s.emailTokens.ConsumeEmailToken(utils.HashEmailToken(r.FormValue("token")), database.EmailTokenPurposeResetPassword)
+	if emailToken == nil || emailToken.IsExpired() {
+		http.Error(w, "The link is invalid or expired: ask for a new one", http.StatusBadRequest)
+		return
+	}
+	user := s.users.FindUserByID(emailToken.UserID)
+	if user == nil {
+		http.Error(w, "The link is invalid or expired: ask for a new one", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := utils.HashPassword(password)
+	if err == nil {
+		err = s.users.UpdateUserPassword(user.ID, passwordHash)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while resetting the password", http.StatusInternalServerError)
+		return
+	}
+	s.endUserSessions(user)
+	// the link has been received by email, so the email is verified too
+	if !user.EmailVerified {
+		if err := s.users.MarkUserEmailAsVerified(user.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	log.Printf("Password of %s reset\n", user.Email)
+
+	err = s.mailer.Send(user.Email, "Your WalrusMail password has been changed",
+		fmt.Sprintf("Hi %s,\n\nthe password of your WalrusMail account has been changed and you have been logged out everywhere.\n"+
+			"If it was not you, reset your password again right away.\n", user.Name))
+	if err != nil {
+		log.Println("Unable to send the password changed email:", err)
+	}
+
+	s.backToLogin(w, r, r.FormValue("session_id"), "password_reset_done")
+}
+
+// endUserSessions logs the user out everywhere: the SSO sessions, the logins in progress, the refresh tokens (with the
+// access tokens issued together with them) and the other reset links are invalidated, and the failed logins are forgotten.
+// The apps the user has logged in to are notified on their back-channel: the browsers of the sessions are not at hand
+func (s *Server) endUserSessions(user *database.User) {
+	for _, ssoSession := range s.sessions.DeleteSSOSessionsOfUser(user.ID) {
+		s.notifyBackchannelLogout(ssoSession)
+	}
+	s.sessions.DeleteOauth2SessionsByEmail(user.Email)
+	s.tokens.RevokeRefreshTokensOfUser(user.ID, "")
+	s.emailTokens.DeleteEmailTokensOfUser(user.ID, database.EmailTokenPurposeResetPassword)
+	s.resetFailedLogins(user.Email)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"provider/database"
+)
+
+// ScopeDescription is an entry of the scope registry: what the consent page tells the user the app gets with the scope
+type ScopeDescription struct {
+	Name        string
+	Description string
+	// the user can uncheck an optional scope on the consent page: the tokens are issued without it
+	Optional bool
+	// only the first-party apps can request a first-party scope
+	FirstParty bool
+}
+
+// scopeRegistry lists the scopes the apps can request on the authorize endpoint
+var scopeRegistry = []ScopeDescription{
+	{Name: "openid", Description: "Sign you in with your WalrusMail account"},
+	{Name: "profile", Description: "See your name", Optional: true},
+	{Name: "email", Description: "See your email address", Optional: true},
+	{Name: accountScope, Description: "Manage the security settings of your WalrusMail account", FirstParty: true},
+	{Name: adminScope, Description: "Unlock the WalrusMail accounts, if you are an admin", FirstParty: true},
+}
+
+// first-party scopes: accountScope lets the apps enroll the user to the second factor, adminScope lets them run
+// the administration endpoints on behalf of an admin
+const (
+	accountScope = "account"
+	adminScope   = "admin"
+)
+
+func registeredScopeNames() []string {
+	names := make([]string, 0, len(scopeRegistry))
+	for _, scope := range scopeRegistry {
+		names = append(names, scope.Name)
+	}
+	return names
+}
+
+// describeScope returns the registry entry of the scope, if registered
+func describeScope(scope string) (description ScopeDescription, registered bool) {
+	for _, entry := range scopeRegistry {
+		if entry.Name == scope {
+			return entry, true
+		}
+	}
+	return ScopeDescription{}, false
+}
+
+// firstPartyScope returns the first of the space separated scopes reserved to the first-party apps, if any and if the app isn't one
+func firstPartyScope(scope string, app *database.RegisteredOauth2App) string {
+	if app.FirstParty {
+		return ""
+	}
+	for _, requested := range strings.Fields(scope) {
+		if description, registered := describeScope(requested); registered && description.FirstParty {
+			return requested
+		}
+	}
+	return ""
+}
+
+// scopesToAsk returns the requested scopes the user has to consent to: the ones not remembered for the app yet, if any consent
+func scopesToAsk(consent *database.Consent, scope string) []string {
+	if consent == nil {
+		return strings.Fields(scope)
+	}
+	return consent.MissingScopes(scope)
+}
+
+// grantedScope returns the requested scopes granted on the consent page: the ones already granted before, the
+// required ones and the optional ones left checked by the user. The checked scopes that weren't asked are ignored
+func grantedScope(scope string, asked, checked []string) string {
+	var granted []string
+	for _, requested := range strings.Fields(scope) {
+		description, registered := describeScope(requested)
+		if !registered {
+			continue
+		}
+		if !contains(asked, requested) || !description.Optional || contains(checked, requested) {
+			granted = append(granted, requested)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+// scopeListItems renders the registered scopes as the items of the consent page list, with a checkbox for the optional ones
+func scopeListItems(scopes []string) string {
+	var items strings.Builder
+	for _, scope := range scopes {
+		description, registered := describeScope(scope)
+		if !registered {
+			continue
+		}
+		if description.Optional {
+			fmt.Fprintf(&items, "<li><label><input type=\"checkbox\" name=\"scope\" value=\"%s\" checked/>%s</label></li>\n",
+				html.EscapeString(scope), html.EscapeString(description.Description))
+		} else {
+			fmt.Fprintf(&items, "<li>%s</li>\n", html.EscapeString(description.Description))
+		}
+	}
+	if items.Len() == 0 {
+		return "<li>Know who you are on WalrusMail</li>\n"
+	}
+	return items.String()
+}
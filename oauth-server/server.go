@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	"provider/database"
+	"provider/mailer"
+)
+
+// Server holds the stores the handlers depend on, so that any storage can be plugged in
+type Server struct {
+	users    database.UserStore
+	clients  database.ClientStore
+	sessions database.SessionStore
+	tokens   database.TokenStore
+	// failed logins counted to throttle the password guessing
+	loginAttempts database.LoginAttemptStore
+	// single-use tokens of the links sent by email, and the delivery of the emails
+	emailTokens database.EmailTokenStore
+	mailer      mailer.Mailer
+	// the scopes the users have granted to the apps, to skip the consent page
+	consents database.ConsentStore
+
+	// how long an authorization code can be exchanged after being issued
+	authorizationCodeExpiresIn time.Duration
+	loginThrottling            LoginThrottlingPolicy
+	ssoSessions                SSOSessionPolicy
+	backchannelLogout          BackchannelLogoutPolicy
+}
+
+// NewServer creates the server on top of the given stores: the emails are printed to the log until another mailer is set
+func NewServer(users database.UserStore, clients database.ClientStore, sessions database.SessionStore, tokens database.TokenStore,
+	loginAttempts database.LoginAttemptStore, emailTokens database.EmailTokenStore, consents database.ConsentStore) *Server {
+	return &Server{
+		users:    users,
+		clients:  clients,
+		sessions: sessions,
+		tokens:   tokens,
+
+		loginAttempts: loginAttempts,
+		emailTokens:   emailTokens,
+		mailer:        &mailer.LogMailer{From: defaultMailFrom},
+		consents:      consents,
+
+		authorizationCodeExpiresIn: database.AuthorizationCodeExpiresIn * time.Second,
+		loginThrottling:            DefaultLoginThrottlingPolicy(),
+		ssoSessions:                DefaultSSOSessionPolicy(),
+		backchannelLogout:          DefaultBackchannelLogoutPolicy(),
+	}
+}
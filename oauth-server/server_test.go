@@ -0,0 +1,1981 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"provider/database"
+	"provider/utils"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gyozatech/temaki"
+)
+
+const (
+	testClientID     = "12345"
+	testClientSecret = "dkjdqqdkjdqjdqjkqefv"
+	testRedirectURI  = "http://localhost:8081/redirect"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	if err := utils.InitKeyRing(utils.AlgES256, ""); err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewMemoryStore()
+	return NewServer(store, store, store, store, store, store, store)
+}
+
+// authorizationCodeFlow runs authorize, submit, consent and token for the given state and returns the token response status
+func authorizationCodeFlow(t *testing.T, server *Server, state string) int {
+	code := authorize(t, server, state)
+	if code == "" {
+		return 0
+	}
+	return exchangeCode(server, code).Code
+}
+
+// authorize runs authorize, submit and consent for the given state and returns the authorization code
+func authorize(t *testing.T, server *Server, state string) string {
+	return authorizeWithParams(t, server, state, nil)
+}
+
+// authorizeWithParams is authorize with more params sent to the authorize endpoint
+func authorizeWithParams(t *testing.T, server *Server, state string, params url.Values) string {
+	query := url.Values{
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid profile"},
+		"state":         {state},
+	}
+	for name, values := range params {
+		query[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, httptest.NewRequest(http.MethodGet, authorizePath+"?"+query.Encode(), nil))
+	redirect, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil {
+		t.Errorf("authorize: got status %d: %s", recorder.Code, recorder.Body.String())
+		return ""
+	}
+	sessionID := redirect.Query().Get("session_id")
+
+	if recorder := submit(server, sessionID, "john.doe@email.com", "jjj"); recorder.Code != http.StatusOK {
+		t.Errorf("submit: got status %d: %s", recorder.Code, recorder.Body.String())
+		return ""
+	}
+
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "scope": {"profile"}}))
+	redirect, err = url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil || redirect.Query().Get("state") != state {
+		t.Errorf("consent: got status %d: %s", recorder.Code, recorder.Body.String())
+		return ""
+	}
+	return redirect.Query().Get("code")
+}
+
+func exchangeCode(server *Server, code string) *httptest.ResponseRecorder {
+	return exchangeCodeWithVerifier(server, code, "")
+}
+
+// exchangeCodeWithVerifier exchanges the code sending the PKCE code_verifier, if not empty
+func exchangeCodeWithVerifier(server *Server, code, codeVerifier string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+	recorder := httptest.NewRecorder()
+	server.tokenHandler(recorder, newFormRequest(tokenPath, form))
+	return recorder
+}
+
+// newOauth2Session starts an Oauth2 session of the demo app without the authorize request and returns its ID
+func newOauth2Session(t *testing.T, server *Server, scope string) string {
+	t.Helper()
+	oauthSession, err := server.sessions.SaveNewOauth2Session(testClientID, testRedirectURI, scope, "xyz", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oauthSession.ID
+}
+
+var sessionIDField = regexp.MustCompile(`name="session_id" value="([^"]+)"`)
+
+// sessionIDOf returns the ID of the Oauth2 session started by the authorize request: from the redirect to the login,
+// or from the consent page if the SSO session has skipped the login
+func sessionIDOf(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	t.Helper()
+	if redirect, err := url.Parse(recorder.Header().Get("Location")); err == nil && redirect.Query().Get("session_id") != "" {
+		return redirect.Query().Get("session_id")
+	}
+	if match := sessionIDField.FindStringSubmatch(recorder.Body.String()); match != nil {
+		return match[1]
+	}
+	t.Fatalf("no Oauth2 session started: got status %d, location %q", recorder.Code, recorder.Header().Get("Location"))
+	return ""
+}
+
+func newFormRequest(path string, form url.Values) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+// userInfo calls the userinfo endpoint with the access token and returns the claims of the response
+func userInfo(t *testing.T, server *Server, accessToken string) map[string]interface{} {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, userInfoPath, nil)
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	recorder := httptest.NewRecorder()
+	server.userInfoHandler(recorder, request)
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &claims); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("userinfo: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return claims
+}
+
+func TestUserInfoClaims(t *testing.T) {
+	server := newTestServer(t)
+	var response AccessTokenResponse
+	json.NewDecoder(exchangeCode(server, authorize(t, server, "state-userinfo")).Body).Decode(&response)
+
+	claims := userInfo(t, server, response.AccessToken)
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	if claims["sub"] != user.ID || claims["name"] != user.Name {
+		t.Errorf("userinfo: got %v, want the sub and the name of %s", claims, user.Email)
+	}
+	for name := range claims {
+		switch name {
+		case "sub", "name", "email", "email_verified", "roles":
+		default:
+			t.Errorf("userinfo must return only the OpenID Connect claims, got %q", name)
+		}
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	server := newTestServer(t)
+	verifier := strings.Repeat("verifier-", 6)
+	hash := sha256.Sum256([]byte(verifier))
+	s256Challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	code := authorizeWithParams(t, server, "state-s256", url.Values{"code_challenge": {s256Challenge}, "code_challenge_method": {"S256"}})
+	if recorder := exchangeCodeWithVerifier(server, code, verifier); recorder.Code != http.StatusOK {
+		t.Errorf("S256: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// without code_challenge_method the challenge is plain
+	code = authorizeWithParams(t, server, "state-plain", url.Values{"code_challenge": {verifier}})
+	if recorder := exchangeCodeWithVerifier(server, code, verifier); recorder.Code != http.StatusOK {
+		t.Errorf("plain: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	code = authorizeWithParams(t, server, "state-missing", url.Values{"code_challenge": {s256Challenge}, "code_challenge_method": {"S256"}})
+	if recorder := exchangeCode(server, code); recorder.Code != http.StatusBadRequest {
+		t.Errorf("missing code_verifier: got status %d, want 400", recorder.Code)
+	}
+	code = authorizeWithParams(t, server, "state-wrong", url.Values{"code_challenge": {s256Challenge}, "code_challenge_method": {"S256"}})
+	if recorder := exchangeCodeWithVerifier(server, code, strings.Repeat("attacker-", 6)); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code_verifier: got status %d, want 401", recorder.Code)
+	}
+	// the code isn't redeemed by a wrong code_verifier: the client can still exchange it
+	if recorder := exchangeCodeWithVerifier(server, code, verifier); recorder.Code != http.StatusOK {
+		t.Errorf("the code must still be redeemable after a wrong code_verifier: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestPKCERequiredByPublicClient(t *testing.T) {
+	server := newTestServer(t)
+	server.clients = &testClientStore{ClientStore: server.clients, update: func(app *database.RegisteredOauth2App) {
+		app.RequirePKCE = true
+	}}
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-no-pkce", "", nil))
+	redirect, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil || redirect.Query().Get("error") != "invalid_request" {
+		t.Fatalf("no code_challenge: got status %d, location %q, want invalid_request", recorder.Code, recorder.Header().Get("Location"))
+	}
+	if redirect.Query().Get("session_id") != "" {
+		t.Errorf("no Oauth2 session must be started without the code_challenge: %s", redirect)
+	}
+}
+
+// TestConcurrentAuthorizationCodeFlows must be run with -race: the flows share the store with the cleanup jobs
+func TestConcurrentAuthorizationCodeFlows(t *testing.T) {
+	server := newTestServer(t)
+	store := server.sessions.(*database.MemoryStore)
+
+	const flows = 50
+	// the logins of the same account are counted as failed while being verified: all the flows must get through
+	server.loginThrottling = LoginThrottlingPolicy{MaxFailuresPerAccount: flows, MaxFailuresPerIP: flows, LockoutDuration: time.Minute}
+	done := make(chan struct{})
+	var cleanup sync.WaitGroup
+	cleanup.Add(1)
+	go func() {
+		defer cleanup.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.DeleteExpiredOauth2Sessions()
+				store.DeleteExpiredDeviceAuthorizations()
+				store.DeleteExpiredRefreshTokens()
+				store.DeleteExpiredRevokedTokens()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < flows; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if status := authorizationCodeFlow(t, server, fmt.Sprintf("state-%d", i)); status != http.StatusOK {
+				t.Errorf("flow %d: token endpoint returned status %d", i, status)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	cleanup.Wait()
+}
+
+func TestOauth2SessionsIndexedByIDAndCode(t *testing.T) {
+	store := database.NewMemoryStore()
+	first, err := store.SaveNewOauth2Session(testClientID, testRedirectURI, "profile", "state-1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the state is chosen by the client: two logins with the same state are two sessions
+	second, err := store.SaveNewOauth2Session(testClientID, testRedirectURI, "profile", "state-1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Fatal("the sessions with the same state must have different IDs")
+	}
+
+	if _, err := store.UpdateOauth2SessionWithAuthCode(first.ID, "code-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOauth2SessionWithAuthCode(first.ID, "code-2"); err != nil {
+		t.Fatal(err)
+	}
+	if session := store.FindOauth2SessionByCode("code-1"); session != nil {
+		t.Error("the replaced code must not be found anymore")
+	}
+	session := store.FindOauth2SessionByCode("code-2")
+	if session == nil || session.ID != first.ID || session.State != "state-1" {
+		t.Fatalf("expected the first session of state-1, got %+v", session)
+	}
+
+	// the returned session is a copy: changing it doesn't touch the stored one
+	session.Scope = "email"
+	if stored := store.FindOauth2SessionByID(first.ID); stored.Scope != "profile" {
+		t.Errorf("expected the stored scope to be profile, got %s", stored.Scope)
+	}
+}
+
+func TestAuthorizationCodeReplayRevokesIssuedTokens(t *testing.T) {
+	server := newTestServer(t)
+
+	code := authorize(t, server, "state-replay")
+	recorder := exchangeCode(server, code)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("first redemption: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder := exchangeCode(server, code); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("second redemption: got status %d", recorder.Code)
+	}
+	refreshToken := server.tokens.FindRefreshToken(response.RefreshToken)
+	if refreshToken == nil || !refreshToken.Revoked {
+		t.Fatal("the refresh token issued from the replayed code must be revoked")
+	}
+	if !server.tokens.IsAccessTokenRevoked(refreshToken.AccessTokenJTI) {
+		t.Error("the access token issued from the replayed code must be revoked")
+	}
+}
+
+func refresh(server *Server, refreshToken string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.tokenHandler(recorder, newFormRequest(tokenPath, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}))
+	return recorder
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	server := newTestServer(t)
+	var first AccessTokenResponse
+	json.NewDecoder(exchangeCode(server, authorize(t, server, "state-rotation")).Body).Decode(&first)
+
+	recorder := refresh(server, first.RefreshToken)
+	var rotated AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &rotated); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("refresh: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if rotated.RefreshToken == "" || rotated.RefreshToken == first.RefreshToken {
+		t.Fatal("the refresh token must be rotated")
+	}
+	newToken := server.tokens.FindRefreshToken(rotated.RefreshToken)
+	if oldToken := server.tokens.FindRefreshToken(first.RefreshToken); !oldToken.Used || oldToken.FamilyID != newToken.FamilyID {
+		t.Fatal("the rotated token must be marked as used and the new one must belong to the same family")
+	}
+
+	// the old token presented again: the whole family is revoked
+	if recorder := refresh(server, first.RefreshToken); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("reuse: got status %d", recorder.Code)
+	}
+	if newToken := server.tokens.FindRefreshToken(rotated.RefreshToken); !newToken.Revoked || !server.tokens.IsAccessTokenRevoked(newToken.AccessTokenJTI) {
+		t.Error("the reuse must revoke the refresh tokens of the family and their access tokens")
+	}
+	if recorder := refresh(server, rotated.RefreshToken); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("the latest token of a revoked family: got status %d", recorder.Code)
+	}
+}
+
+func TestConcurrentRefreshesRotateOnce(t *testing.T) {
+	server := newTestServer(t)
+	var response AccessTokenResponse
+	json.NewDecoder(exchangeCode(server, authorize(t, server, "state-concurrent")).Body).Decode(&response)
+
+	const refreshes = 20
+	var rotated int32
+	var wg sync.WaitGroup
+	for i := 0; i < refreshes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if refresh(server, response.RefreshToken).Code == http.StatusOK {
+				atomic.AddInt32(&rotated, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if rotated != 1 {
+		t.Errorf("%d concurrent refreshes rotated the same token, want 1", rotated)
+	}
+}
+
+// failingTokenStore can't save the refresh tokens, like a database that has gone away
+type failingTokenStore struct {
+	database.TokenStore
+}
+
+func (s *failingTokenStore) SaveNewRefreshToken(appID, userID, scope, familyID, accessTokenJTI string, amr []string, authTime time.Time) (*database.RefreshToken, error) {
+	return nil, fmt.Errorf("database is locked")
+}
+
+func TestRefreshTokenNotSaved(t *testing.T) {
+	server := newTestServer(t)
+	server.tokens = &failingTokenStore{TokenStore: server.tokens}
+	recorder := exchangeCode(server, authorize(t, server, "state-failing"))
+	var response Oauth2ErrorResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusInternalServerError || response.Error != "server_error" {
+		t.Errorf("refresh token not saved: got status %d and error %q, want server_error", recorder.Code, response.Error)
+	}
+}
+
+func TestAuthorizationCodeReplayAfterExpiry(t *testing.T) {
+	server := newTestServer(t)
+	code := authorize(t, server, "state-replay")
+	recorder := exchangeCode(server, code)
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("first redemption: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the code has expired by the time the attacker replays it
+	server.authorizationCodeExpiresIn = time.Nanosecond
+	if recorder := exchangeCode(server, code); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("replay after expiry: got status %d", recorder.Code)
+	}
+	if refreshToken := server.tokens.FindRefreshToken(response.RefreshToken); refreshToken == nil || !refreshToken.Revoked {
+		t.Error("the refresh token issued from the code replayed after its expiry must be revoked")
+	}
+}
+
+func TestAuthorizationCodeBoundToClientAndLifetime(t *testing.T) {
+	server := newTestServer(t)
+
+	code := authorize(t, server, "state-redirect")
+	recorder := httptest.NewRecorder()
+	server.tokenHandler(recorder, newFormRequest(tokenPath, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost:8081/other"},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("a different redirect_uri: got status %d", recorder.Code)
+	}
+
+	server.authorizationCodeExpiresIn = time.Nanosecond
+	if recorder := exchangeCode(server, authorize(t, server, "state-expired")); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("an expired code: got status %d", recorder.Code)
+	}
+}
+
+func submit(server *Server, sessionID, email, password string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.submitHandler(recorder, newFormRequest("/oauth/v2/submit", url.Values{
+		"session_id": {sessionID},
+		"email":      {email},
+		"password":   {password},
+	}))
+	return recorder
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	server := newTestServer(t)
+	clientCredentials := func(form url.Values, basicAuth string) *httptest.ResponseRecorder {
+		form.Set("grant_type", "client_credentials")
+		request := newFormRequest(tokenPath, form)
+		if basicAuth != "" {
+			request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+		}
+		recorder := httptest.NewRecorder()
+		server.tokenHandler(recorder, request)
+		return recorder
+	}
+
+	// a confidential client gets an access token on its own behalf, with neither refresh_token nor id_token
+	for name, recorder := range map[string]*httptest.ResponseRecorder{
+		"form":  clientCredentials(url.Values{"client_id": {testClientID}, "client_secret": {testClientSecret}, "scope": {"profile"}}, ""),
+		"basic": clientCredentials(url.Values{"scope": {"profile"}}, testClientID+":"+testClientSecret),
+	} {
+		var response map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", name, recorder.Code, recorder.Body.String())
+		}
+		if _, ok := response["refresh_token"]; ok {
+			t.Errorf("%s: no refresh_token must be issued to the client itself", name)
+		}
+		if _, ok := response["id_token"]; ok {
+			t.Errorf("%s: no id_token must be issued without a user", name)
+		}
+		if response["scope"] != "profile" || response["token_type"] != "bearer" {
+			t.Errorf("%s: got scope %v and token_type %v", name, response["scope"], response["token_type"])
+		}
+		accessToken, _ := response["access_token"].(string)
+		claims, isValid := utils.DecodeJWT(accessToken, server.tokens)
+		if !isValid || !utils.IsClientJWT(claims) || claims["sub"] != testClientID {
+			t.Errorf("%s: the access token must be issued to the client: %v", name, claims)
+		}
+	}
+
+	// without scope the client gets all the scopes it is allowed to request, and no others
+	recorder := clientCredentials(url.Values{"client_id": {testClientID}, "client_secret": {testClientSecret}}, "")
+	if !strings.Contains(recorder.Body.String(), `"scope":"profile email"`) {
+		t.Errorf("default scope: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := clientCredentials(url.Values{"client_id": {testClientID}, "client_secret": {testClientSecret}, "scope": {"admin"}}, ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("scope not allowed: got status %d, want 400", recorder.Code)
+	}
+
+	// a public client, with no secret to authenticate, can't act on its own behalf
+	if recorder := clientCredentials(url.Values{"client_id": {testClientID}}, ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("public client: got status %d, want 400", recorder.Code)
+	}
+	for name, recorder := range map[string]*httptest.ResponseRecorder{
+		"wrong secret":          clientCredentials(url.Values{"client_id": {testClientID}, "client_secret": {"wrong"}}, ""),
+		"wrong secret in basic": clientCredentials(url.Values{}, testClientID+":wrong"),
+		"unknown client":        clientCredentials(url.Values{"client_id": {"unknown"}, "client_secret": {testClientSecret}}, ""),
+	} {
+		if recorder.Code != http.StatusUnauthorized || strings.Contains(recorder.Body.String(), "access_token") {
+			t.Errorf("%s: got status %d, want 401: %s", name, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+// introspect calls the introspection endpoint as the demo app and returns the fields of the response
+func introspect(t *testing.T, server *Server, token, tokenTypeHint string) map[string]interface{} {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.introspectHandler(recorder, newFormRequest(introspectPath, url.Values{
+		"token":           {token},
+		"token_type_hint": {tokenTypeHint},
+		"client_id":       {testClientID},
+		"client_secret":   {testClientSecret},
+	}))
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("introspection: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return response
+}
+
+// issueTokens runs the authorization code flow and returns the token response
+func issueTokens(t *testing.T, server *Server, state string) AccessTokenResponse {
+	t.Helper()
+	recorder := exchangeCode(server, authorize(t, server, state))
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return response
+}
+
+// expiredRefreshTokenStore finds the refresh tokens as if they had been issued before their lifetime
+type expiredRefreshTokenStore struct {
+	database.TokenStore
+}
+
+func (s *expiredRefreshTokenStore) FindRefreshToken(token string) *database.RefreshToken {
+	refreshToken := s.TokenStore.FindRefreshToken(token)
+	if refreshToken != nil {
+		refreshToken.CreatedAt = refreshToken.CreatedAt.Add(-database.RefreshTokenExpiresIn*time.Second - time.Minute)
+	}
+	return refreshToken
+}
+
+func TestIntrospection(t *testing.T) {
+	server := newTestServer(t)
+	tokens := issueTokens(t, server, "state-introspection")
+	user := server.users.FindUserByEmail("john.doe@email.com")
+
+	response := introspect(t, server, tokens.AccessToken, "")
+	if response["active"] != true || response["token_type"] != "bearer" || response["client_id"] != testClientID ||
+		response["sub"] != user.ID || response["scope"] != "openid profile" || response["exp"] == nil || response["iat"] == nil {
+		t.Errorf("active access token: got %v", response)
+	}
+	// the hint only decides which kind of token is looked up first
+	for _, hint := range []string{"refresh_token", "access_token"} {
+		response = introspect(t, server, tokens.RefreshToken, hint)
+		if response["active"] != true || response["token_type"] != "refresh_token" || response["client_id"] != testClientID || response["sub"] != user.ID {
+			t.Errorf("active refresh token with hint %q: got %v", hint, response)
+		}
+	}
+
+	// nothing but the inactive state is told about the tokens that can't be used
+	inactive := func(name string, response map[string]interface{}) {
+		t.Helper()
+		if len(response) != 1 || response["active"] != false {
+			t.Errorf("%s: got %v, want only {\"active\":false}", name, response)
+		}
+	}
+	inactive("unknown token", introspect(t, server, "unknown", ""))
+
+	jwt.TimeFunc = func() time.Time { return time.Now().Add(database.AccessTokenExpiresIn*time.Second + time.Minute) }
+	defer func() { jwt.TimeFunc = time.Now }()
+	inactive("expired access token", introspect(t, server, tokens.AccessToken, ""))
+	jwt.TimeFunc = time.Now
+
+	tokenStore := server.tokens
+	server.tokens = &expiredRefreshTokenStore{TokenStore: tokenStore}
+	inactive("expired refresh token", introspect(t, server, tokens.RefreshToken, "refresh_token"))
+	server.tokens = tokenStore
+
+	tokenStore.RevokeRefreshTokenFamily(tokenStore.FindRefreshToken(tokens.RefreshToken).FamilyID)
+	inactive("revoked access token", introspect(t, server, tokens.AccessToken, ""))
+	inactive("revoked refresh token", introspect(t, server, tokens.RefreshToken, "refresh_token"))
+
+	// the caller must be a registered app
+	for name, form := range map[string]url.Values{
+		"no client":    {"token": {tokens.AccessToken}},
+		"wrong secret": {"token": {tokens.AccessToken}, "client_id": {testClientID}, "client_secret": {"wrong"}},
+	} {
+		recorder := httptest.NewRecorder()
+		server.introspectHandler(recorder, newFormRequest(introspectPath, form))
+		if recorder.Code != http.StatusUnauthorized || strings.Contains(recorder.Body.String(), "active") {
+			t.Errorf("%s: got status %d, want 401: %s", name, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+// revoke calls the revocation endpoint as the demo app
+func revoke(server *Server, token, tokenTypeHint string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.revokeHandler(recorder, newFormRequest(revokePath, url.Values{
+		"token":           {token},
+		"token_type_hint": {tokenTypeHint},
+		"client_id":       {testClientID},
+		"client_secret":   {testClientSecret},
+	}))
+	return recorder
+}
+
+func TestRevocation(t *testing.T) {
+	server := newTestServer(t)
+	active := func(token, hint string) bool {
+		return introspect(t, server, token, hint)["active"] == true
+	}
+
+	// revoking the refresh token revokes the whole family: the tokens it was rotated from and their access tokens
+	first := issueTokens(t, server, "state-revoke-refresh")
+	var rotated AccessTokenResponse
+	if err := json.Unmarshal(refresh(server, first.RefreshToken).Body.Bytes(), &rotated); err != nil || rotated.RefreshToken == "" {
+		t.Fatal("refresh failed")
+	}
+	if recorder := revoke(server, rotated.RefreshToken, "refresh_token"); recorder.Code != http.StatusOK {
+		t.Fatalf("revoke refresh token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	for name, token := range map[string]string{"first access token": first.AccessToken, "rotated access token": rotated.AccessToken} {
+		if active(token, "") {
+			t.Errorf("%s: still active after the revocation of the family", name)
+		}
+	}
+	for name, refreshToken := range map[string]string{"first refresh token": first.RefreshToken, "rotated refresh token": rotated.RefreshToken} {
+		if found := server.tokens.FindRefreshToken(refreshToken); found == nil || !found.Revoked {
+			t.Errorf("%s: not revoked with the family: %+v", name, found)
+		}
+	}
+	if recorder := refresh(server, rotated.RefreshToken); recorder.Code == http.StatusOK {
+		t.Error("the revoked refresh token must not be exchanged")
+	}
+
+	// revoking the access token revokes the refresh token issued with it
+	tokens := issueTokens(t, server, "state-revoke-access")
+	if recorder := revoke(server, tokens.AccessToken, ""); recorder.Code != http.StatusOK {
+		t.Fatalf("revoke access token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if active(tokens.AccessToken, "") || active(tokens.RefreshToken, "refresh_token") {
+		t.Error("the access token and its refresh token must be revoked")
+	}
+
+	// unknown or already revoked tokens get 200 as well (RFC 7009 section 2.2)
+	for name, recorder := range map[string]*httptest.ResponseRecorder{
+		"unknown token":               revoke(server, "unknown", ""),
+		"unknown refresh token":       revoke(server, "unknown", "refresh_token"),
+		"already revoked":             revoke(server, tokens.RefreshToken, "refresh_token"),
+		"already revoked jwt as hint": revoke(server, tokens.AccessToken, "refresh_token"),
+	} {
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200", name, recorder.Code)
+		}
+	}
+
+	// only the app the token has been issued to can revoke it
+	tokens = issueTokens(t, server, "state-revoke-client")
+	for name, form := range map[string]url.Values{
+		"no client":    {"token": {tokens.RefreshToken}},
+		"wrong secret": {"token": {tokens.RefreshToken}, "client_id": {testClientID}, "client_secret": {"wrong"}},
+	} {
+		recorder := httptest.NewRecorder()
+		server.revokeHandler(recorder, newFormRequest(revokePath, form))
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want 401", name, recorder.Code)
+		}
+	}
+	clients := server.clients
+	server.clients = &testClientStore{ClientStore: clients, update: func(app *database.RegisteredOauth2App) {
+		app.ID, app.ClientID = "other-app", "other-client"
+	}}
+	for _, token := range []string{tokens.AccessToken, tokens.RefreshToken} {
+		if recorder := revoke(server, token, ""); recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "unauthorized_client") {
+			t.Errorf("another app: got status %d, want unauthorized_client: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	server.clients = clients
+	if !active(tokens.AccessToken, "") || !active(tokens.RefreshToken, "refresh_token") {
+		t.Error("the tokens must stay active when the revocation is rejected")
+	}
+}
+
+// jwksPublicKey fetches the JWKS and returns the EC public key with the given kid, as a relying party would
+func jwksPublicKey(t *testing.T, kid string) *ecdsa.PublicKey {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	jwksHandler(recorder, httptest.NewRequest(http.MethodGet, jwksPath, nil))
+	var jwks utils.JWKS
+	if err := json.Unmarshal(recorder.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("jwks: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	for _, key := range jwks.Keys {
+		if key.Kid != kid {
+			continue
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if key.Kty != "EC" || key.Crv != "P-256" || key.Alg != utils.AlgES256 || errX != nil || errY != nil {
+			t.Fatalf("unexpected JWK: %+v", key)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	t.Fatalf("kid %s not published in the JWKS", kid)
+	return nil
+}
+
+func TestIDTokenVerifiedWithTheJWKS(t *testing.T) {
+	server := newTestServer(t)
+	code := authorizeWithParams(t, server, "state-id-token", url.Values{"nonce": {"n-0S6_WzA2Mj"}})
+	recorder := exchangeCode(server, code)
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.IDToken == "" {
+		t.Fatalf("token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	claims := jwt.MapClaims{}
+	idToken, err := jwt.ParseWithClaims(response.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != utils.AlgES256 {
+			return nil, fmt.Errorf("unexpected alg %s", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return jwksPublicKey(t, kid), nil
+	})
+	if err != nil || !idToken.Valid {
+		t.Fatalf("the id_token must verify with the published key: %v", err)
+	}
+
+	if claims["iss"] != utils.Issuer || !claims.VerifyAudience(testClientID, true) {
+		t.Errorf("got iss %v and aud %v, want %s and %s", claims["iss"], claims["aud"], utils.Issuer, testClientID)
+	}
+	if claims["nonce"] != "n-0S6_WzA2Mj" {
+		t.Errorf("the nonce must be echoed: got %v", claims["nonce"])
+	}
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	if claims["sub"] != user.ID {
+		t.Errorf("got sub %v, want %s", claims["sub"], user.ID)
+	}
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	if now := float64(time.Now().Unix()); iat > now || exp <= now || exp-iat != utils.IDTokenExpiresIn {
+		t.Errorf("got iat %v and exp %v, want the id_token valid for %d seconds from now", iat, exp, utils.IDTokenExpiresIn)
+	}
+	if authTime, _ := claims["auth_time"].(float64); authTime == 0 || authTime > iat {
+		t.Errorf("got auth_time %v, want the time of the login", claims["auth_time"])
+	}
+
+	// at_hash is the left half of the SHA-256 of the access token (OpenID Connect Core section 3.1.3.6)
+	sum := sha256.Sum256([]byte(response.AccessToken))
+	if want := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]); claims["at_hash"] != want {
+		t.Errorf("got at_hash %v, want %s", claims["at_hash"], want)
+	}
+
+	// a key not in the JWKS can't verify it
+	if _, err := jwt.Parse(response.IDToken, func(token *jwt.Token) (interface{}, error) {
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return &other.PublicKey, nil
+	}); err == nil {
+		t.Error("the id_token must not verify with another key")
+	}
+
+	// signed with the same keys, the id_token is not an access token
+	request := httptest.NewRequest(http.MethodGet, userInfoPath, nil)
+	request.Header.Set("Authorization", "Bearer "+response.IDToken)
+	recorder = httptest.NewRecorder()
+	server.userInfoHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("userinfo with the id_token: got status %d, want 401", recorder.Code)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	server := newTestServer(t)
+	router := temaki.NewRouter()
+	server.registerRoutes(router)
+	dispatch := router.DispatcherHandler()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		dispatch(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	var metadata ServerMetadata
+	recorder := serve(http.MethodGet, "/.well-known/openid-configuration")
+	if err := json.Unmarshal(recorder.Body.Bytes(), &metadata); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("openid-configuration: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if oauthMetadata := serve(http.MethodGet, "/.well-known/oauth-authorization-server"); oauthMetadata.Body.String() != recorder.Body.String() {
+		t.Errorf("the authorization server metadata must be the same document: %s", oauthMetadata.Body.String())
+	}
+	if metadata.Issuer != utils.Issuer {
+		t.Errorf("got issuer %s, want %s", metadata.Issuer, utils.Issuer)
+	}
+
+	// every published endpoint is served by the router with the method the clients use
+	for name, endpoint := range map[string]struct{ method, uri string }{
+		"authorization_endpoint":        {http.MethodGet, metadata.AuthorizationEndpoint},
+		"token_endpoint":                {http.MethodPost, metadata.TokenEndpoint},
+		"userinfo_endpoint":             {http.MethodGet, metadata.UserInfoEndpoint},
+		"jwks_uri":                      {http.MethodGet, metadata.JwksURI},
+		"introspection_endpoint":        {http.MethodPost, metadata.IntrospectionEndpoint},
+		"revocation_endpoint":           {http.MethodPost, metadata.RevocationEndpoint},
+		"device_authorization_endpoint": {http.MethodPost, metadata.DeviceAuthorizationEndpoint},
+		"end_session_endpoint":          {http.MethodGet, metadata.EndSessionEndpoint},
+	} {
+		if !strings.HasPrefix(endpoint.uri, utils.Issuer+"/") {
+			t.Errorf("%s: %q is not under the issuer", name, endpoint.uri)
+			continue
+		}
+		if recorder := serve(endpoint.method, strings.TrimPrefix(endpoint.uri, utils.Issuer)); recorder.Code == http.StatusNotFound || recorder.Code == http.StatusMethodNotAllowed {
+			t.Errorf("%s: %s %s got status %d, the route is not registered", name, endpoint.method, endpoint.uri, recorder.Code)
+		}
+	}
+
+	// the id_token is signed with the algorithm published, by a key in the JWKS
+	if len(metadata.IDTokenSigningAlgValuesSupported) != 1 || metadata.IDTokenSigningAlgValuesSupported[0] != utils.AlgES256 {
+		t.Errorf("got id_token_signing_alg_values_supported %v, want [%s]", metadata.IDTokenSigningAlgValuesSupported, utils.AlgES256)
+	}
+	var jwks utils.JWKS
+	json.Unmarshal(serve(http.MethodGet, jwksPath).Body.Bytes(), &jwks)
+	for _, key := range jwks.Keys {
+		if key.Alg != metadata.IDTokenSigningAlgValuesSupported[0] {
+			t.Errorf("the JWKS publishes a %s key: %+v", key.Alg, key)
+		}
+	}
+
+	// the token endpoint supports the published grant types, and only them
+	for _, grantType := range append(metadata.GrantTypesSupported, "password") {
+		recorder := httptest.NewRecorder()
+		server.tokenHandler(recorder, newFormRequest(tokenPath, url.Values{"grant_type": {grantType}, "client_id": {testClientID}, "client_secret": {testClientSecret}}))
+		if unsupported := strings.HasPrefix(recorder.Body.String(), "Unsupported grant_type"); unsupported != (grantType == "password") {
+			t.Errorf("grant_type %s: got status %d: %s", grantType, recorder.Code, recorder.Body.String())
+		}
+	}
+	if strings.Join(metadata.ScopesSupported, " ") != strings.Join(registeredScopeNames(), " ") {
+		t.Errorf("got scopes_supported %v, want the registered scopes %v", metadata.ScopesSupported, registeredScopeNames())
+	}
+	if strings.Join(metadata.CodeChallengeMethodsSupported, " ") != "S256 plain" || strings.Join(metadata.ResponseTypesSupported, " ") != "code" {
+		t.Errorf("got code_challenge_methods_supported %v and response_types_supported %v", metadata.CodeChallengeMethodsSupported, metadata.ResponseTypesSupported)
+	}
+	if strings.Join(metadata.TokenEndpointAuthMethodsSupported, " ") != "client_secret_basic client_secret_post" {
+		t.Errorf("got token_endpoint_auth_methods_supported %v", metadata.TokenEndpointAuthMethodsSupported)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	server := newTestServer(t)
+	// no backoff between the attempts, only the lockout
+	server.loginThrottling.BaseBackoff = 0
+
+	for i := 0; i < server.loginThrottling.MaxFailuresPerAccount; i++ {
+		wrongPassword := submit(server, "state-lockout", "john.doe@email.com", "wrong")
+		unknownEmail := submit(server, "state-lockout", fmt.Sprintf("nobody-%d@email.com", i), "wrong")
+		if wrongPassword.Code != unknownEmail.Code || wrongPassword.Body.String() != unknownEmail.Body.String() {
+			t.Fatalf("unknown emails must look like wrong passwords: got %d %q and %d %q",
+				wrongPassword.Code, wrongPassword.Body.String(), unknownEmail.Code, unknownEmail.Body.String())
+		}
+	}
+
+	// locked: even the right password is rejected without being verified
+	recorder := submit(server, "state-lockout", "john.doe@email.com", "jjj")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked account: got status %d", recorder.Code)
+	}
+
+	adminToken, _, err := utils.IssueJWT(*server.users.FindUserByEmail("john.doe@email.com"), testClientID, adminScope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, _, err := utils.IssueJWT(*server.users.FindUserByEmail("marion.ruhl@email.com"), testClientID, adminScope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the admin's token without the admin scope, like the ones the apps usually get
+	profileToken, _, err := utils.IssueJWT(*server.users.FindUserByEmail("john.doe@email.com"), testClientID, "profile", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock := func(token string) int {
+		request := newFormRequest("/admin/v2/unlock", url.Values{"email": {"john.doe@email.com"}})
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		server.unlockHandler(recorder, request)
+		return recorder.Code
+	}
+	if status := unlock(userToken); status != http.StatusForbidden {
+		t.Errorf("unlock by a user: got status %d", status)
+	}
+	if status := unlock(profileToken); status != http.StatusForbidden {
+		t.Errorf("unlock without the admin scope: got status %d", status)
+	}
+	if status := unlock(adminToken); status != http.StatusNoContent {
+		t.Fatalf("unlock by an admin: got status %d", status)
+	}
+
+	// the IP address is still below its threshold
+	if recorder := submit(server, newOauth2Session(t, server, "profile"), "john.doe@email.com", "jjj"); recorder.Code != http.StatusOK {
+		t.Errorf("unlocked account: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// TestConcurrentWrongPasswords checks that the concurrent logins can't all be verified before the first failure is counted
+func TestConcurrentWrongPasswords(t *testing.T) {
+	server := newTestServer(t)
+	server.loginThrottling.BaseBackoff = 0
+
+	const attempts = 20
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- submit(server, "state-concurrent", "john.doe@email.com", "wrong").Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	verified := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusUnauthorized:
+			verified++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("got status %d, want 401 or 429", status)
+		}
+	}
+	if verified != server.loginThrottling.MaxFailuresPerAccount {
+		t.Errorf("%d passwords verified, want %d before the lockout", verified, server.loginThrottling.MaxFailuresPerAccount)
+	}
+}
+
+// TestRightPasswordGivesBackTheAttempt checks that only the failed logins are counted, once verified
+func TestRightPasswordGivesBackTheAttempt(t *testing.T) {
+	server := newTestServer(t)
+	server.loginThrottling.BaseBackoff = 0
+
+	submit(server, "state-wrong", "john.doe@email.com", "wrong")
+	if recorder := submit(server, newOauth2Session(t, server, "profile"), "john.doe@email.com", "jjj"); recorder.Code != http.StatusOK {
+		t.Fatalf("right password: got status %d", recorder.Code)
+	}
+	if loginAttempt := server.loginAttempts.FindLoginAttempt(accountLoginKey("john.doe@email.com")); loginAttempt != nil {
+		t.Errorf("the failures of the account must be forgotten: %+v", loginAttempt)
+	}
+	if loginAttempt := server.loginAttempts.FindLoginAttempt(ipLoginKey("192.0.2.1")); loginAttempt == nil || loginAttempt.Failures != 1 {
+		t.Errorf("the IP address must keep only its wrong password: %+v", loginAttempt)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	policy := DefaultLoginThrottlingPolicy()
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: policy.LockoutDuration, 64: policy.LockoutDuration} {
+		loginAttempt := &database.LoginAttempt{Failures: failures, LastFailedAt: time.Now()}
+		if wait := policy.retryAfter(loginAttempt, policy.MaxFailuresPerAccount); wait > want || wait < want-time.Second {
+			t.Errorf("%d failures: got %v, want %v", failures, wait, want)
+		}
+	}
+}
+
+func TestTOTPSecondFactor(t *testing.T) {
+	server := newTestServer(t)
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	accessToken, _, err := utils.IssueJWT(*user, testClientID, "profile account", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearerRequest := func(path string, form url.Values) *http.Request {
+		request := newFormRequest(path, form)
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		return request
+	}
+
+	recorder := httptest.NewRecorder()
+	server.totpEnrollmentHandler(recorder, bearerRequest("/account/v2/totp", url.Values{}))
+	var enrollment TOTPEnrollmentResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &enrollment); err != nil || enrollment.Secret == "" {
+		t.Fatalf("enrollment: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// until confirmed the second factor is not required
+	if code := authorize(t, server, "state-unconfirmed"); code == "" {
+		t.Fatal("the login must not require the unconfirmed second factor")
+	}
+
+	totpCode, _ := utils.TOTPCode(enrollment.Secret, time.Now())
+	recorder = httptest.NewRecorder()
+	server.totpConfirmationHandler(recorder, bearerRequest("/account/v2/totp/confirm", url.Values{"code": {totpCode}}))
+	var confirmation TOTPConfirmationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &confirmation); err != nil || len(confirmation.RecoveryCodes) != utils.RecoveryCodesCount {
+		t.Fatalf("confirmation: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	sessionID := newOauth2Session(t, server, "openid")
+	if recorder := submit(server, sessionID, "john.doe@email.com", "jjj"); !strings.Contains(recorder.Body.String(), "/oauth/v2/totp") {
+		t.Fatalf("the password must be followed by the TOTP page: got %d", recorder.Code)
+	}
+
+	// the consent can't be skipped with only the password
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}}))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("consent without the second factor: got status %d", recorder.Code)
+	}
+
+	// the code used for the confirmation can't be replayed, a recovery code works only once
+	totp := func(code string) int {
+		recorder := httptest.NewRecorder()
+		server.totpHandler(recorder, newFormRequest("/oauth/v2/totp", url.Values{"session_id": {sessionID}, "code": {code}}))
+		return recorder.Code
+	}
+	if status := totp(totpCode); status != http.StatusUnauthorized {
+		t.Errorf("replayed TOTP code: got status %d", status)
+	}
+	server.loginAttempts.DeleteLoginAttempt(accountLoginKey("john.doe@email.com"))
+	server.loginAttempts.DeleteLoginAttempt(ipLoginKey("192.0.2.1"))
+	if status := totp(confirmation.RecoveryCodes[0]); status != http.StatusOK {
+		t.Fatalf("recovery code: got status %d", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}}))
+	redirect, _ := url.Parse(recorder.Header().Get("Location"))
+	recorder = exchangeCode(server, redirect.Query().Get("code"))
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(response.IDToken, claims); err != nil {
+		t.Fatal(err)
+	}
+	if amr := fmt.Sprint(claims["amr"]); amr != "[pwd otp]" {
+		t.Errorf("expected the amr claim to record pwd and otp, got %s", amr)
+	}
+
+	// the refreshed tokens still tell how the user logged in
+	var refreshed AccessTokenResponse
+	if recorder := refresh(server, response.RefreshToken); json.Unmarshal(recorder.Body.Bytes(), &refreshed) != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("refresh: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	refreshedClaims := map[string]jwt.MapClaims{"access token": {}, "id_token": {}}
+	for name, token := range map[string]string{"access token": refreshed.AccessToken, "id_token": refreshed.IDToken} {
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, refreshedClaims[name]); err != nil {
+			t.Fatalf("refreshed %s: %v", name, err)
+		}
+		if amr := fmt.Sprint(refreshedClaims[name]["amr"]); amr != "[pwd otp]" {
+			t.Errorf("refreshed %s: expected the amr claim to record pwd and otp, got %s", name, amr)
+		}
+	}
+	if authTime := refreshedClaims["id_token"]["auth_time"]; authTime != claims["auth_time"] {
+		t.Errorf("refreshed id_token: got auth_time %v, want the one of the login %v", authTime, claims["auth_time"])
+	}
+
+	server.loginAttempts.DeleteLoginAttempt(ipLoginKey("192.0.2.1"))
+	sessionID = newOauth2Session(t, server, "openid")
+	submit(server, sessionID, "john.doe@email.com", "jjj")
+	recorder = httptest.NewRecorder()
+	server.totpHandler(recorder, newFormRequest("/oauth/v2/totp", url.Values{"session_id": {sessionID}, "code": {confirmation.RecoveryCodes[0]}}))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: got status %d", recorder.Code)
+	}
+}
+
+func TestTOTPEnrollmentRequiresTheAccountScope(t *testing.T) {
+	server := newTestServer(t)
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	enroll := func(clientID, scope string) int {
+		accessToken, _, err := utils.IssueJWT(*user, clientID, scope, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := newFormRequest("/account/v2/totp", url.Values{})
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		server.totpEnrollmentHandler(recorder, request)
+		return recorder.Code
+	}
+	if status := enroll(testClientID, "openid profile"); status != http.StatusForbidden {
+		t.Errorf("token without the account scope: got status %d, want 403", status)
+	}
+	if status := enroll("other-client", accountScope); status != http.StatusForbidden {
+		t.Errorf("token issued to another client: got status %d, want 403", status)
+	}
+
+	// a third-party app can't get the scope, nor use the tokens it got before
+	clients := server.clients
+	server.clients = &testClientStore{ClientStore: clients, update: func(app *database.RegisteredOauth2App) {
+		app.FirstParty = false
+	}}
+	if status := enroll(testClientID, accountScope); status != http.StatusForbidden {
+		t.Errorf("token issued to a third-party app: got status %d, want 403", status)
+	}
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequestWithScope("state-account", "openid "+accountScope, "", nil))
+	redirect, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil || redirect.Query().Get("error") != "invalid_scope" {
+		t.Errorf("third-party app asking for the account scope: got status %d, location %q, want invalid_scope", recorder.Code, recorder.Header().Get("Location"))
+	}
+	server.clients = clients
+
+	if status := enroll(testClientID, accountScope); status != http.StatusOK {
+		t.Errorf("token issued to the first-party app: got status %d", status)
+	}
+}
+
+// recordingMailer keeps the emails instead of sending them
+type recordingMailer struct {
+	mutex  sync.Mutex
+	emails []recordedEmail
+}
+
+type recordedEmail struct {
+	To, Subject, Body string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.emails = append(m.emails, recordedEmail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+func (m *recordingMailer) last() recordedEmail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.emails) == 0 {
+		return recordedEmail{}
+	}
+	return m.emails[len(m.emails)-1]
+}
+
+var verifyEmailLink = regexp.MustCompile(regexp.QuoteMeta(utils.Issuer+verifyEmailPath) + `\?\S+`)
+
+func signup(server *Server, sessionID, name, email, password string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.signupHandler(recorder, newFormRequest(signupPath, url.Values{
+		"session_id": {sessionID},
+		"name":       {name},
+		"email":      {email},
+		"password":   {password},
+	}))
+	return recorder
+}
+
+func TestSignupWithEmailVerification(t *testing.T) {
+	server := newTestServer(t)
+	mailer := &recordingMailer{}
+	server.mailer = mailer
+	sessionID := newOauth2Session(t, server, "profile")
+
+	if recorder := signup(server, sessionID, "New User", "new.user@email.com", "short"); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("short password: got status %d, want 400", recorder.Code)
+	}
+	if recorder := signup(server, sessionID, "New User", "New.User@Email.com", "newuser123"); recorder.Code != http.StatusOK {
+		t.Fatalf("signup: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	email := mailer.last()
+	link := verifyEmailLink.FindString(email.Body)
+	if email.To != "new.user@email.com" || link == "" {
+		t.Fatalf("expected the verification link sent to new.user@email.com, got %+v", email)
+	}
+	if user := server.users.FindUserByEmail("new.user@email.com"); user == nil || user.EmailVerified || user.Password == "newuser123" {
+		t.Fatalf("expected a new user, not verified, with the password hashed: %+v", user)
+	}
+
+	// the login is refused until the email is verified
+	if recorder := submit(server, sessionID, "new.user@email.com", "newuser123"); recorder.Code != http.StatusForbidden {
+		t.Fatalf("login before the verification: got status %d, want 403", recorder.Code)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.verifyEmailHandler(recorder, httptest.NewRequest(http.MethodGet, link, nil))
+	if recorder.Code != http.StatusFound || !strings.Contains(recorder.Header().Get("Location"), loginPath+"?session_id="+sessionID) {
+		t.Fatalf("verification: got status %d, location %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+	recorder = httptest.NewRecorder()
+	server.verifyEmailHandler(recorder, httptest.NewRequest(http.MethodGet, link, nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("reused link: got status %d, want 400", recorder.Code)
+	}
+
+	if recorder := submit(server, sessionID, "new.user@email.com", "newuser123"); recorder.Code != http.StatusOK {
+		t.Fatalf("login after the verification: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// signing up again doesn't tell that the email is registered, the owner is notified instead
+	if recorder := signup(server, "", "Someone Else", "new.user@email.com", "anotherpassword"); recorder.Code != http.StatusOK {
+		t.Fatalf("signup with a registered email: got status %d", recorder.Code)
+	}
+	if email := mailer.last(); email.To != "new.user@email.com" || verifyEmailLink.MatchString(email.Body) {
+		t.Fatalf("expected a notice without verification link, got %+v", email)
+	}
+}
+
+var resetPasswordLink = regexp.MustCompile(regexp.QuoteMeta(utils.Issuer+resetPasswordPath) + `\?\S+`)
+
+func TestPasswordReset(t *testing.T) {
+	server := newTestServer(t)
+	mailer := &recordingMailer{}
+	server.mailer = mailer
+
+	recorder := exchangeCode(server, authorize(t, server, "state-before-reset"))
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	// a login in progress with the old password
+	inProgress := newOauth2Session(t, server, "profile")
+	if recorder := submit(server, inProgress, "john.doe@email.com", "jjj"); recorder.Code != http.StatusOK {
+		t.Fatalf("login: got status %d", recorder.Code)
+	}
+
+	forgotPassword := func(email string) {
+		recorder := httptest.NewRecorder()
+		server.forgotPasswordHandler(recorder, newFormRequest(forgotPasswordPath, url.Values{"email": {email}}))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("forgot password for %s: got status %d", email, recorder.Code)
+		}
+	}
+	forgotPassword("nobody@email.com")
+	if len(mailer.emails) != 0 {
+		t.Fatalf("no email expected for an unknown address, got %+v", mailer.emails)
+	}
+	forgotPassword("john.doe@email.com")
+	link := resetPasswordLink.FindString(mailer.last().Body)
+	if link == "" {
+		t.Fatalf("expected the reset link, got %+v", mailer.last())
+	}
+	token, _ := url.Parse(link)
+
+	// opening the link doesn't use the token
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		server.resetPasswordPageHandler(recorder, httptest.NewRequest(http.MethodGet, link, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("reset page: got status %d", recorder.Code)
+		}
+	}
+
+	resetPassword := func(password string) int {
+		recorder := httptest.NewRecorder()
+		server.resetPasswordHandler(recorder, newFormRequest(resetPasswordPath, url.Values{
+			"token":    {token.Query().Get("token")},
+			"password": {password},
+		}))
+		return recorder.Code
+	}
+	if status := resetPassword("short"); status != http.StatusBadRequest {
+		t.Fatalf("short password: got status %d, want 400", status)
+	}
+	if status := resetPassword("anewpassword"); status != http.StatusOK {
+		t.Fatalf("reset: got status %d", status)
+	}
+	if status := resetPassword("anotherpassword"); status != http.StatusBadRequest {
+		t.Fatalf("reused link: got status %d, want 400", status)
+	}
+
+	refreshToken := server.tokens.FindRefreshToken(response.RefreshToken)
+	if refreshToken == nil || !refreshToken.Revoked || !server.tokens.IsAccessTokenRevoked(refreshToken.AccessTokenJTI) {
+		t.Error("the tokens issued before the reset must be revoked")
+	}
+	if server.sessions.FindOauth2SessionByID(inProgress) != nil {
+		t.Error("the logins in progress must be ended by the reset")
+	}
+
+	afterReset := newOauth2Session(t, server, "profile")
+	server.loginThrottling.BaseBackoff = 0 // the failed login with the old password must not delay the next one
+	if recorder := submit(server, afterReset, "john.doe@email.com", "jjj"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("old password: got status %d, want 401", recorder.Code)
+	}
+	if recorder := submit(server, afterReset, "john.doe@email.com", "anewpassword"); recorder.Code != http.StatusOK {
+		t.Errorf("new password: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func authorizeRequest(state, prompt string, cookie *http.Cookie) *http.Request {
+	return authorizeRequestWithScope(state, "openid profile", prompt, cookie)
+}
+
+func authorizeRequestWithScope(state, scope, prompt string, cookie *http.Cookie) *http.Request {
+	query := url.Values{
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"response_type": {"code"},
+		"scope":         {scope},
+		"state":         {state},
+	}
+	if prompt != "" {
+		query.Set("prompt", prompt)
+	}
+	request := httptest.NewRequest(http.MethodGet, authorizePath+"?"+query.Encode(), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+// startLogin sends the authorize request and returns the ID of the Oauth2 session it has started
+func startLogin(t *testing.T, server *Server, request *http.Request) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, request)
+	return sessionIDOf(t, recorder)
+}
+
+// loginWithSSO logs in with the password and returns the SSO cookie set by the login and the ID of the Oauth2 session,
+// waiting for the consent
+func loginWithSSO(t *testing.T, server *Server) (*http.Cookie, string) {
+	t.Helper()
+	sessionID := startLogin(t, server, authorizeRequest("xyz", "", nil))
+	recorder := submit(server, sessionID, "john.doe@email.com", "jjj")
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == ssoCookieName {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+				t.Errorf("the SSO cookie must be HttpOnly and SameSite=Lax: %+v", cookie)
+			}
+			return cookie, sessionID
+		}
+	}
+	t.Fatalf("no SSO cookie set by the login: status %d", recorder.Code)
+	return nil, ""
+}
+
+func TestSSOSessionSkipsLogin(t *testing.T) {
+	server := newTestServer(t)
+	cookie, sessionID := loginWithSSO(t, server)
+	loggedInAt := server.sessions.FindOauth2SessionByID(sessionID).AuthTime
+
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-sso", "", cookie))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "oauth/v2/consent") {
+		t.Fatalf("with the SSO cookie: got status %d, want the consent page", recorder.Code)
+	}
+	session := server.sessions.FindOauth2SessionByID(sessionIDOf(t, recorder))
+	if session.Email == nil || *session.Email != "john.doe@email.com" || !session.AuthTime.Equal(loggedInAt) {
+		t.Fatalf("the session must be authenticated as the user of the SSO session since the login: %+v", session)
+	}
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {session.ID}}))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("consent: got status %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-prompt", "login", cookie))
+	if recorder.Code != http.StatusFound {
+		t.Errorf("prompt=login: got status %d, want the redirect to the login", recorder.Code)
+	}
+
+	forged := *cookie
+	forged.Value = "someone-else" + forged.Value[strings.LastIndex(forged.Value, "."):]
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-forged", "", &forged))
+	if recorder.Code != http.StatusFound || !strings.Contains(recorder.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Errorf("forged cookie: got status %d, want the redirect to the login and the cookie removed", recorder.Code)
+	}
+}
+
+// idleSSOSessionStore finds the SSO sessions as if the browser had been idle for longer than idleTimeout
+type idleSSOSessionStore struct {
+	database.SessionStore
+	idleTimeout time.Duration
+}
+
+func (s *idleSSOSessionStore) FindSSOSession(id string) *database.SSOSession {
+	ssoSession := s.SessionStore.FindSSOSession(id)
+	if ssoSession != nil {
+		ssoSession.IdleExpiresAt = ssoSession.IdleExpiresAt.Add(-s.idleTimeout - time.Minute)
+	}
+	return ssoSession
+}
+
+func TestSSOSessionIdleTimeout(t *testing.T) {
+	server := newTestServer(t)
+	cookie, _ := loginWithSSO(t, server)
+	server.sessions = &idleSSOSessionStore{SessionStore: server.sessions, idleTimeout: server.ssoSessions.IdleTimeout}
+
+	recorder := httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-idle", "", cookie))
+	if recorder.Code != http.StatusFound || !strings.Contains(recorder.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Errorf("idle session: got status %d, want the redirect to the login and the cookie removed", recorder.Code)
+	}
+}
+
+func TestRememberedConsent(t *testing.T) {
+	server := newTestServer(t)
+	cookie, sessionID := loginWithSSO(t, server)
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "scope": {"profile"}, "remember": {"yes"}}))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("consent: got status %d", recorder.Code)
+	}
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	if consent := server.consents.FindConsent(user.ID, "4b3d6d22-a317-456c-9f2e-793bd6a29ac0"); consent == nil || consent.RememberedScope != "openid profile" {
+		t.Fatalf("the consent must be remembered: %+v", consent)
+	}
+
+	// the same scopes, or fewer: straight back to the app with the code
+	for _, scope := range []string{"openid profile", "profile"} {
+		recorder = httptest.NewRecorder()
+		server.authorizeHandler(recorder, authorizeRequestWithScope("state-"+scope, scope, "", cookie))
+		if location := recorder.Header().Get("Location"); recorder.Code != http.StatusFound || !strings.HasPrefix(location, testRedirectURI+"?code=") {
+			t.Fatalf("scope %q already granted: got status %d, location %q", scope, recorder.Code, location)
+		}
+	}
+
+	// a new scope: the consent page asks only for it
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequestWithScope("state-email", "openid profile email", "", cookie))
+	if body := recorder.Body.String(); recorder.Code != http.StatusOK || !strings.Contains(body, `value="email"`) || strings.Contains(body, `value="profile"`) {
+		t.Fatalf("new scope: got status %d, want the consent page for email only: %s", recorder.Code, recorder.Body.String())
+	}
+	// without remembering it, the new scope is recorded but asked again next time
+	server.consentHandler(httptest.NewRecorder(), newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionIDOf(t, recorder)}, "scope": {"email"}}))
+	if consent := server.consents.FindConsent(user.ID, "4b3d6d22-a317-456c-9f2e-793bd6a29ac0"); consent.Scope != "openid profile email" || consent.RememberedScope != "openid profile" {
+		t.Errorf("the consent must record the granted scopes, remembered or not: %+v", consent)
+	}
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequestWithScope("state-email-again", "openid profile email", "", cookie))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("scope not remembered: got status %d, want the consent page", recorder.Code)
+	}
+}
+
+func TestGranularConsent(t *testing.T) {
+	server := newTestServer(t)
+	sessionID := startLogin(t, server, authorizeRequestWithScope("state-scopes", "openid profile email", "", nil))
+	recorder := submit(server, sessionID, "john.doe@email.com", "jjj")
+	body := recorder.Body.String()
+	for _, description := range []string{"Sign you in with your WalrusMail account", "See your name", "See your email address"} {
+		if !strings.Contains(body, description) {
+			t.Errorf("the consent page must describe the scope with %q", description)
+		}
+	}
+	if strings.Contains(body, `value="openid"`) {
+		t.Error("the openid scope is required: it can't be unchecked")
+	}
+
+	// profile unchecked: the scopes not asked are ignored
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "scope": {"email", "admin"}}))
+	redirect, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil {
+		t.Fatalf("consent: got status %d", recorder.Code)
+	}
+	recorder = exchangeCode(server, redirect.Query().Get("code"))
+	var response AccessTokenResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusOK || response.Scope != "openid email" {
+		t.Fatalf("token: got status %d and scope %q, want only the granted scopes", recorder.Code, response.Scope)
+	}
+
+	recorder = refresh(server, response.RefreshToken)
+	response = AccessTokenResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusOK || response.Scope != "openid email" {
+		t.Errorf("refresh: got status %d and scope %q, want the scopes granted", recorder.Code, response.Scope)
+	}
+}
+
+func TestUncheckedScopesLeaveOutTheClaims(t *testing.T) {
+	server := newTestServer(t)
+	sessionID := startLogin(t, server, authorizeRequestWithScope("state-openid", "openid profile email", "", nil))
+	submit(server, sessionID, "john.doe@email.com", "jjj")
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}}))
+	redirect, _ := url.Parse(recorder.Header().Get("Location"))
+	var response AccessTokenResponse
+	json.NewDecoder(exchangeCode(server, redirect.Query().Get("code")).Body).Decode(&response)
+	if response.Scope != "openid" {
+		t.Fatalf("token: got scope %q, want openid only", response.Scope)
+	}
+
+	accessTokenClaims, valid := utils.DecodeJWT(response.AccessToken, server.tokens)
+	if !valid {
+		t.Fatal("invalid access token")
+	}
+	idTokenClaims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(response.IDToken, idTokenClaims); err != nil {
+		t.Fatal(err)
+	}
+	for source, claims := range map[string]map[string]interface{}{
+		"access token": accessTokenClaims,
+		"id_token":     idTokenClaims,
+		"userinfo":     userInfo(t, server, response.AccessToken),
+	} {
+		for _, claim := range []string{"name", "email", "email_verified"} {
+			if _, found := claims[claim]; found {
+				t.Errorf("%s: the %s claim must be left out without the profile and email scopes", source, claim)
+			}
+		}
+	}
+}
+
+func TestDeviceAuthorizationRejectsUnknownScopes(t *testing.T) {
+	server := newTestServer(t)
+	recorder := httptest.NewRecorder()
+	server.deviceAuthorizationHandler(recorder, newFormRequest(deviceAuthorizationPath, url.Values{
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"scope":         {"profile payments"},
+	}))
+	var response Oauth2ErrorResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusBadRequest || response.Error != "invalid_scope" {
+		t.Errorf("unknown scope: got status %d and error %q, want invalid_scope", recorder.Code, response.Error)
+	}
+}
+
+func TestAuthorizationErrorsRedirectToTheApp(t *testing.T) {
+	server := newTestServer(t)
+	authorizeWith := func(params url.Values) *httptest.ResponseRecorder {
+		query := url.Values{
+			"client_id":     {testClientID},
+			"redirect_uri":  {testRedirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid profile"},
+			"state":         {"xyz"},
+		}
+		for name, values := range params {
+			query[name] = values
+		}
+		recorder := httptest.NewRecorder()
+		server.authorizeHandler(recorder, httptest.NewRequest(http.MethodGet, authorizePath+"?"+query.Encode(), nil))
+		return recorder
+	}
+	wantError := func(name string, recorder *httptest.ResponseRecorder, errorCode string) {
+		t.Helper()
+		location, err := url.Parse(recorder.Header().Get("Location"))
+		if recorder.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+			t.Fatalf("%s: got status %d, location %q, want the redirect to the app", name, recorder.Code, recorder.Header().Get("Location"))
+		}
+		query := location.Query()
+		if query.Get("error") != errorCode || query.Get("error_description") == "" || query.Get("state") != "xyz" {
+			t.Errorf("%s: got %v, want error %s with the description and the state", name, query, errorCode)
+		}
+	}
+
+	// the redirect_uri is not trusted until validated
+	if recorder := authorizeWith(url.Values{"redirect_uri": {"http://attacker.example/"}, "response_type": {"token"}}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unregistered redirect_uri: got status %d, want 400", recorder.Code)
+	}
+	wantError("response_type", authorizeWith(url.Values{"response_type": {"token"}}), "unsupported_response_type")
+	wantError("scope", authorizeWith(url.Values{"scope": {"openid payments"}}), "invalid_scope")
+	wantError("code_challenge_method", authorizeWith(url.Values{"code_challenge_method": {"S256"}}), "invalid_request")
+
+	sessionID := sessionIDOf(t, authorizeWith(url.Values{}))
+	submit(server, sessionID, "john.doe@email.com", "jjj")
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "action": {"deny"}, "remember": {"yes"}}))
+	wantError("deny", recorder, "access_denied")
+	user := server.users.FindUserByEmail("john.doe@email.com")
+	if consent := server.consents.FindConsent(user.ID, "4b3d6d22-a317-456c-9f2e-793bd6a29ac0"); consent != nil {
+		t.Errorf("a denied request must not be remembered: %+v", consent)
+	}
+}
+
+// pollDeviceToken polls the token endpoint with the device_code as the demo app
+func pollDeviceToken(server *Server, deviceCode string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.tokenHandler(recorder, newFormRequest(tokenPath, url.Values{
+		"grant_type":    {deviceCodeGrantType},
+		"device_code":   {deviceCode},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}))
+	return recorder
+}
+
+// startDeviceAuthorization calls the device authorization endpoint as the demo app
+func startDeviceAuthorization(t *testing.T, server *Server, scope string) DeviceAuthorizationResponse {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.deviceAuthorizationHandler(recorder, newFormRequest(deviceAuthorizationPath, url.Values{
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"scope":         {scope},
+	}))
+	var response DeviceAuthorizationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("device authorization: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return response
+}
+
+func wantOauth2Error(t *testing.T, name string, recorder *httptest.ResponseRecorder, errorCode string) {
+	t.Helper()
+	var response Oauth2ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusBadRequest || response.Error != errorCode {
+		t.Errorf("%s: got status %d: %s, want %s", name, recorder.Code, recorder.Body.String(), errorCode)
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	server := newTestServer(t)
+	device := startDeviceAuthorization(t, server, "profile")
+	if device.Interval != database.DeviceCodeInterval || device.ExpiresIn != database.DeviceCodeExpiresIn ||
+		device.VerificationURIComplete != deviceVerificationURI+"?user_code="+url.QueryEscape(device.UserCode) {
+		t.Errorf("unexpected device authorization: %+v", device)
+	}
+
+	// the device polls while the user is away, then too fast: the interval grows by 5 seconds
+	wantOauth2Error(t, "first poll", pollDeviceToken(server, device.DeviceCode), "authorization_pending")
+	wantOauth2Error(t, "poll within the interval", pollDeviceToken(server, device.DeviceCode), "slow_down")
+	if found := server.sessions.FindDeviceAuthorizationByDeviceCode(device.DeviceCode); found.Interval != database.DeviceCodeInterval+5 {
+		t.Errorf("got interval %d after slow_down, want %d", found.Interval, database.DeviceCodeInterval+5)
+	}
+
+	// the user types the code on the verification page, logs in and approves
+	recorder := httptest.NewRecorder()
+	server.deviceVerificationHandler(recorder, newFormRequest(devicePath, url.Values{"user_code": {device.UserCode}}))
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil || location.Path != loginPath {
+		t.Fatalf("verification: got status %d, location %q, want the login", recorder.Code, recorder.Header().Get("Location"))
+	}
+	sessionID := location.Query().Get("session_id")
+	if recorder := submit(server, sessionID, "john.doe@email.com", "jjj"); !strings.Contains(recorder.Body.String(), "See your name") {
+		t.Fatalf("the device must be approved on the consent page: got status %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "scope": {"profile"}}))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("approval: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// once the interval has passed, the device gets its tokens, once
+	waitInterval := func(deviceCode string) {
+		found := server.sessions.FindDeviceAuthorizationByDeviceCode(deviceCode)
+		if err := server.sessions.UpdateDeviceAuthorizationPolling(deviceCode, time.Now().Add(-time.Duration(found.Interval)*time.Second), found.Interval); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantOauth2Error(t, "poll after the approval within the interval", pollDeviceToken(server, device.DeviceCode), "slow_down")
+	waitInterval(device.DeviceCode)
+	recorder = pollDeviceToken(server, device.DeviceCode)
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("poll after the approval: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if response.AccessToken == "" || response.RefreshToken == "" || response.Scope != "profile" || response.IDToken != "" {
+		t.Errorf("unexpected token response: %+v", response)
+	}
+	if claims := userInfo(t, server, response.AccessToken); claims["name"] != "John Doe" {
+		t.Errorf("the access token must belong to the user who approved: %v", claims)
+	}
+	wantOauth2Error(t, "device_code reused", pollDeviceToken(server, device.DeviceCode), "invalid_grant")
+}
+
+// approveDevice types the user_code on the verification page, logs in as John Doe and approves the device
+func approveDevice(t *testing.T, server *Server, userCode string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.deviceVerificationHandler(recorder, newFormRequest(devicePath, url.Values{"user_code": {userCode}}))
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusFound || err != nil || location.Path != loginPath {
+		t.Fatalf("verification: got status %d, location %q, want the login", recorder.Code, recorder.Header().Get("Location"))
+	}
+	sessionID := location.Query().Get("session_id")
+	if recorder := submit(server, sessionID, "john.doe@email.com", "jjj"); recorder.Code != http.StatusOK {
+		t.Fatalf("login: got status %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}, "scope": {"profile"}}))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("approval: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeviceFlowIDToken(t *testing.T) {
+	server := newTestServer(t)
+	device := startDeviceAuthorization(t, server, "openid profile")
+	approveDevice(t, server, device.UserCode)
+
+	recorder := pollDeviceToken(server, device.DeviceCode)
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("poll after the approval: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(response.IDToken, claims); err != nil {
+		t.Fatalf("the openid scope must get an id_token: %v", err)
+	}
+	if amr := fmt.Sprint(claims["amr"]); amr != "[pwd]" || claims["sub"] != server.users.FindUserByEmail("john.doe@email.com").ID {
+		t.Errorf("the id_token must tell who approved the device and how: %v", claims)
+	}
+	if authTime, _ := claims["auth_time"].(float64); time.Since(time.Unix(int64(authTime), 0)) > time.Minute {
+		t.Errorf("the id_token must tell when the user logged in: %v", claims["auth_time"])
+	}
+}
+
+// TestConcurrentDevicePolls must be run with -race: the polls of the approved device can't all exchange the device_code
+func TestConcurrentDevicePolls(t *testing.T) {
+	server := newTestServer(t)
+	device := startDeviceAuthorization(t, server, "profile")
+	approveDevice(t, server, device.UserCode)
+
+	const polls = 20
+	var found sync.WaitGroup
+	found.Add(polls)
+	server.sessions = &pollBarrierStore{SessionStore: server.sessions, found: &found}
+	var issued int32
+	var wg sync.WaitGroup
+	for i := 0; i < polls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pollDeviceToken(server, device.DeviceCode).Code == http.StatusOK {
+				atomic.AddInt32(&issued, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if issued != 1 {
+		t.Errorf("the device_code must be exchanged once: got %d token responses", issued)
+	}
+}
+
+// pollBarrierStore lets the polls of the device go on only once all of them have found the approved device
+// authorization, and never slows them down
+type pollBarrierStore struct {
+	database.SessionStore
+	found *sync.WaitGroup
+}
+
+func (s *pollBarrierStore) FindDeviceAuthorizationByDeviceCode(deviceCode string) *database.DeviceAuthorization {
+	deviceAuthorization := s.SessionStore.FindDeviceAuthorizationByDeviceCode(deviceCode)
+	s.found.Done()
+	s.found.Wait()
+	return deviceAuthorization
+}
+
+func (s *pollBarrierStore) UpdateDeviceAuthorizationPolling(deviceCode string, lastPolledAt time.Time, interval int) error {
+	return nil
+}
+
+// expiredDeviceSessionStore finds the device authorizations as if they had been started before their lifetime
+type expiredDeviceSessionStore struct {
+	database.SessionStore
+}
+
+func (s *expiredDeviceSessionStore) FindDeviceAuthorizationByDeviceCode(deviceCode string) *database.DeviceAuthorization {
+	return expireDeviceAuthorization(s.SessionStore.FindDeviceAuthorizationByDeviceCode(deviceCode))
+}
+
+func (s *expiredDeviceSessionStore) FindDeviceAuthorizationByUserCode(userCode string) *database.DeviceAuthorization {
+	return expireDeviceAuthorization(s.SessionStore.FindDeviceAuthorizationByUserCode(userCode))
+}
+
+func expireDeviceAuthorization(deviceAuthorization *database.DeviceAuthorization) *database.DeviceAuthorization {
+	if deviceAuthorization != nil {
+		deviceAuthorization.CreatedAt = deviceAuthorization.CreatedAt.Add(-database.DeviceCodeExpiresIn*time.Second - time.Minute)
+	}
+	return deviceAuthorization
+}
+
+func TestDeviceFlowExpiredToken(t *testing.T) {
+	server := newTestServer(t)
+	device := startDeviceAuthorization(t, server, "profile")
+	server.sessions = &expiredDeviceSessionStore{SessionStore: server.sessions}
+
+	wantOauth2Error(t, "poll after the expiry", pollDeviceToken(server, device.DeviceCode), "expired_token")
+	recorder := httptest.NewRecorder()
+	server.deviceVerificationHandler(recorder, newFormRequest(devicePath, url.Values{"user_code": {device.UserCode}}))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expired user code: got status %d, want 400", recorder.Code)
+	}
+}
+
+func TestDeniedDeviceAuthorization(t *testing.T) {
+	server := newTestServer(t)
+	deviceAuthorization, err := server.sessions.SaveNewDeviceAuthorization(testClientID, "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauthSession, err := server.sessions.SaveNewOauth2SessionForDevice(deviceAuthorization.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.sessions.UpdateOauth2SessionWithEmail(oauthSession.ID, "john.doe@email.com", []string{amrPassword}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {oauthSession.ID}, "action": {"deny"}}))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("deny: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.tokenHandler(recorder, newFormRequest(tokenPath, url.Values{
+		"grant_type":    {deviceCodeGrantType},
+		"device_code":   {deviceAuthorization.DeviceCode},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}))
+	var response Oauth2ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error != "access_denied" {
+		t.Errorf("polling after the denial: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func endSessionRequest(params url.Values, cookie *http.Cookie) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, endSessionPath+"?"+params.Encode(), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+func TestRPInitiatedLogout(t *testing.T) {
+	server := newTestServer(t)
+	cookie, sessionID := loginWithSSO(t, server)
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}}))
+	redirect, _ := url.Parse(recorder.Header().Get("Location"))
+	recorder = exchangeCode(server, redirect.Query().Get("code"))
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.IDToken == "" {
+		t.Fatalf("token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	const postLogoutRedirectURI = "http://localhost:8081/login"
+
+	// only the registered URIs
+	recorder = httptest.NewRecorder()
+	server.endSessionHandler(recorder, endSessionRequest(url.Values{
+		"id_token_hint":            {response.IDToken},
+		"post_logout_redirect_uri": {"http://attacker.example/"},
+	}, cookie))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("unregistered post_logout_redirect_uri: got status %d, want 400", recorder.Code)
+	}
+
+	// without the id_token_hint the user must confirm
+	recorder = httptest.NewRecorder()
+	server.endSessionHandler(recorder, endSessionRequest(url.Values{
+		"client_id":                {testClientID},
+		"post_logout_redirect_uri": {postLogoutRedirectURI},
+	}, cookie))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `name="confirm"`) {
+		t.Fatalf("logout without id_token_hint: got status %d, want the confirmation page", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-still-logged-in", "", cookie))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("the SSO session must survive the unconfirmed logout: got status %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.endSessionHandler(recorder, endSessionRequest(url.Values{
+		"id_token_hint":            {response.IDToken},
+		"post_logout_redirect_uri": {postLogoutRedirectURI},
+		"state":                    {"xyz"},
+	}, cookie))
+	// the app has a front-channel logout URI: the browser is sent back by the page loading it
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `data-uri="`+postLogoutRedirectURI+`?state=xyz"`) {
+		t.Fatalf("logout: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Error("the SSO cookie must be removed")
+	}
+
+	recorder = httptest.NewRecorder()
+	server.authorizeHandler(recorder, authorizeRequest("state-logged-out", "", cookie))
+	if recorder.Code != http.StatusFound {
+		t.Errorf("after the logout: got status %d, want the redirect to the login", recorder.Code)
+	}
+	if refreshToken := server.tokens.FindRefreshToken(response.RefreshToken); refreshToken == nil || !refreshToken.Revoked {
+		t.Error("the app revokes its tokens on logout: the refresh token must be revoked")
+	}
+}
+
+// testClientStore changes the registered apps found in the demo store
+type testClientStore struct {
+	database.ClientStore
+	update func(app *database.RegisteredOauth2App)
+}
+
+func (s *testClientStore) FindRegisteredAppByID(appID string) *database.RegisteredOauth2App {
+	app := s.ClientStore.FindRegisteredAppByID(appID)
+	if app != nil {
+		s.update(app)
+	}
+	return app
+}
+
+func (s *testClientStore) FindRegisteredAppByClientID(clientID string) *database.RegisteredOauth2App {
+	app := s.ClientStore.FindRegisteredAppByClientID(clientID)
+	if app != nil {
+		s.update(app)
+	}
+	return app
+}
+
+func TestBackchannelAndFrontchannelLogout(t *testing.T) {
+	// the app fails the first notification: it must be retried
+	var attempts int32
+	logoutTokens := make(chan string, 1)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		logoutTokens <- r.PostFormValue("logout_token")
+	}))
+	defer app.Close()
+	const frontchannelLogoutURI = "http://localhost:8081/frontchannel-logout"
+
+	server := newTestServer(t)
+	server.backchannelLogout.RetryBackoff = time.Millisecond
+	server.clients = &testClientStore{ClientStore: server.clients, update: func(registered *database.RegisteredOauth2App) {
+		registered.BackchannelLogoutURI = app.URL
+		registered.FrontchannelLogoutURI = frontchannelLogoutURI
+	}}
+
+	cookie, sessionID := loginWithSSO(t, server)
+	recorder := httptest.NewRecorder()
+	server.consentHandler(recorder, newFormRequest("/oauth/v2/consent", url.Values{"session_id": {sessionID}}))
+	redirect, _ := url.Parse(recorder.Header().Get("Location"))
+	recorder = exchangeCode(server, redirect.Query().Get("code"))
+	var response AccessTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.IDToken == "" {
+		t.Fatalf("token: got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	idTokenClaims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(response.IDToken, idTokenClaims); err != nil || idTokenClaims["sid"] == nil {
+		t.Fatalf("the id_token must have the sid of the SSO session: %v %v", idTokenClaims, err)
+	}
+	sid := idTokenClaims["sid"].(string)
+
+	recorder = httptest.NewRecorder()
+	server.endSessionHandler(recorder, endSessionRequest(url.Values{"id_token_hint": {response.IDToken}}, cookie))
+	wantIframe := html.EscapeString(frontchannelLogoutURI + "?" + url.Values{"iss": {utils.Issuer}, "sid": {sid}}.Encode())
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `<iframe src="`+wantIframe+`"`) {
+		t.Fatalf("logout: got status %d, want the iframe of the front-channel logout URI: %s", recorder.Code, recorder.Body.String())
+	}
+
+	select {
+	case logoutToken := <-logoutTokens:
+		claims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(logoutToken, claims); err != nil {
+			t.Fatal(err)
+		}
+		events, _ := claims["events"].(map[string]interface{})
+		if claims["sid"] != sid || claims["sub"] != idTokenClaims["sub"] || claims["aud"] != testClientID || events[utils.BackchannelLogoutEvent] == nil {
+			t.Errorf("unexpected logout token claims: %v", claims)
+		}
+		if _, hasNonce := claims["nonce"]; hasNonce {
+			t.Error("the logout token must not have a nonce")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no logout token received by the back-channel logout URI")
+	}
+}
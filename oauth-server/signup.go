@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"provider/database"
+	"provider/utils"
+
+	"github.com/google/uuid"
+)
+
+// minPasswordLength is the shortest password accepted at the sign up
+const minPasswordLength = 8
+
+// signupPageHandler shows the sign up form: the session_id brings the user back to the login flow once the email is verified
+func signupPageHandler(w http.ResponseWriter, r *http.Request) {
+	signupPage, err := generateSignupPage(r.URL.Query().Get("session_id"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the sign up page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
+	fmt.Fprint(w, signupPage)
+}
+
+// signupHandler creates the user, not verified, and sends the verification link to the email.
+// The response is the same if the email is already registered, so that the form can't tell which emails have an account:
+// the owner of the email gets a new link if the account is not verified yet, a notice otherwise
+func (s *Server) signupHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.FormValue("session_id")
+	name := strings.TrimSpace(r.FormValue("name"))
+	password := r.FormValue("password")
+	address, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(address.Address)
+	if name == "" {
+		http.Error(w, "missing the following param from the 'POST /signup' request: name", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if user := s.users.FindUserByEmail(email); user != nil {
+		s.sendSignupAgainEmail(user, sessionID)
+		s.writeSignupDonePage(w, email)
+		return
+	}
+
+	passwordHash, err := utils.HashPassword(password)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the user", http.StatusInternalServerError)
+		return
+	}
+	user := &database.User{
+		ID:       uuid.New().String(),
+		Name:     name,
+		Email:    email,
+		Password: passwordHash,
+		Roles:    "user",
+	}
+	err = s.users.SaveNewUser(user)
+	if err == database.ErrEmailAlreadyRegistered {
+		// signed up at the same time by another request
+		s.writeSignupDonePage(w, email)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the user", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s signed up\n", email)
+
+	if err := s.sendVerificationEmail(user, sessionID); err != nil {
+		// the user can sign up again to get a new link
+		log.Println("Unable to send the verification email:", err)
+	}
+	s.writeSignupDonePage(w, email)
+}
+
+// sendSignupAgainEmail answers the sign up with the email of an existing user
+func (s *Server) sendSignupAgainEmail(user *database.User, sessionID string) {
+	var err error
+	if user.EmailVerified {
+		err = s.mailer.Send(user.Email, "You already have a WalrusMail account",
+			fmt.Sprintf("Hi %s,\n\nsomeone has tried to sign up to WalrusMail with your email address, but you already have an account: "+
+				"log in with your password.\nIf it was not you, you can ignore this email.\n", user.Name))
+	} else {
+		err = s.sendVerificationEmail(user, sessionID)
+	}
+	if err != nil {
+		log.Println("Unable to send the email:", err)
+	}
+}
+
+// sendVerificationEmail sends the single-use link that verifies the email of the user
+func (s *Server) sendVerificationEmail(user *database.User, sessionID string) error {
+	link, err := s.newEmailLink(user, database.EmailTokenPurposeVerifyEmail, database.EmailVerificationTokenExpiresIn, verifyEmailPath, sessionID)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(user.Email, "Verify your WalrusMail email address",
+		fmt.Sprintf("Hi %s,\n\nopen this link to verify your email address and complete the sign up:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't sign up to WalrusMail, you can ignore this email.\n",
+			user.Name, link, database.EmailVerificationTokenExpiresIn/3600))
+}
+
+// newEmailLink stores a new single-use token for the user and returns the link to the path that uses it:
+// the session_id, if any, brings the user back to the login flow in progress
+func (s *Server) newEmailLink(user *database.User, purpose string, expiresIn int, path, sessionID string) (string, error) {
+	token, tokenHash, err := utils.GenerateEmailToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.emailTokens.SaveNewEmailToken(tokenHash, user.ID, purpose, expiresIn); err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("token", token)
+	if sessionID != "" {
+		params.Set("session_id", sessionID)
+	}
+	return utils.Issuer + path + "?" + params.Encode(), nil
+}
+
+// verifyEmailHandler is the link sent by email: it verifies the email of the user and sends them back to the login
+func (s *Server) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	emailToken := s.emailTokens.ConsumeEmailToken(utils.HashEmailToken(r.URL.Query().Get("token")), database.EmailTokenPurposeVerifyEmail)
+	if emailToken == nil || emailToken.IsExpired() {
+		http.Error(w, "The link is invalid or expired: sign up again to receive a new one", http.StatusBadRequest)
+		return
+	}
+	if err := s.users.MarkUserEmailAsVerified(emailToken.UserID); err != nil {
+		log.Println(err)
+		http.Error(w, "Error while verifying the email", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Email of the user %s verified\n", emailToken.UserID)
+
+	s.backToLogin(w, r, r.URL.Query().Get("session_id"), "email_verified")
+}
+
+// backToLogin goes on with the login flow the user has left, unless it has expired in the meantime:
+// in that case the page tells the user to go back to the application
+func (s *Server) backToLogin(w http.ResponseWriter, r *http.Request, sessionID, pageName string) {
+	if sessionID != "" && s.sessions.FindOauth2SessionByID(sessionID) != nil {
+		http.Redirect(w, r, utils.Issuer+loginPath+"?"+url.Values{"session_id": {sessionID}}.Encode(), http.StatusFound)
+		return
+	}
+	htmlPage, err := generatePage(pageName, "")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, htmlPage)
+}
+
+// validatePassword enforces the minimum length of the passwords chosen by the users
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Errorf("The password must be at least %d characters long", minPasswordLength)
+	}
+	return nil
+}
+
+func (s *Server) writeSignupDonePage(w http.ResponseWriter, email string) {
+	signupDonePage, err := generateSignupDonePage(email)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error while creating the page", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, signupDonePage)
+}
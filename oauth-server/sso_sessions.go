@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"provider/database"
+	"provider/utils"
+)
+
+// ssoCookieName is the cookie of the browser where the user has logged in
+const ssoCookieName = "walrusmail_sso"
+
+// SSOSessionPolicy sets how long a user stays logged in on the browser: the session ends after being idle too long
+// or at its absolute expiry, whatever comes first, and then the user must log in again
+type SSOSessionPolicy struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	CookieKey   []byte // signs the cookie
+}
+
+// DefaultSSOSessionPolicy keeps the user logged in for 12 hours, unless idle for 30 minutes
+func DefaultSSOSessionPolicy() SSOSessionPolicy {
+	return SSOSessionPolicy{
+		IdleTimeout: 30 * time.Minute,
+		MaxLifetime: 12 * time.Hour,
+		CookieKey:   utils.GenerateCookieKey(),
+	}
+}
+
+// configureFromEnv overrides the lifetimes (in seconds) with SSO_IDLE_TIMEOUT and SSO_MAX_LIFETIME, and the key generated
+// on startup with SSO_COOKIE_SECRET, so that the sessions survive a restart of the server
+func (p *SSOSessionPolicy) configureFromEnv() error {
+	idleTimeout, err := positiveIntFromEnv("SSO_IDLE_TIMEOUT", int(p.IdleTimeout/time.Second))
+	if err != nil {
+		return err
+	}
+	maxLifetime, err := positiveIntFromEnv("SSO_MAX_LIFETIME", int(p.MaxLifetime/time.Second))
+	if err != nil {
+		return err
+	}
+	p.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	p.MaxLifetime = time.Duration(maxLifetime) * time.Second
+	if secret := os.Getenv("SSO_COOKIE_SECRET"); secret != "" {
+		if len(secret) < utils.CookieKeyLength {
+			return fmt.Errorf("SSO_COOKIE_SECRET must be at least %d characters long", utils.CookieKeyLength)
+		}
+		p.CookieKey = []byte(secret)
+	}
+	return nil
+}
+
+// startSSOSession keeps the user logged in on the browser after the login of the Oauth2 session has been completed
+func (s *Server) startSSOSession(w http.ResponseWriter, user *database.User, oauthSession *database.Oauth2Session) {
+	ssoSession, err := s.sessions.SaveNewSSOSession(user.ID, oauthSession.AMR, oauthSession.AuthTime, s.ssoSessions.IdleTimeout, s.ssoSessions.MaxLifetime)
+	if err != nil {
+		// the login goes on anyway: the user will see the login form next time
+		log.Println("Unable to start the SSO session:", err)
+		return
+	}
+	if err := s.sessions.UpdateOauth2SessionWithSSOSession(oauthSession.ID, ssoSession.ID); err != nil {
+		log.Println(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    utils.SignCookieValue(ssoSession.ID, s.ssoSessions.CookieKey),
+		Path:     "/",
+		MaxAge:   int(s.ssoSessions.MaxLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(utils.Issuer, "https://"),
+		// Lax: the cookie is sent when the apps redirect the browser to the authorization endpoint, not with their requests
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// currentSSOSession returns the valid session of the cookie, if any: the cookie of an ended session is removed
+func (s *Server) currentSSOSession(w http.ResponseWriter, r *http.Request) *database.SSOSession {
+	cookie, err := r.Cookie(ssoCookieName)
+	if err != nil {
+		return nil
+	}
+	id, valid := utils.VerifyCookieValue(cookie.Value, s.ssoSessions.CookieKey)
+	var ssoSession *database.SSOSession
+	if valid {
+		ssoSession = s.sessions.FindSSOSession(id)
+	}
+	if ssoSession == nil || ssoSession.IsExpired() {
+		clearSSOCookie(w)
+		return nil
+	}
+	return ssoSession
+}
+
+func clearSSOCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(utils.Issuer, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// resumeSSOSession skips the login form if the browser has a valid session: the Oauth2 session with the ID
+// is authenticated as the user of the SSO session and the consent is asked. False if the user must log in
+func (s *Server) resumeSSOSession(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	ssoSession := s.currentSSOSession(w, r)
+	if ssoSession == nil {
+		return false
+	}
+	// the user may have enrolled to the second factor since the login
+	user := s.users.FindUserByID(ssoSession.UserID)
+	if user == nil || !isLoginComplete(user, ssoSession.AMR) {
+		return false
+	}
+	oauthSession, err := s.sessions.UpdateOauth2SessionWithEmail(sessionID, user.Email, ssoSession.AMR, ssoSession.AuthTime)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if err := s.sessions.UpdateOauth2SessionWithSSOSession(sessionID, ssoSession.ID); err != nil {
+		log.Println(err)
+		return false
+	}
+	if err := s.sessions.TouchSSOSession(ssoSession.ID, s.ssoSessions.IdleTimeout); err != nil {
+		log.Println(err)
+	}
+	log.Printf("Login of %s resumed from the SSO session\n", user.Email)
+	s.askConsent(w, r, user, oauthSession)
+	return true
+}
+
+// sessionID returns the sid of the SSO session the user of the Oauth2 session has logged in with: empty if none,
+// or if the session has ended in the meantime
+func (s *Server) sessionID(oauthSession *database.Oauth2Session) string {
+	if oauthSession.SSOSessionID == "" {
+		return ""
+	}
+	ssoSession := s.sessions.FindSSOSession(oauthSession.SSOSessionID)
+	if ssoSession == nil {
+		return ""
+	}
+	return ssoSession.SID
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// CookieKeyLength is the size in bytes of the keys signing the cookies
+const CookieKeyLength = 32
+
+// GenerateCookieKey generates a random key to sign the cookies: the cookies signed with it are lost on restart
+func GenerateCookieKey() []byte {
+	key := make([]byte, CookieKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// SignCookieValue appends the HMAC-SHA256 of the value, so that the browser can't forge or change it
+func SignCookieValue(value string, key []byte) string {
+	return value + "." + cookieSignature(value, key)
+}
+
+// VerifyCookieValue returns the value of a cookie signed with the key: false if the signature doesn't match
+func VerifyCookieValue(signedValue string, key []byte) (string, bool) {
+	i := strings.LastIndex(signedValue, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, signature := signedValue[:i], signedValue[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(cookieSignature(value, key))) {
+		return "", false
+	}
+	return value, true
+}
+
+func cookieSignature(value string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// GenerateEmailToken generates the random token of a link sent by email and the hash to store in its place:
+// whoever reads the database can't use the links
+func GenerateEmailToken() (token, tokenHash string, err error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(randomBytes)
+	return token, HashEmailToken(token), nil
+}
+
+// HashEmailToken hashes the token of the link: the tokens are random so a plain SHA-256 is enough
+func HashEmailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
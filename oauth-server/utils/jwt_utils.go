@@ -6,29 +6,73 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 )
 
-// secret used to sign the jwt
-var secret = []byte("my_secret_key")
+// AccessTokenType is the typ header of the access tokens (RFC 9068): the id_tokens and the logout tokens are signed
+// with the same keys, but they can't be used as bearer tokens
+const AccessTokenType = "at+jwt"
 
-// IssueJWT issues a new jwt based on the user's data
-func IssueJWT(user database.User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"name":  user.Name,
-		"email": user.Email,
-		"roles": user.Roles,
-		"exp":   time.Now().Add(60 * time.Minute).Unix(),
-	})
-	// Sign the token with the secret key
-	return token.SignedString(secret)
+// AccessTokenAudience is the aud claim of the access tokens: the resource and administration endpoints they are
+// meant for are served by this server
+const AccessTokenAudience = Issuer
+
+// IssueJWT issues a new jwt based on the user's data, granted to the client app for the given scope:
+// name and email claims are added only if the matching scopes have been granted.
+// It returns also the jti claim identifying the token in the revocation list
+func IssueJWT(user database.User, clientID, scope string, amr []string) (tokenString, jti string, err error) {
+	now := time.Now()
+	jti = uuid.New().String()
+	claims := jwt.MapClaims{
+		"jti":       jti,
+		"sub":       user.ID,
+		"aud":       AccessTokenAudience,
+		"roles":     user.Roles,
+		"client_id": clientID,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(database.AccessTokenExpiresIn * time.Second).Unix(),
+	}
+	if HasScope(scope, "profile") {
+		claims["name"] = user.Name
+	}
+	if HasScope(scope, "email") {
+		claims["email"] = user.Email
+	}
+	// the authentication methods are known only for the tokens issued right after the login
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+	// Sign the token with the private signing key
+	tokenString, err = signJWT(AccessTokenType, claims)
+	return tokenString, jti, err
 }
 
-// VerifyJWT is used to verify the jwt signature
-func VerifyJWT(tokenString string) (*jwt.Token, error) {
-	// Parse the token with the secret key
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
+// IssueClientJWT issues a new jwt on behalf of the registered app itself (client_credentials grant): no user is involved
+func IssueClientJWT(app database.RegisteredOauth2App, scope string) (string, error) {
+	now := time.Now()
+	// Sign the token with the private signing key
+	return signJWT(AccessTokenType, jwt.MapClaims{
+		"jti":       uuid.New().String(),
+		"sub":       app.ClientID,
+		"aud":       AccessTokenAudience,
+		"client_id": app.ClientID,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(database.AccessTokenExpiresIn * time.Second).Unix(),
 	})
+}
+
+// IsClientJWT tells if the decoded claims belong to a jwt issued to an app rather than to a user
+func IsClientJWT(claims jwt.MapClaims) bool {
+	clientID, ok := claims["client_id"].(string)
+	return ok && claims["sub"] == clientID
+}
+
+// VerifyJWT is used to verify the jwt signature, rejecting the tokens in the revocation list and the jwt that are not access tokens
+func VerifyJWT(tokenString string, tokenStore database.TokenStore) (*jwt.Token, error) {
+	// Parse the token with the public key matching its kid
+	token, err := jwt.ParseWithClaims(tokenString, &jwt.MapClaims{}, verificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -36,18 +80,19 @@ func VerifyJWT(tokenString string) (*jwt.Token, error) {
 	if !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+	if err := checkAccessToken(token, *token.Claims.(*jwt.MapClaims)); err != nil {
+		return nil, err
+	}
+	if IsJWTRevoked(*token.Claims.(*jwt.MapClaims), tokenStore) {
+		return nil, fmt.Errorf("revoked token")
+	}
 	return token, nil
 }
 
-// DecodeJWT decodes the issue jwt
-func DecodeJWT(tokenString string) (claims jwt.MapClaims, isValid bool) {
+// DecodeJWT decodes the issued access token, rejecting the tokens in the revocation list and the jwt that are not access tokens
+func DecodeJWT(tokenString string, tokenStore database.TokenStore) (claims jwt.MapClaims, isValid bool) {
 	// Decode the token and verify the signature
-	decodedToken, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return secret, nil
-	})
+	decodedToken, err := jwt.Parse(tokenString, verificationKey)
 	if err != nil {
 		fmt.Println("Error decoding token:", err)
 		return nil, false
@@ -66,26 +111,36 @@ func DecodeJWT(tokenString string) (claims jwt.MapClaims, isValid bool) {
 		return nil, false
 	}
 
+	if err := checkAccessToken(decodedToken, claims); err != nil {
+		fmt.Println("Invalid access token:", err)
+		return nil, false
+	}
+
+	if IsJWTRevoked(claims, tokenStore) {
+		fmt.Println("Token has been revoked")
+		return nil, false
+	}
+
 	return claims, true
 }
 
-// ClaimsToUser converts the jwt claims into the user object
-func ClaimsToUser(claims jwt.MapClaims) (*database.User, error) {
-	name, ok := claims["name"].(string)
-	if !ok {
-		return nil, fmt.Errorf("missing name claim")
+// checkAccessToken rejects the jwt without the typ of the access tokens, the ones meant for another audience
+// and the ones without the jti that lets them be revoked
+func checkAccessToken(token *jwt.Token, claims jwt.MapClaims) error {
+	if typ, _ := token.Header["typ"].(string); typ != AccessTokenType {
+		return fmt.Errorf("not an access token: typ %v", token.Header["typ"])
 	}
-	email, ok := claims["email"].(string)
-	if !ok {
-		return nil, fmt.Errorf("missing email claim")
+	if !claims.VerifyAudience(AccessTokenAudience, true) {
+		return fmt.Errorf("the access token is meant for another audience: aud %v", claims["aud"])
 	}
-	roles, ok := claims["roles"].(string)
-	if !ok {
-		return nil, fmt.Errorf("missing roles claim")
+	if jti, _ := claims["jti"].(string); jti == "" {
+		return fmt.Errorf("the access token has no jti")
 	}
-	return &database.User{
-		Name:  name,
-		Email: email,
-		Roles: roles,
-	}, nil
+	return nil
+}
+
+// IsJWTRevoked checks the jti claim against the revocation list
+func IsJWTRevoked(claims jwt.MapClaims, tokenStore database.TokenStore) bool {
+	jti, ok := claims["jti"].(string)
+	return ok && tokenStore.IsAccessTokenRevoked(jti)
 }
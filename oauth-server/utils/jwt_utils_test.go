@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"provider/database"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestOnlyAccessTokensAreBearerTokens(t *testing.T) {
+	if err := InitKeyRing(AlgES256, ""); err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewMemoryStore()
+	user := *store.FindUserByEmail("john.doe@email.com")
+	app := *store.FindRegisteredAppByClientID("12345")
+
+	accessToken, _, err := IssueJWT(user, app.ClientID, "openid profile", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientToken, err := IssueClientJWT(app, "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := IssueIDToken(user, app.ClientID, "openid profile", "nonce", "sid", time.Now(), []string{"pwd"}, accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logoutToken, err := IssueLogoutToken(user.ID, app.ClientID, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a token that couldn't be revoked
+	withoutJTI, err := signJWT(AccessTokenType, jwt.MapClaims{"sub": user.ID, "aud": AccessTokenAudience, "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a token meant for another resource server, or for none
+	otherAudience, err := signJWT(AccessTokenType, jwt.MapClaims{"jti": "other-audience", "sub": user.ID, "aud": "http://localhost:8082", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutAudience, err := signJWT(AccessTokenType, jwt.MapClaims{"jti": "without-audience", "sub": user.ID, "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		token string
+		valid bool
+	}{
+		"access token":                      {accessToken, true},
+		"client access token":               {clientToken, true},
+		"id_token":                          {idToken, false},
+		"logout token":                      {logoutToken, false},
+		"access token without jti":          {withoutJTI, false},
+		"access token for another audience": {otherAudience, false},
+		"access token without audience":     {withoutAudience, false},
+	} {
+		if _, isValid := DecodeJWT(test.token, store); isValid != test.valid {
+			t.Errorf("%s: DecodeJWT got valid %v, want %v", name, isValid, test.valid)
+		}
+		if _, err := VerifyJWT(test.token, store); (err == nil) != test.valid {
+			t.Errorf("%s: VerifyJWT got error %v, want valid %v", name, err, test.valid)
+		}
+	}
+}
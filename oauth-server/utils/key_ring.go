@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	cron "github.com/robfig/cron/v3"
+)
+
+// KeyStatus is the stage of a signing key in its lifecycle
+type KeyStatus string
+
+const (
+	// KeyStatusNext keys are published in the JWKS before being used, so the consumers can cache them in advance
+	KeyStatusNext KeyStatus = "next"
+	// KeyStatusActive is the only key used to sign the new jwt
+	KeyStatusActive KeyStatus = "active"
+	// KeyStatusRetired keys don't sign anymore but still verify the jwt issued before the rotation
+	KeyStatusRetired KeyStatus = "retired"
+)
+
+// RetiredKeyTTL is how long a retired key is kept: it must outlive any jwt signed while the key was active
+const RetiredKeyTTL = 24 * time.Hour
+
+// DefaultKeyRotationSchedule is the cron spec of the rotation job if none is provided
+const DefaultKeyRotationSchedule = "@every 24h"
+
+// the key ring holds the active key, the next one and the retired ones not yet expired
+var (
+	keyRing      = []*SigningKey{}
+	keyRingAlg   string
+	keyRingMutex sync.RWMutex
+	// the key loaded from a PEM file is the only one and is never rotated: it belongs to the deployment
+	keyRingPEMFile string
+	// where the generated keys are saved, if set, so that the jwt issued before a restart can still be verified
+	keyRingFile string
+)
+
+// InitKeyRing loads the key of the given algorithm from a PEM file, that stays active since it is never rotated,
+// or, if pemFile is empty, generates the active and the next keys, lost on restart.
+// It defaults to RS256 if alg is empty
+func InitKeyRing(alg, pemFile string) error {
+	if alg == "" {
+		alg = AlgRS256
+	}
+	var ring []*SigningKey
+	if pemFile == "" {
+		active, err := GenerateSigningKey(alg)
+		if err != nil {
+			return err
+		}
+		next, err := GenerateSigningKey(alg)
+		if err != nil {
+			return err
+		}
+		active.Status = KeyStatusActive
+		next.Status = KeyStatusNext
+		ring = []*SigningKey{active, next}
+	} else {
+		active, err := ReadSigningKeyFromPEM(alg, pemFile)
+		if err != nil {
+			return err
+		}
+		active.Status = KeyStatusActive
+		ring = []*SigningKey{active}
+	}
+
+	keyRingMutex.Lock()
+	defer keyRingMutex.Unlock()
+	keyRingAlg = alg
+	keyRing = ring
+	keyRingPEMFile = pemFile
+	keyRingFile = ""
+	return nil
+}
+
+// LoadKeyRing loads the key ring saved in ringFile or, if the file doesn't exist yet, generates the keys of the given
+// algorithm and saves them there: the rotations are saved too. It defaults to RS256 if alg is empty
+func LoadKeyRing(alg, ringFile string) error {
+	if alg == "" {
+		alg = AlgRS256
+	}
+	ring, err := readKeyRing(alg, ringFile)
+	if os.IsNotExist(err) {
+		if err := InitKeyRing(alg, ""); err != nil {
+			return err
+		}
+		keyRingMutex.Lock()
+		defer keyRingMutex.Unlock()
+		keyRingFile = ringFile
+		return writeKeyRing(ringFile, keyRingAlg, keyRing)
+	}
+	if err != nil {
+		return err
+	}
+
+	keyRingMutex.Lock()
+	defer keyRingMutex.Unlock()
+	keyRingAlg = alg
+	keyRing = ring
+	keyRingPEMFile = ""
+	keyRingFile = ringFile
+	return nil
+}
+
+// StartKeyRotation schedules the rotation of the signing keys with the given cron spec, unless the key has been
+// loaded from a PEM file
+func StartKeyRotation(schedule string) error {
+	keyRingMutex.RLock()
+	pemFile := keyRingPEMFile
+	keyRingMutex.RUnlock()
+	if pemFile != "" {
+		log.Printf("The signing key loaded from %s is never rotated\n", pemFile)
+		return nil
+	}
+	if schedule == "" {
+		schedule = DefaultKeyRotationSchedule
+	}
+	c := cron.New()
+	_, err := c.AddFunc(schedule, func() {
+		log.Println("Rotating the signing keys... [Job started]")
+		if err := RotateSigningKeys(); err != nil {
+			log.Println("error while rotating the signing keys: ", err)
+			return
+		}
+		log.Println("Rotating the signing keys... [Job completed]")
+	})
+	if err != nil {
+		return fmt.Errorf("invalid key rotation schedule %s: %v", schedule, err)
+	}
+	c.Start()
+	return nil
+}
+
+// RotateSigningKeys promotes the next key to active, retires the active one, generates a new next key
+// and drops the retired keys older than RetiredKeyTTL. The ring is left untouched if it can't be saved
+func RotateSigningKeys() error {
+	newNext, err := GenerateSigningKey(keyRingAlgorithm())
+	if err != nil {
+		return err
+	}
+	newNext.Status = KeyStatusNext
+
+	keyRingMutex.Lock()
+	defer keyRingMutex.Unlock()
+	if keyRingPEMFile != "" {
+		return fmt.Errorf("the signing key loaded from %s is never rotated", keyRingPEMFile)
+	}
+	now := time.Now()
+	rotated := []*SigningKey{}
+	for _, key := range keyRing {
+		rotatedKey := *key
+		switch key.Status {
+		case KeyStatusActive:
+			rotatedKey.Status = KeyStatusRetired
+			rotatedKey.RetiredAt = now
+		case KeyStatusNext:
+			rotatedKey.Status = KeyStatusActive
+		case KeyStatusRetired:
+			if now.Sub(key.RetiredAt) > RetiredKeyTTL {
+				continue
+			}
+		}
+		rotated = append(rotated, &rotatedKey)
+	}
+	rotated = append(rotated, newNext)
+	if keyRingFile != "" {
+		if err := writeKeyRing(keyRingFile, keyRingAlg, rotated); err != nil {
+			return err
+		}
+	}
+	keyRing = rotated
+	return nil
+}
+
+// PublicJWKS returns the key set with all the public keys in the key ring, retired and next ones included
+func PublicJWKS() JWKS {
+	keyRingMutex.RLock()
+	defer keyRingMutex.RUnlock()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range keyRing {
+		if key.Status == KeyStatusRetired && time.Since(key.RetiredAt) > RetiredKeyTTL {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	return jwks
+}
+
+// SigningAlgorithm returns the algorithm used to sign the issued jwt
+func SigningAlgorithm() string {
+	return keyRingAlgorithm()
+}
+
+func keyRingAlgorithm() string {
+	keyRingMutex.RLock()
+	defer keyRingMutex.RUnlock()
+	return keyRingAlg
+}
+
+func activeSigningKey() *SigningKey {
+	keyRingMutex.RLock()
+	defer keyRingMutex.RUnlock()
+	for _, key := range keyRing {
+		if key.Status == KeyStatusActive {
+			return key
+		}
+	}
+	return nil
+}
+
+// findVerificationKey looks for the key with the given kid among the ones that can verify a jwt
+func findVerificationKey(kid string) *SigningKey {
+	keyRingMutex.RLock()
+	defer keyRingMutex.RUnlock()
+	for _, key := range keyRing {
+		if key.KID != kid {
+			continue
+		}
+		switch key.Status {
+		case KeyStatusActive:
+			return key
+		case KeyStatusRetired:
+			if time.Since(key.RetiredAt) <= RetiredKeyTTL {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// signJWT signs the claims with the active key, setting the kid header
+func signJWT(tokenType string, claims jwt.MapClaims) (string, error) {
+	key := activeSigningKey()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.KID
+	token.Header["typ"] = tokenType
+	return token.SignedString(key.PrivateKey)
+}
+
+// verificationKey is the jwt.Keyfunc selecting the public key by the kid header of the jwt
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := findVerificationKey(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid: %v", token.Header["kid"])
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.PublicKey, nil
+}
+
+// savedKeyRing is the JSON file the key ring is saved to: it holds the private keys, so only the owner can read it
+type savedKeyRing struct {
+	Alg  string     `json:"alg"`
+	Keys []savedKey `json:"keys"`
+}
+
+type savedKey struct {
+	PrivateKey string    `json:"private_key"` // PKCS #8 PEM
+	Status     KeyStatus `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	RetiredAt  time.Time `json:"retired_at"`
+}
+
+// writeKeyRing saves the ring to a temporary file renamed over ringFile, so that a crash never leaves half a ring
+func writeKeyRing(ringFile, alg string, ring []*SigningKey) error {
+	saved := savedKeyRing{Alg: alg}
+	for _, key := range ring {
+		der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+		if err != nil {
+			return err
+		}
+		saved.Keys = append(saved.Keys, savedKey{
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			Status:     key.Status,
+			CreatedAt:  key.CreatedAt,
+			RetiredAt:  key.RetiredAt,
+		})
+	}
+	jsonBytes, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := ringFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, jsonBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, ringFile)
+}
+
+// readKeyRing reads the ring saved in ringFile, dropping the retired keys older than RetiredKeyTTL
+func readKeyRing(alg, ringFile string) ([]*SigningKey, error) {
+	jsonBytes, err := ioutil.ReadFile(ringFile)
+	if err != nil {
+		return nil, err
+	}
+	var saved savedKeyRing
+	if err := json.Unmarshal(jsonBytes, &saved); err != nil {
+		return nil, fmt.Errorf("invalid key ring %s: %v", ringFile, err)
+	}
+	if saved.Alg != alg {
+		return nil, fmt.Errorf("the key ring %s holds %s keys, not %s", ringFile, saved.Alg, alg)
+	}
+	ring := []*SigningKey{}
+	hasActive := false
+	for _, savedKey := range saved.Keys {
+		if savedKey.Status == KeyStatusRetired && time.Since(savedKey.RetiredAt) > RetiredKeyTTL {
+			continue
+		}
+		block, _ := pem.Decode([]byte(savedKey.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("invalid key ring %s: a private key is not PEM encoded", ringFile)
+		}
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key ring %s: %v", ringFile, err)
+		}
+		key, err := newSigningKey(alg, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.Status = savedKey.Status
+		key.CreatedAt = savedKey.CreatedAt
+		key.RetiredAt = savedKey.RetiredAt
+		hasActive = hasActive || key.Status == KeyStatusActive
+		ring = append(ring, key)
+	}
+	if !hasActive {
+		return nil, fmt.Errorf("invalid key ring %s: no active key", ringFile)
+	}
+	return ring, nil
+}
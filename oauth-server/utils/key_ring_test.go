@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func signTestJWT(t *testing.T) string {
+	t.Helper()
+	token, err := signJWT(AccessTokenType, jwt.MapClaims{"sub": "john", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func verifies(token string) bool {
+	_, err := jwt.Parse(token, verificationKey)
+	return err == nil
+}
+
+func jwksKIDs() map[string]bool {
+	kids := map[string]bool{}
+	for _, key := range PublicJWKS().Keys {
+		kids[key.Kid] = true
+	}
+	return kids
+}
+
+func TestKeyRotation(t *testing.T) {
+	if err := InitKeyRing(AlgES256, ""); err != nil {
+		t.Fatal(err)
+	}
+	oldKID := activeSigningKey().KID
+	token := signTestJWT(t)
+	if err := RotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	newKID := activeSigningKey().KID
+	if newKID == oldKID {
+		t.Fatal("the active key hasn't changed")
+	}
+
+	// during the grace period, the tokens signed with the retired key still verify
+	if !verifies(token) {
+		t.Error("the token signed before the rotation must verify")
+	}
+	if kids := jwksKIDs(); !kids[oldKID] || !kids[newKID] {
+		t.Errorf("the JWKS must list the retired and the active keys: got %v", kids)
+	}
+	if !verifies(signTestJWT(t)) {
+		t.Error("the token signed with the new key must verify")
+	}
+
+	keyRingMutex.Lock()
+	for _, key := range keyRing {
+		if key.KID == oldKID {
+			key.RetiredAt = time.Now().Add(-RetiredKeyTTL - time.Minute)
+		}
+	}
+	keyRingMutex.Unlock()
+	if verifies(token) {
+		t.Error("the token signed with a key retired for longer than RetiredKeyTTL must not verify")
+	}
+	if jwksKIDs()[oldKID] {
+		t.Error("the expired key must be dropped from the JWKS")
+	}
+}
+
+func TestKeyRingSurvivesRestart(t *testing.T) {
+	ringFile := filepath.Join(t.TempDir(), "key-ring.json")
+	if err := LoadKeyRing(AlgES256, ringFile); err != nil {
+		t.Fatal(err)
+	}
+	beforeRotation := signTestJWT(t)
+	if err := RotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	activeKID := activeSigningKey().KID
+	afterRotation := signTestJWT(t)
+
+	// a restart: the ring is lost from memory and loaded back from the file
+	if err := InitKeyRing(AlgES256, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadKeyRing(AlgES256, ringFile); err != nil {
+		t.Fatal(err)
+	}
+	if activeSigningKey().KID != activeKID {
+		t.Errorf("the active key must be the one saved: got %s, want %s", activeSigningKey().KID, activeKID)
+	}
+	if !verifies(beforeRotation) || !verifies(afterRotation) {
+		t.Error("the tokens issued before the restart must verify")
+	}
+
+	if err := LoadKeyRing(AlgRS256, ringFile); err == nil {
+		t.Error("the ring saved for another algorithm must be rejected")
+	}
+}
+
+func TestPEMKeyIsNeverRotated(t *testing.T) {
+	key, err := GenerateSigningKey(AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	pemFile := filepath.Join(t.TempDir(), "private-key.pem")
+	if err := ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitKeyRing(AlgES256, pemFile); err != nil {
+		t.Fatal(err)
+	}
+	if activeSigningKey().KID != key.KID {
+		t.Fatal("the PEM key must be the active key")
+	}
+	if err := RotateSigningKeys(); err == nil {
+		t.Error("the PEM key must not be rotated")
+	}
+	if activeSigningKey().KID != key.KID || len(PublicJWKS().Keys) != 1 {
+		t.Errorf("the PEM key must stay the only key: got %v", jwksKIDs())
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"provider/database"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Issuer identifies this server in the iss claim of the id_token
+const Issuer = "http://localhost:8080"
+
+// IDTokenExpiresIn is the validity of an id_token in seconds
+const IDTokenExpiresIn = 60 * 60
+
+// LogoutTokenExpiresIn is the validity of a logout token in seconds: it's sent right after the logout
+const LogoutTokenExpiresIn = 2 * 60
+
+// IDTokenType is the typ header of the id_tokens
+const IDTokenType = "JWT"
+
+// LogoutTokenType is the typ header of the logout tokens (OpenID Connect Back-Channel Logout section 2.4)
+const LogoutTokenType = "logout+jwt"
+
+// BackchannelLogoutEvent is the only event of the logout tokens (OpenID Connect Back-Channel Logout section 2.4)
+const BackchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// HasScope tells if the space separated scope contains the wanted one
+func HasScope(scope, wanted string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueIDToken issues the OpenID Connect id_token of the authenticated user:
+// profile and email claims are added only if the matching scopes have been granted.
+// The sid claim identifies the SSO session the user has logged in with, if any
+func IssueIDToken(user database.User, clientID, scope, nonce, sid string, authTime time.Time, amr []string, accessToken string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       Issuer,
+		"sub":       user.ID,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(IDTokenExpiresIn * time.Second).Unix(),
+		"auth_time": authTime.Unix(),
+		"at_hash":   accessTokenHash(accessToken),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+	if HasScope(scope, "profile") {
+		claims["name"] = user.Name
+	}
+	if HasScope(scope, "email") {
+		claims["email"] = user.Email
+	}
+	return signJWT(IDTokenType, claims)
+}
+
+// IssueLogoutToken issues the token posted to the back-channel logout URI of the app when the user logs out of the SSO session
+// identified by sid: it has the events claim instead of the nonce, so that it can't be mistaken for an id_token
+func IssueLogoutToken(userID, clientID, sid string) (string, error) {
+	now := time.Now()
+	return signJWT(LogoutTokenType, jwt.MapClaims{
+		"iss":    Issuer,
+		"sub":    userID,
+		"aud":    clientID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(LogoutTokenExpiresIn * time.Second).Unix(),
+		"jti":    uuid.New().String(),
+		"sid":    sid,
+		"events": map[string]interface{}{BackchannelLogoutEvent: map[string]interface{}{}},
+	})
+}
+
+// VerifyIDTokenHint verifies the signature and the issuer of an id_token issued by this server and returns its claims.
+// The id_token may have expired: the apps send the one they received at the login to ask to log the user out
+func VerifyIDTokenHint(idToken string) (jwt.MapClaims, error) {
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(idToken, verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyIssuer(Issuer, true) {
+		return nil, fmt.Errorf("the token has not been issued by %s", Issuer)
+	}
+	// the access tokens are signed with the same keys, but they have no at_hash
+	if _, isIDToken := claims["at_hash"]; !isIDToken {
+		return nil, fmt.Errorf("the token is not an id_token")
+	}
+	return claims, nil
+}
+
+// accessTokenHash computes the at_hash claim: the left half of the access_token hash,
+// using the hash function of the signing algorithm (OpenID Connect Core section 3.1.3.6)
+func accessTokenHash(accessToken string) string {
+	var h hash.Hash
+	if SigningAlgorithm() == AlgEdDSA {
+		h = sha512.New()
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(accessToken))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hashing algorithms: the hashes are stored as PHC strings ($argon2id$...) or bcrypt strings ($2a$...)
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+// argon2id parameters (OWASP recommendation: 19 MiB of memory, 2 iterations, 1 degree of parallelism)
+const (
+	argon2Memory      = 19 * 1024
+	argon2Iterations  = 2
+	argon2Parallelism = 1
+	argon2SaltLength  = 16
+	argon2KeyLength   = 32
+)
+
+// BcryptCost is the cost of the bcrypt hashes
+const BcryptCost = 12
+
+// passwordHashAlg is the algorithm of the new hashes: the passwords hashed otherwise are rehashed on the next login
+var passwordHashAlg = PasswordHashArgon2id
+
+// dummyPasswordHash is verified when the user doesn't exist, so that the response takes the same time: it is hashed
+// with the configured algorithm, since the hashes of the users are upgraded to it on login
+var dummyPasswordHash, _ = HashPassword("dummy password")
+
+// SetPasswordHashAlgorithm chooses the algorithm of the new hashes: argon2id (default) or bcrypt
+func SetPasswordHashAlgorithm(alg string) (err error) {
+	switch alg {
+	case "":
+		passwordHashAlg = PasswordHashArgon2id
+	case PasswordHashArgon2id, PasswordHashBcrypt:
+		passwordHashAlg = alg
+	default:
+		return fmt.Errorf("Unsupported password hash algorithm %s: use %s or %s", alg, PasswordHashArgon2id, PasswordHashBcrypt)
+	}
+	dummyPasswordHash, err = HashPassword("dummy password")
+	return err
+}
+
+// HashPassword hashes the password with a random salt using the configured algorithm
+func HashPassword(password string) (string, error) {
+	if passwordHashAlg == PasswordHashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+		return string(hash), err
+	}
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Iterations, argon2Memory, argon2Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Iterations, argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword compares the password with the stored hash in constant time:
+// needsRehash tells if the hash should be upgraded to the configured algorithm and parameters
+func VerifyPassword(password, hash string) (valid, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		valid, upToDate := verifyArgon2id(password, hash)
+		return valid, valid && (!upToDate || passwordHashAlg != PasswordHashArgon2id)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false, false
+		}
+		cost, _ := bcrypt.Cost([]byte(hash))
+		return true, passwordHashAlg != PasswordHashBcrypt || cost != BcryptCost
+	default:
+		// legacy entries store the base64 encoding of the plain text password: always rehashed
+		encoded := base64.StdEncoding.EncodeToString([]byte(password))
+		valid := subtle.ConstantTimeCompare([]byte(encoded), []byte(hash)) == 1
+		return valid, valid
+	}
+}
+
+// VerifyDummyPassword spends the time of a password verification when there's no hash to verify
+func VerifyDummyPassword(password string) {
+	VerifyPassword(password, dummyPasswordHash)
+}
+
+// verifyArgon2id checks a $argon2id$v=19$m=...,t=...,p=...$salt$key hash: upToDate tells if it uses the current parameters
+func verifyArgon2id(password, hash string) (valid, upToDate bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false
+	}
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	valid = subtle.ConstantTimeCompare(computed, key) == 1
+	upToDate = memory == argon2Memory && iterations == argon2Iterations && parallelism == argon2Parallelism &&
+		len(salt) == argon2SaltLength && len(key) == argon2KeyLength
+	return valid, upToDate
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	defer SetPasswordHashAlgorithm(PasswordHashArgon2id)
+
+	argon2Hash, err := HashPassword("jjj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argon2Hash, "$argon2id$v=19$") {
+		t.Fatalf("expected a PHC argon2id hash, got %s", argon2Hash)
+	}
+	if other, _ := HashPassword("jjj"); other == argon2Hash {
+		t.Error("every hash must have its own salt")
+	}
+
+	if err := SetPasswordHashAlgorithm(PasswordHashBcrypt); err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := HashPassword("jjj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPasswordHashAlgorithm(PasswordHashArgon2id); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		password    string
+		hash        string
+		valid       bool
+		needsRehash bool
+	}{
+		{"argon2id", "jjj", argon2Hash, true, false},
+		{"argon2id wrong password", "jjk", argon2Hash, false, false},
+		{"bcrypt", "jjj", bcryptHash, true, true},
+		{"bcrypt wrong password", "jjk", bcryptHash, false, false},
+		{"legacy base64", "jjj", "ampq", true, true},
+		{"legacy base64 wrong password", "jjk", "ampq", false, false},
+		{"malformed argon2id", "jjj", "$argon2id$v=19$m=x", false, false},
+	}
+	for _, test := range tests {
+		valid, needsRehash := VerifyPassword(test.password, test.hash)
+		if valid != test.valid || needsRehash != test.needsRehash {
+			t.Errorf("%s: got valid=%t needsRehash=%t, want valid=%t needsRehash=%t", test.name, valid, needsRehash, test.valid, test.needsRehash)
+		}
+	}
+}
+
+func TestVerifyPasswordOutdatedArgon2idParameters(t *testing.T) {
+	// the same password hashed with lighter parameters must be valid and rehashed
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("jjj"), salt, 1, 4096, 1, argon2KeyLength)
+	hash := "$argon2id$v=19$m=4096,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	valid, needsRehash := VerifyPassword("jjj", hash)
+	if !valid || !needsRehash {
+		t.Errorf("got valid=%t needsRehash=%t, want both true", valid, needsRehash)
+	}
+}
+
+func TestDummyPasswordHashUsesTheConfiguredAlgorithm(t *testing.T) {
+	defer SetPasswordHashAlgorithm(PasswordHashArgon2id)
+
+	// an unknown email must cost as much as the hashes of the users, upgraded to the configured algorithm on login
+	if err := SetPasswordHashAlgorithm(PasswordHashBcrypt); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dummyPasswordHash, "$2a$") {
+		t.Errorf("expected a bcrypt dummy hash, got %s", dummyPasswordHash)
+	}
+	if err := SetPasswordHashAlgorithm(PasswordHashArgon2id); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dummyPasswordHash, "$argon2id$") {
+		t.Errorf("expected an argon2id dummy hash, got %s", dummyPasswordHash)
+	}
+}
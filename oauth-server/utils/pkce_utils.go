@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// PKCE code challenge methods (RFC 7636)
+const (
+	CodeChallengeMethodS256  = "S256"
+	CodeChallengeMethodPlain = "plain"
+)
+
+// code_verifier and code_challenge are 43 to 128 chars taken from the unreserved characters [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~"
+var pkceValueRegexp = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// IsValidCodeChallengeMethod tells if the method sent in the authorize request is supported
+func IsValidCodeChallengeMethod(method string) bool {
+	return method == CodeChallengeMethodS256 || method == CodeChallengeMethodPlain
+}
+
+// IsValidPKCEValue checks the syntax of a code_verifier or of a plain code_challenge
+func IsValidPKCEValue(value string) bool {
+	return pkceValueRegexp.MatchString(value)
+}
+
+// VerifyCodeChallenge checks the code_verifier sent to the token endpoint against the code_challenge sent to the authorize endpoint
+func VerifyCodeChallenge(codeVerifier, codeChallenge, codeChallengeMethod string) bool {
+	if !IsValidPKCEValue(codeVerifier) {
+		return false
+	}
+	var computed string
+	switch codeChallengeMethod {
+	case CodeChallengeMethodS256:
+		hash := sha256.Sum256([]byte(codeVerifier))
+		computed = base64.RawURLEncoding.EncodeToString(hash[:])
+	case CodeChallengeMethodPlain:
+		computed = codeVerifier
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(codeChallenge)) == 1
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Supported signing algorithms for the issued jwt
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is the asymmetric key pair used to sign the issued jwt: only the public part is published in the JWKS
+type SigningKey struct {
+	KID        string // RFC 7638 thumbprint of the public key, set as kid header of the issued jwt
+	Method     jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+	Status     KeyStatus
+	CreatedAt  time.Time
+	RetiredAt  time.Time // zero until the key is retired
+}
+
+// JWK is the JSON Web Key (RFC 7517) representation of a public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // EC and OKP curve
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the JSON Web Key Set served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// GenerateSigningKey generates a new key pair for the given algorithm
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+	switch alg {
+	case AlgRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s: must be %s, %s or %s", alg, AlgRS256, AlgES256, AlgEdDSA)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(alg, privateKey)
+}
+
+// ReadSigningKeyFromPEM reads the private key for the given algorithm from a PEM file
+func ReadSigningKeyFromPEM(alg, pemFile string) (*SigningKey, error) {
+	pemBytes, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+	var privateKey crypto.PrivateKey
+	switch alg {
+	case AlgRS256:
+		privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+	case AlgES256:
+		privateKey, err = jwt.ParseECPrivateKeyFromPEM(pemBytes)
+	case AlgEdDSA:
+		privateKey, err = jwt.ParseEdPrivateKeyFromPEM(pemBytes)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s: must be %s, %s or %s", alg, AlgRS256, AlgES256, AlgEdDSA)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the %s private key from %s: %v", alg, pemFile, err)
+	}
+	return newSigningKey(alg, privateKey)
+}
+
+func newSigningKey(alg string, privateKey crypto.PrivateKey) (*SigningKey, error) {
+	key := &SigningKey{
+		Method:     jwt.GetSigningMethod(alg),
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now(),
+	}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.PublicKey = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s requires a P-256 key", AlgES256)
+		}
+		key.PublicKey = &k.PublicKey
+	case ed25519.PrivateKey:
+		key.PublicKey = k.Public()
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	kid, err := thumbprint(key.JWK())
+	if err != nil {
+		return nil, err
+	}
+	key.KID = kid
+	return key, nil
+}
+
+// JWK returns the public part of the signing key as a JSON Web Key
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{
+		Use: "sig",
+		Alg: k.Method.Alg(),
+		Kid: k.KID,
+	}
+	switch publicKey := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		// coordinates are padded to the curve size (RFC 7518 section 6.2.1.2)
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+	return jwk
+}
+
+// thumbprint computes the JWK thumbprint (RFC 7638) used as kid
+func thumbprint(jwk JWK) (string, error) {
+	// only the required members, in lexicographic order
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		return "", fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+	jsonBytes, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(jsonBytes)
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) parameters: the defaults every authenticator app supports
+const (
+	TOTPIssuer    = "WalrusMail"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 // steps accepted before and after the current one, for the clock drift of the phone
+	totpSecretLen = 20
+)
+
+// RecoveryCodesCount is how many recovery codes are generated at the enrollment
+const RecoveryCodesCount = 10
+
+// recovery codes are typed by the user so they use only lower case letters and digits that can't be confused
+const recoveryCodeCharset = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret generates the base32 shared secret of a new TOTP enrollment
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// TOTPURI is the otpauth:// URI the authenticator apps scan as a QR code
+func TOTPURI(accountName, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(TOTPIssuer + ":" + accountName)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// VerifyTOTP checks the code against the steps around the current time and returns the matching step,
+// which must be greater than the last one used to prevent the replay of the same code
+func VerifyTOTP(secret, code string, now time.Time) (step int64, valid bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPCode returns the code of the secret at the given time
+func TOTPCode(secret string, now time.Time) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, now.Unix()/totpPeriod), nil
+}
+
+// totpCode is the HOTP value (RFC 4226) of the time step
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateRecoveryCodes generates the single-use codes that replace the TOTP when the phone is lost:
+// the codes are shown once to the user, only their hashes are stored
+func GenerateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodesCount; i++ {
+		randomBytes := make([]byte, 10)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, nil, err
+		}
+		code := make([]byte, 0, 11)
+		for j, b := range randomBytes {
+			if j == 5 {
+				code = append(code, '-')
+			}
+			code = append(code, recoveryCodeCharset[int(b)%len(recoveryCodeCharset)])
+		}
+		codes = append(codes, string(code))
+		hashes = append(hashes, HashRecoveryCode(string(code)))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes the recovery code ignoring case, spaces and dashes typed by the user:
+// the codes are random so a plain SHA-256 is enough
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
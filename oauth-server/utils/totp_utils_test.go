@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("at %d: got %s, want %s", unix, code, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	previous, _ := TOTPCode(secret, now.Add(-totpPeriod*time.Second))
+	if step, valid := VerifyTOTP(secret, previous, now); !valid || step != now.Unix()/totpPeriod-1 {
+		t.Errorf("the code of the previous step must be accepted for the clock drift")
+	}
+	tooOld, _ := TOTPCode(secret, now.Add(-3*totpPeriod*time.Second))
+	if _, valid := VerifyTOTP(secret, tooOld, now); valid {
+		t.Errorf("the code of an old step must be rejected")
+	}
+
+	uri := TOTPURI("john.doe@email.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/WalrusMail:john.doe@email.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected otpauth URI %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodesCount || len(hashes) != RecoveryCodesCount {
+		t.Fatalf("expected %d codes, got %d", RecoveryCodesCount, len(codes))
+	}
+	// the user can type the code without the dash and in upper case
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if HashRecoveryCode(typed) != hashes[0] {
+		t.Errorf("the typed code %s doesn't match %s", typed, codes[0])
+	}
+}